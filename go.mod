@@ -2,9 +2,20 @@ module httpserver
 
 go 1.20
 
-require github.com/go-redis/redis/v8 v8.11.5
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/go-redis/redis/v8 v8.11.5
+	github.com/yuin/goldmark v1.5.6
+	google.golang.org/grpc v1.58.3
+	google.golang.org/protobuf v1.31.0
+)
 
 require (
-	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/net v0.12.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
 )
@@ -1,19 +1,49 @@
 package main
 
 import (
+	"bytes"
+	"container/list"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-redis/redis/v8"
+	"github.com/yuin/goldmark"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 const maxLogFiles = 10
@@ -24,6 +54,8 @@ var (
 	logMutex       sync.Mutex
 	fileLogger     *log.Logger // 用于文件的日志记录器
 	consoleLogger  *log.Logger // 用于控制台的日志记录器
+	syslogLogger   *log.Logger // 用于远程 syslog 的日志记录器，未配置时为 nil
+	syslogOnly     bool        // 为 true 时访问日志只发送到 syslog，不写入 server.log
 )
 
 func init() {
@@ -32,50 +64,278 @@ func init() {
 	if err != nil {
 		log.Fatalf("Error opening server.log: %v", err)
 	}
-	fileLogger = log.New(logFile, "", log.LstdFlags)
+	fileLogger = log.New(checkedLogWriter{logFile}, "", log.LstdFlags)
 
 	// 初始化 consoleLogger，包含颜色代码
 	consoleLogger = log.New(os.Stdout, "", log.LstdFlags)
 
-	lastLogDate = time.Now().Truncate(24 * time.Hour)
+	lastLogDate = currentLogPeriod()
 }
 
-func rotateLogFile() error {
+// 日志文件写入失败（例如磁盘已满）的次数，以及两次控制台警告之间的最短间隔
+var (
+	logWriteErrors        atomic.Int64
+	logWriteWarnInterval  = time.Minute
+	lastLogWriteWarning   time.Time
+	logWriteWarningsMutex sync.Mutex
+)
+
+// 检查日志文件写入错误的 io.Writer。log.Logger 会丢弃写入错误，这里计数并按间隔在控制台警告，
+// 请求照常处理
+type checkedLogWriter struct {
+	w io.Writer
+}
+
+func (cw checkedLogWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if err != nil {
+		failures := logWriteErrors.Add(1)
+		logWriteWarningsMutex.Lock()
+		warn := time.Since(lastLogWriteWarning) >= logWriteWarnInterval
+		if warn {
+			lastLogWriteWarning = time.Now()
+		}
+		logWriteWarningsMutex.Unlock()
+		if warn {
+			consoleLogger.Printf(colorRed+"Error writing to the log file (%d failed writes so far): %v\n"+colorReset, failures, err)
+		}
+	}
+	return n, err
+}
+
+// 日志轮转周期，默认每天轮转一次
+var rotateInterval = 24 * time.Hour
+
+// 解析 -rotate-interval：hourly、daily 或自定义的时长
+func parseRotateInterval(value string) (time.Duration, error) {
+	switch value {
+	case "hourly":
+		return time.Hour, nil
+	case "daily":
+		return 24 * time.Hour, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("expected hourly, daily or a duration: %v", err)
+	}
+	if interval < time.Minute {
+		return 0, fmt.Errorf("interval %s is shorter than 1m", interval)
+	}
+	return interval, nil
+}
+
+// 当前日志周期的起始时间
+func currentLogPeriod() time.Time {
+	return time.Now().Truncate(rotateInterval)
+}
+
+// 归档文件名：按天轮转时沿用 server1.log 到 server10.log 的循环编号；
+// 其他周期以周期起始时间命名，整小时的周期精确到小时，否则精确到分钟，例如 server-2024-01-02-15.log
+func archiveLogName() string {
+	if rotateInterval == 24*time.Hour {
+		currentLogFile = (currentLogFile % maxLogFiles) + 1
+		return fmt.Sprintf("server%d.log", currentLogFile)
+	}
+	layout := "2006-01-02-1504"
+	if rotateInterval%time.Hour == 0 {
+		layout = "2006-01-02-15"
+	}
+	base := "server-" + lastLogDate.Format(layout)
+	name := base + ".log"
+	// 同一周期内手动轮转多次时不覆盖已有的归档
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s.%d.log", base, i)
+	}
+}
+
+// 按时间命名的归档只保留最新的 maxLogFiles 个
+func pruneLogArchives() {
+	names, _ := filepath.Glob("server-*.log")
+	if len(names) <= maxLogFiles {
+		return
+	}
+	modTimes := make(map[string]time.Time, len(names))
+	for _, name := range names {
+		if info, err := os.Stat(name); err == nil {
+			modTimes[name] = info.ModTime()
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return modTimes[names[i]].Before(modTimes[names[j]]) })
+	for _, name := range names[:len(names)-maxLogFiles] {
+		os.Remove(name)
+	}
+}
+
+// 轮转日志文件，返回归档后的文件名
+func rotateLogFile() (string, error) {
 	logMutex.Lock()
 	defer logMutex.Unlock()
 
 	// 计算新的日志文件名
-	currentLogFile = (currentLogFile % maxLogFiles) + 1
-	newLogFileName := fmt.Sprintf("server%d.log", currentLogFile)
+	newLogFileName := archiveLogName()
 
 	// 重命名当前的 server.log
 	err := os.Rename("server.log", newLogFileName)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// 创建一个新的 server.log 文件
 	file, err := os.OpenFile("server.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// 更新 fileLogger 以使用新的文件
-	fileLogger.SetOutput(file)
+	fileLogger.SetOutput(checkedLogWriter{file})
+	if rotateInterval != 24*time.Hour {
+		pruneLogArchives()
+	}
 
-	// 更新 lastLogDate 为今天
-	lastLogDate = time.Now().Truncate(24 * time.Hour)
-	return nil
+	// 更新 lastLogDate 为当前周期
+	lastLogDate = currentLogPeriod()
+	return newLogFileName, nil
 }
 
+// 轮转失败后（例如磁盘已满）在该间隔内不再重试，避免每个请求都访问出错的文件系统
+var (
+	rotateRetryInterval = time.Minute
+	lastRotateFailure   time.Time
+	rotating            atomic.Bool
+)
+
 func checkLogRotation() {
-	today := time.Now().Truncate(24 * time.Hour)
-	if lastLogDate.Before(today) {
-		err := rotateLogFile()
-		if err != nil {
-			log.Fatalf("Error rotating log file: %v", err)
+	period := currentLogPeriod()
+	logMutex.Lock()
+	due := lastLogDate.Before(period) && time.Since(lastRotateFailure) >= rotateRetryInterval
+	logMutex.Unlock()
+
+	// 同一时间只允许一个请求执行轮转
+	if !due || !rotating.CompareAndSwap(false, true) {
+		return
+	}
+	defer rotating.Store(false)
+
+	if _, err := rotateLogFile(); err != nil {
+		// 轮转失败时继续写入当前的日志文件
+		logMutex.Lock()
+		lastRotateFailure = time.Now()
+		logMutex.Unlock()
+		consoleLogger.Printf(colorRed+"Error rotating log file, retrying in %s: %v\n"+colorReset, rotateRetryInterval, err)
+	}
+}
+
+// syslog 设施名称与编号的对应关系
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3,
+	"auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// 远程 syslog 写入器，每次写入发送一条 RFC 3164 格式的消息。连接失败后在后台按退避间隔重连，
+// 重连期间丢弃日志行，请求处理过程中不会等待连接建立
+type syslogWriter struct {
+	mu           sync.Mutex
+	network      string
+	addr         string
+	priority     int
+	hostname     string
+	tag          string
+	conn         net.Conn
+	reconnecting bool
+}
+
+// 重连的退避间隔从 syslogRetryMin 开始每次翻倍，最长 syslogRetryMax；单次写入最多等待 syslogWriteTimeout
+var (
+	syslogRetryMin     = time.Second
+	syslogRetryMax     = 30 * time.Second
+	syslogWriteTimeout = time.Second
+)
+
+var errSyslogUnavailable = errors.New("syslog server unavailable, reconnecting")
+
+// 解析形如 udp://host:514 或 tcp://host:514 的地址，未指定协议时默认使用 UDP
+func newSyslogWriter(target, facility string) (*syslogWriter, error) {
+	code, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+
+	network, addr := "udp", target
+	if i := strings.Index(target, "://"); i >= 0 {
+		network, addr = target[:i], target[i+3:]
+	}
+	if network != "udp" && network != "tcp" {
+		return nil, fmt.Errorf("unsupported syslog network %q", network)
+	}
+
+	hostname, _ := os.Hostname()
+	w := &syslogWriter{
+		network:  network,
+		addr:     addr,
+		priority: code*8 + 6, // 严重级别固定为 info
+		hostname: hostname,
+		tag:      filepath.Base(os.Args[0]),
+	}
+	// 启动时同步连接一次，尽早暴露配置错误；之后的失败由后台重连处理
+	conn, err := net.DialTimeout(w.network, w.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	w.conn = conn
+	return w, nil
+}
+
+// 在后台重连，成功后恢复发送。调用方持有 w.mu
+func (w *syslogWriter) startReconnect() {
+	if w.reconnecting {
+		return
+	}
+	w.reconnecting = true
+	backoff := syslogRetryMin
+	go func() {
+		for {
+			time.Sleep(backoff)
+			conn, err := net.DialTimeout(w.network, w.addr, 5*time.Second)
+			if err == nil {
+				w.mu.Lock()
+				w.conn = conn
+				w.reconnecting = false
+				w.mu.Unlock()
+				consoleLogger.Printf("Reconnected to syslog server %s\n", w.addr)
+				return
+			}
+			if backoff *= 2; backoff > syslogRetryMax {
+				backoff = syslogRetryMax
+			}
 		}
+	}()
+}
+
+func (w *syslogWriter) Write(b []byte) (int, error) {
+	msg := fmt.Sprintf("<%d>%s %s %s[%d]: %s\n",
+		w.priority, time.Now().Format(time.Stamp), w.hostname, w.tag, os.Getpid(), strings.TrimRight(string(b), "\n"))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return 0, errSyslogUnavailable
 	}
+	// 对端不再读取时 TCP 写入会阻塞，设置写超时，避免拖慢请求
+	w.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	if _, err := w.conn.Write([]byte(msg)); err != nil {
+		consoleLogger.Printf(colorRed+"Error sending access log to syslog server %s, dropping lines until it reconnects: %v\n"+colorReset, w.addr, err)
+		w.conn.Close()
+		w.conn = nil
+		w.startReconnect()
+		return 0, err
+	}
+	return len(b), nil
 }
 
 // ANSI 颜色代码
@@ -106,11 +366,39 @@ func coloredMethod(method string) string {
 	}
 }
 
+// 控制台日志只为这些方法的请求着色，nil 表示全部着色
+var colorMethods map[string]bool
+
+// 解析 -color-methods：all、none、mutating（POST、PUT、PATCH、DELETE）或逗号分隔的方法列表
+func parseColorMethods(value string) (map[string]bool, error) {
+	switch value {
+	case "all":
+		return nil, nil
+	case "none":
+		return map[string]bool{}, nil
+	case "mutating":
+		value = "POST,PUT,PATCH,DELETE"
+	}
+	methods := make(map[string]bool)
+	for _, method := range strings.Split(value, ",") {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" {
+			return nil, fmt.Errorf("empty method in %q", value)
+		}
+		methods[method] = true
+	}
+	return methods, nil
+}
+
+func consoleColored(method string) bool {
+	return colorMethods == nil || colorMethods[strings.ToUpper(method)]
+}
+
 // 定义一个 HTTP 日志记录器
 type loggingResponseWriter struct {
 	http.ResponseWriter
 	statusCode  int
-	length      int
+	length      int64
 	wroteHeader bool // 新增字段，用于跟踪是否已经写入头部
 }
 
@@ -122,9 +410,37 @@ func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
 	if !lrw.wroteHeader {
 		lrw.WriteHeader(http.StatusOK)
 	}
-	size, err := lrw.ResponseWriter.Write(b)
-	lrw.length += size
-	return size, err
+	// 底层写入器可能只写入部分数据而不返回错误，继续写入剩余部分，
+	// 没有任何进展时返回 io.ErrShortWrite，避免调用方丢失数据或无限循环
+	written := 0
+	for written < len(b) {
+		size, err := lrw.ResponseWriter.Write(b[written:])
+		written += size
+		lrw.length += int64(size)
+		if err != nil {
+			return written, err
+		}
+		if size == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// 透传 io.ReaderFrom，使 http.ServeContent 的 io.Copy 能继续使用底层连接的 sendfile，
+// 大文件经过整个中间件链时以固定内存流式传输，不会被缓冲
+func (lrw *loggingResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !lrw.wroteHeader {
+		lrw.WriteHeader(http.StatusOK)
+	}
+	n, err := io.Copy(lrw.ResponseWriter, src)
+	lrw.length += n
+	return n, err
+}
+
+// 供 http.ResponseController 找到底层连接，用于设置写截止时间
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
 }
 
 func (lrw *loggingResponseWriter) WriteHeader(statusCode int) {
@@ -136,93 +452,4868 @@ func (lrw *loggingResponseWriter) WriteHeader(statusCode int) {
 	lrw.wroteHeader = true // 设置标志，表示头部已经写入
 }
 
-// 包装处理函数以记录日志
-func logRequest(handler http.Handler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		checkLogRotation()
+// 由 key=value 组成的命令行参数，可重复指定，也可在一个参数中用逗号分隔多个
+type pairList []keyValue
 
-		start := time.Now()
-		lrw := NewLoggingResponseWriter(w)
-		handler.ServeHTTP(lrw, r)
-		duration := time.Since(start)
-		method := coloredMethod(r.Method)
+type keyValue struct {
+	Key   string
+	Value string
+}
 
-		// 从 r.RemoteAddr 中提取 IP 地址
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			// 如果无法解析 IP 地址，使用原始的 RemoteAddr
-			ip = r.RemoteAddr
+func (p *pairList) String() string {
+	if p == nil {
+		return ""
+	}
+	parts := make([]string, len(*p))
+	for i, kv := range *p {
+		parts[i] = kv.Key + "=" + kv.Value
+	}
+	return strings.Join(parts, ",")
+}
+
+func (p *pairList) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(part, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return fmt.Errorf("expected key=value, got %q", part)
 		}
+		*p = append(*p, keyValue{Key: key, Value: strings.TrimSpace(val)})
+	}
+	return nil
+}
 
-		// 控制台日志（包含颜色）
-		consoleLogger.Printf("%s [%s] %s %d %d %d\n",
-			colorCyan+ip+colorReset, method, colorYellow+r.URL.Path+colorReset, lrw.statusCode, duration.Milliseconds(), lrw.length)
+// 请求上下文中注入值使用的 key 类型，避免与其他包冲突
+type contextKey string
 
-		// 文件日志（不包含颜色）
-		fileLogger.Printf("%s [%s] %s %d %d %d\n",
-			ip, r.Method, r.URL.Path, lrw.statusCode, duration.Milliseconds(), lrw.length)
+var (
+	contextValues   pairList // 通过 -context 配置、注入到每个请求上下文的键值对
+	logContextValue bool     // 是否在访问日志中输出注入的键值对
+)
+
+// 将配置的键值对注入请求上下文，供后续处理函数和日志使用
+func injectContext(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqCtx := r.Context()
+		for _, kv := range contextValues {
+			reqCtx = context.WithValue(reqCtx, contextKey(kv.Key), kv.Value)
+		}
+		handler.ServeHTTP(w, r.WithContext(reqCtx))
+	})
+}
+
+// 读取注入到请求上下文中的值
+func contextValue(reqCtx context.Context, key string) string {
+	value, _ := reqCtx.Value(contextKey(key)).(string)
+	return value
+}
+
+// 请求路径和查询字符串的最大长度，超过时在路由和解析查询参数之前返回 414，为 0 时不限制
+var (
+	maxPathLength  int
+	maxQueryLength int
+)
+
+func limitPathLength(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxPathLength > 0 && len(r.URL.Path) > maxPathLength {
+			http.Error(w, "URI Too Long", http.StatusRequestURITooLong)
+			return
+		}
+		if maxQueryLength > 0 && len(r.URL.RawQuery) > maxQueryLength {
+			http.Error(w, "URI Too Long", http.StatusRequestURITooLong)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 在路由之前拒绝可疑的请求路径并记录为安全事件：off 不检查，basic 拒绝空字节、控制字符
+// 和编码后的目录穿越（例如 ..%2f），strict 还拒绝任何编码的斜杠、反斜杠以及 . 和 .. 路径段
+var suspiciousPaths = "off"
+
+// 返回路径可疑的原因，正常路径返回空字符串
+func suspiciousPathReason(r *http.Request) string {
+	escaped := r.URL.EscapedPath()
+	lower := strings.ToLower(escaped)
+	for _, c := range r.URL.Path {
+		if c == 0 {
+			return "null byte"
+		}
+		if c < 0x20 || c == 0x7f {
+			return "control character"
+		}
 	}
+	// 编码后的点或斜杠与 .. 相邻时可能绕过按原始路径做的检查
+	decodedSlashes := strings.NewReplacer("%2f", "/", "%5c", "/", "%2e", ".").Replace(lower)
+	for _, segment := range strings.Split(decodedSlashes, "/") {
+		if segment == ".." && decodedSlashes != lower {
+			return "encoded path traversal"
+		}
+	}
+	if suspiciousPaths != "strict" {
+		return ""
+	}
+	if strings.Contains(lower, "%2f") || strings.Contains(lower, "%5c") || strings.Contains(escaped, "\\") {
+		return "encoded slash or backslash"
+	}
+	for _, segment := range strings.Split(decodedSlashes, "/") {
+		if segment == "." || segment == ".." {
+			return "dot segment"
+		}
+	}
+	return ""
 }
 
-var ctx = context.Background()
-var redisClient *redis.Client
+func rejectSuspiciousPaths(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reason := suspiciousPathReason(r); reason != "" {
+			consoleLogger.Printf(colorRed+"Security: rejected request from %s with suspicious path %q (%s)\n"+colorReset, clientIP(r), r.RequestURI, reason)
+			fileLogger.Printf("Security: rejected request from %s with suspicious path %q (%s)\n", clientIP(r), r.RequestURI, reason)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
 
-// 定义一个结构体用于JSON响应
-type CountResponse struct {
-	Page  string `json:"page"`
-	Count int64  `json:"count"`
+// 单个 IP 同时进行中的请求数上限，超过时返回 429，为 0 时不限制
+var (
+	maxConnsPerIP  int
+	ipInFlight     = make(map[string]int)
+	ipInFlightLock sync.Mutex
+)
+
+func limitConcurrencyPerIP(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		ipInFlightLock.Lock()
+		if ipInFlight[ip] >= maxConnsPerIP {
+			ipInFlightLock.Unlock()
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		ipInFlight[ip]++
+		ipInFlightLock.Unlock()
+
+		// 计数归零时删除条目，避免 map 随不同 IP 的数量增长
+		defer func() {
+			ipInFlightLock.Lock()
+			if ipInFlight[ip]--; ipInFlight[ip] <= 0 {
+				delete(ipInFlight, ip)
+			}
+			ipInFlightLock.Unlock()
+		}()
+		handler.ServeHTTP(w, r)
+	})
 }
 
-func countHandler(w http.ResponseWriter, r *http.Request) {
-	page := r.URL.Query().Get("page")
-	if page == "" {
-		http.Error(w, "Page parameter is missing", http.StatusBadRequest)
-		return
+// 全局同时处理的请求数上限，超过时请求排队等待而不是被拒绝，为 0 时不限制。
+// 排队时间记录在请求上下文中，访问日志以 wait= 输出，用于区分服务器饱和和处理函数本身慢
+var (
+	maxInFlight   int
+	inFlightSlots chan struct{}
+)
+
+type queueWaitKey struct{}
+
+func limitInFlight(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queued := time.Now()
+		select {
+		case inFlightSlots <- struct{}{}:
+		case <-r.Context().Done():
+			// 客户端在排队期间断开，不再处理
+			return
+		}
+		defer func() { <-inFlightSlots }()
+		r = r.WithContext(context.WithValue(r.Context(), queueWaitKey{}, time.Since(queued)))
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 返回请求在 limitInFlight 中的排队时间，未经过排队时 ok 为 false
+func queueWait(r *http.Request) (time.Duration, bool) {
+	wait, ok := r.Context().Value(queueWaitKey{}).(time.Duration)
+	return wait, ok
+}
+
+// 为 true 时拒绝没有 Host 头的请求（例如 HTTP/1.0 客户端），基于 Host 选择内容的功能无法处理这类请求。
+// net/http 已经拒绝缺少 Host 的 HTTP/1.1 请求
+var requireHost bool
+
+func requireHostHeader(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "" {
+			http.Error(w, "Missing Host header", http.StatusBadRequest)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 请求体的最大字节数，为 0 时不限制。声明的 Content-Length 超过限制时直接返回 413，
+// 带 Expect: 100-continue 的客户端因此不会收到 100 Continue，也就不会发送请求体；
+// net/http 只在处理函数第一次读取请求体时发送 100 Continue，并对其他 Expect 值返回 417
+var maxBodySize int64
+
+func limitBodySize(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxBodySize > 0 {
+			if r.ContentLength > maxBodySize {
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			// 分块传输等未声明长度的请求体在读取超过限制时返回错误
+			r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 请求 ID：从配置的请求头读取（缺失或非法时生成），写回同名响应头并放入请求上下文
+var (
+	requestIDHeader      = "X-Request-ID"
+	requestIDTraceparent bool // 请求头缺失时是否使用 W3C traceparent 中的 trace-id
+)
+
+type requestIDKey struct{}
+
+// 只接受长度合理且不含特殊字符的外部请求 ID，防止日志注入
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// traceparent 格式为 version-traceid-parentid-flags，例如 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+var traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" && requestIDTraceparent {
+			// 全零的 trace-id 是非法值
+			if m := traceparentPattern.FindStringSubmatch(r.Header.Get("traceparent")); m != nil && m[1] != strings.Repeat("0", 32) {
+				id = m[1]
+			}
+		}
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// 读取当前请求的 ID
+func requestIDFromContext(reqCtx context.Context) string {
+	id, _ := reqCtx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// 调试用的人为延迟，仅在 -debug 模式下生效，防止误用于生产环境
+var (
+	debugMode  bool
+	delayPairs pairList
+	pathDelays []pathDelay
+)
+
+type pathDelay struct {
+	path  string // 以 / 结尾时按前缀匹配，否则按完整路径匹配
+	delay time.Duration
+}
+
+func parsePathDelays(pairs pairList) ([]pathDelay, error) {
+	delays := make([]pathDelay, 0, len(pairs))
+	for _, kv := range pairs {
+		d, err := time.ParseDuration(kv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay for %s: %v", kv.Key, err)
+		}
+		delays = append(delays, pathDelay{path: kv.Key, delay: d})
 	}
+	return delays, nil
+}
 
-	redisKey := "page.count." + page
+// 在处理匹配路径的请求之前注入延迟，只使用第一个匹配的配置，客户端断开时提前结束等待
+func delayRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, pd := range pathDelays {
+			if r.URL.Path != pd.path && !(strings.HasSuffix(pd.path, "/") && strings.HasPrefix(r.URL.Path, pd.path)) {
+				continue
+			}
+			timer := time.NewTimer(pd.delay)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+			}
+			break
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 访问日志中请求耗时的单位：ms、us 或 ns，默认 ms 以保持兼容
+var logDurationUnit = "ms"
+
+var durationUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+func logDuration(d time.Duration) int64 {
+	return int64(d / durationUnits[logDurationUnit])
+}
+
+// 受信任的代理（例如 CDN 或负载均衡器），只有来自这些地址的请求才信任其注入的请求头
+var trustedProxies []*net.IPNet
+
+// 解析逗号分隔的 IP 或 CIDR 列表，单个 IP 视为只包含该地址的网段
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", part)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
 
-	newCount, err := redisClient.Incr(ctx, redisKey).Result()
+// 直接连接的对端是否为受信任的代理
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
+		host = r.RemoteAddr
 	}
+	ip := net.ParseIP(host)
+	return ip != nil && isTrustedProxy(ip)
+}
 
-	// 创建响应对象
-	response := CountResponse{
-		Page:  page,
-		Count: newCount,
+// CDN 注入的客户端国家/地区请求头，例如 CF-IPCountry，为空时不记录
+var geoHeader string
+
+var geoValuePattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,16}$`)
+
+// 返回受信任代理提供的客户端国家/地区，不可信或格式不正确时返回空字符串
+func clientCountry(r *http.Request) string {
+	if geoHeader == "" || !fromTrustedProxy(r) {
+		return ""
+	}
+	country := r.Header.Get(geoHeader)
+	if !geoValuePattern.MatchString(country) {
+		return ""
 	}
+	return country
+}
 
-	// 设置响应头为JSON
-	w.Header().Set("Content-Type", "application/json")
+// X-Forwarded-For 中属于受信任代理的尾部跳数，为 0 时忽略该请求头
+var forwardedHops int
 
-	// 编码并发送JSON响应
-	json.NewEncoder(w).Encode(response)
+// 从右往左数第 forwardedHops 个 X-Forwarded-For 条目是最外层受信任代理看到的对端地址；
+// 条目少于跳数时使用最左边的条目，条目不是合法 IP 时返回空字符串
+func forwardedClientIP(r *http.Request) string {
+	var entries []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+	i := len(entries) - forwardedHops
+	if i < 0 {
+		i = 0
+	}
+	ip := net.ParseIP(entries[i])
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
 }
 
-func main() {
-	// 定义命令行参数，默认端口为 8080
-	var port string
-	flag.StringVar(&port, "p", "8080", "Define what TCP port to bind to")
+// 从 r.RemoteAddr 中提取客户端 IP 地址，来自受信任代理的请求使用 X-Forwarded-For 中的地址
+func clientIP(r *http.Request) string {
+	if forwardedHops > 0 && fromTrustedProxy(r) {
+		if ip := forwardedClientIP(r); ip != "" {
+			return ip
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// 如果无法解析 IP 地址，使用原始的 RemoteAddr
+		return r.RemoteAddr
+	}
+	return ip
+}
 
-	// 添加 -h 和 --help 选项
-	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
-		flag.PrintDefaults()
+// 处理函数在处理请求的过程中追加到访问日志的字段
+type logFields struct {
+	mu     sync.Mutex
+	fields []keyValue
+}
+
+type logFieldsKey struct{}
+
+// 为当前请求的访问日志追加一个字段，请求未经过 logRequest 时忽略
+func addLogField(r *http.Request, key, value string) {
+	lf, ok := r.Context().Value(logFieldsKey{}).(*logFields)
+	if !ok {
+		return
 	}
-	flag.Parse() // 解析命令行参数
+	lf.mu.Lock()
+	lf.fields = append(lf.fields, keyValue{Key: key, Value: value})
+	lf.mu.Unlock()
+}
 
-	lastLogDate = time.Now().Truncate(24 * time.Hour)
+// 包装处理函数以记录日志
+func logRequest(handler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checkLogRotation()
 
-	http.HandleFunc("/count", countHandler)
-	// 设置文件服务器
-	fileServer := http.FileServer(http.Dir("."))
-	http.Handle("/", logRequest(fileServer))
+		start := time.Now()
+		lrw := NewLoggingResponseWriter(w)
+		fields := &logFields{}
+		r = r.WithContext(context.WithValue(r.Context(), logFieldsKey{}, fields))
+		if logOnStart {
+			logRequestStart(r, start)
+		}
+		handler.ServeHTTP(lrw, r)
+		duration := time.Since(start)
 
-	consoleLogger.Printf(colorGreen+"Starting server on :%s\n"+colorReset, port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+		ip := clientIP(r)
+
+		// 追加客户端国家/地区和注入到上下文中的键值对，记录开始日志时带上请求 ID 以便对应
+		var extra []keyValue
+		if logOnStart {
+			extra = append(extra, keyValue{Key: "id", Value: requestIDFromContext(r.Context())})
+		}
+		if country := clientCountry(r); country != "" {
+			extra = append(extra, keyValue{Key: "country", Value: country})
+		}
+		if logSNI && r.TLS != nil && r.TLS.ServerName != "" {
+			extra = append(extra, keyValue{Key: "sni", Value: r.TLS.ServerName})
+		}
+		if wait, ok := queueWait(r); ok {
+			extra = append(extra, keyValue{Key: "wait", Value: strconv.FormatInt(logDuration(wait), 10)})
+		}
+		// 只记录校验通过的客户端证书；-client-auth request 下未经校验的证书主题完全由客户端决定
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			extra = append(extra, keyValue{Key: "client_cert", Value: r.TLS.VerifiedChains[0][0].Subject.String()})
+		}
+		// 客户端在响应完成前断开（HTTP/1 关闭连接或 HTTP/2 重置流）时请求上下文被取消，
+		// 这不是服务端错误；还没有发出任何响应体时客户端实际上没有收到响应，按惯例记录为 499
+		status := lrw.statusCode
+		if r.Context().Err() == context.Canceled {
+			extra = append(extra, keyValue{Key: "cancelled", Value: "client"})
+			if lrw.length == 0 {
+				status = statusClientClosedRequest
+			}
+		}
+		if logContextValue {
+			for _, kv := range contextValues {
+				extra = append(extra, keyValue{Key: kv.Key, Value: contextValue(r.Context(), kv.Key)})
+			}
+		}
+		fields.mu.Lock()
+		extra = append(extra, fields.fields...)
+		fields.mu.Unlock()
+
+		entry := accessLogEntry{
+			Time:         start,
+			IP:           ip,
+			Method:       r.Method,
+			Path:         loggedPath(r),
+			Status:       status,
+			Duration:     logDuration(duration),
+			DurationUnit: logDurationUnit,
+			Bytes:        lrw.length,
+			extra:        extra,
+			order:        logFieldOrderFor(r.URL.Path),
+		}
+		if len(extra) > 0 {
+			entry.Fields = make(map[string]string, len(extra))
+			for _, kv := range extra {
+				entry.Fields[kv.Key] = kv.Value
+			}
+		}
+
+		// 控制台日志（文本格式包含颜色）
+		if consoleLogFormat == "json" {
+			writeJSONLog(consoleLogger, entry)
+		} else {
+			consoleLogger.Println(entry.text(consoleColored(entry.Method)))
+		}
+
+		// 文件日志（不包含颜色）
+		if !syslogOnly {
+			logAccess(fileLogger, fileLogFormat, entry)
+		}
+
+		// 远程 syslog 日志（与文件日志格式相同）
+		if syslogLogger != nil {
+			logAccess(syslogLogger, fileLogFormat, entry)
+		}
+	}
+}
+
+// 为 true 时访问日志的路径包含查询字符串，logRedactParams 中的参数值替换为 [REDACTED]（参数名不区分大小写）
+var (
+	logQuery        bool
+	logRedactParams map[string]bool
+)
+
+const redactedValue = "[REDACTED]"
+
+// 访问日志中记录的路径，按原始顺序保留查询参数，只替换需要隐藏的参数值
+func loggedPath(r *http.Request) string {
+	if !logQuery || r.URL.RawQuery == "" {
+		return r.URL.Path
+	}
+	params := strings.Split(r.URL.RawQuery, "&")
+	for i, param := range params {
+		key, _, ok := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if ok && logRedactParams[strings.ToLower(name)] {
+			params[i] = key + "=" + redactedValue
+		}
+	}
+	return r.URL.Path + "?" + strings.Join(params, "&")
+}
+
+// 客户端断开且没有发出响应体时访问日志记录的状态码，沿用 nginx 的 499 Client Closed Request
+const statusClientClosedRequest = 499
+
+// 为 true 时在访问日志中记录 TLS 请求的 SNI 服务器名称，非 TLS 请求和未发送 SNI 的请求不记录
+var logSNI bool
+
+// 为 true 时在请求开始时额外记录一行 started 日志，便于发现长时间未完成的请求
+var logOnStart bool
+
+// 请求开始时的日志，JSON 格式使用 event 字段与完成日志区分
+type startLogEntry struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	IP        string    `json:"ip"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	RequestID string    `json:"id"`
+}
+
+func logRequestStart(r *http.Request, start time.Time) {
+	entry := startLogEntry{
+		Time:      start,
+		Event:     "started",
+		IP:        clientIP(r),
+		Method:    r.Method,
+		Path:      loggedPath(r),
+		RequestID: requestIDFromContext(r.Context()),
+	}
+	write := func(logger *log.Logger, format string, colored bool) {
+		if format == "json" {
+			if line, err := json.Marshal(entry); err == nil {
+				logger.Writer().Write(append(line, '\n'))
+			}
+			return
+		}
+		if colored {
+			logger.Printf("%s [%s] %s started id=%s\n",
+				colorCyan+entry.IP+colorReset, coloredMethod(entry.Method), colorYellow+entry.Path+colorReset, entry.RequestID)
+			return
+		}
+		logger.Printf("%s [%s] %s started id=%s\n", entry.IP, entry.Method, entry.Path, entry.RequestID)
+	}
+	write(consoleLogger, consoleLogFormat, consoleColored(entry.Method))
+	if !syslogOnly {
+		write(fileLogger, fileLogFormat, false)
+	}
+	if syslogLogger != nil {
+		write(syslogLogger, fileLogFormat, false)
+	}
+}
+
+// 访问日志的格式：text 为传统的单行文本，json 为每行一个 JSON 对象。控制台和文件分别配置，
+// 例如文件保持文本便于本地查看，而 stdout 输出 JSON 供日志平台采集
+var (
+	consoleLogFormat = "text"
+	fileLogFormat    = "text"
+)
+
+// 一条访问日志，JSON 格式直接编码该结构
+type accessLogEntry struct {
+	Time         time.Time         `json:"time"`
+	IP           string            `json:"ip"`
+	Method       string            `json:"method"`
+	Path         string            `json:"path"`
+	Status       int               `json:"status"`
+	Duration     int64             `json:"duration"`
+	DurationUnit string            `json:"duration_unit"` // 由 -log-duration-unit 决定
+	Bytes        int64             `json:"bytes"`
+	Fields       map[string]string `json:"fields,omitempty"`
+
+	extra []keyValue // 文本格式按添加顺序输出附加字段
+	order []string   // 文本格式输出的字段，为空时使用 logFieldOrder
+}
+
+// 文本格式输出的字段及其顺序，由 -log-fields 配置，可以只输出其中一部分；fields 为附加的 key=value 对
+var logFieldOrder = []string{"ip", "method", "path", "status", "duration", "bytes", "fields"}
+
+var accessLogFieldNames = map[string]bool{
+	"ip": true, "method": true, "path": true, "status": true, "duration": true, "bytes": true, "fields": true,
+}
+
+// 按路径前缀覆盖文本日志的字段，例如静态资源只记录状态和路径，/count 记录全部字段；最长的前缀优先
+type routeLogFields struct {
+	prefix string
+	order  []string
+}
+
+var (
+	routeLogFieldPairs pairList
+	routeLogFieldSets  []routeLogFields // 按前缀长度从长到短排列
+)
+
+// 解析 prefix=field|field 对，字段列表以 | 分隔，因为逗号用于分隔多个前缀
+func parseRouteLogFields(pairs pairList) ([]routeLogFields, error) {
+	sets := make([]routeLogFields, 0, len(pairs))
+	for _, kv := range pairs {
+		if !strings.HasPrefix(kv.Key, "/") {
+			return nil, fmt.Errorf("prefix %q must start with /", kv.Key)
+		}
+		order, err := parseLogFields(strings.ReplaceAll(kv.Value, "|", ","))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", kv.Key, err)
+		}
+		sets = append(sets, routeLogFields{prefix: kv.Key, order: order})
+	}
+	sort.SliceStable(sets, func(i, j int) bool { return len(sets[i].prefix) > len(sets[j].prefix) })
+	return sets, nil
+}
+
+// 返回路径匹配的最长前缀的字段，没有匹配时返回 nil
+func logFieldOrderFor(urlPath string) []string {
+	for _, set := range routeLogFieldSets {
+		if strings.HasPrefix(urlPath, set.prefix) {
+			return set.order
+		}
+	}
+	return nil
+}
+
+// 解析逗号分隔的文本日志字段列表，拒绝未知或重复的字段
+func parseLogFields(value string) ([]string, error) {
+	var order []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if !accessLogFieldNames[name] {
+			return nil, fmt.Errorf("unknown field %q (expected ip, method, path, status, duration, bytes or fields)", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate field %q", name)
+		}
+		seen[name] = true
+		order = append(order, name)
+	}
+	return order, nil
+}
+
+// 文本日志中附加字段的值：包含空白、引号或控制字符时加引号转义，避免伪造日志行或字段
+func textFieldValue(value string) string {
+	needsQuote := strings.IndexFunc(value, func(r rune) bool {
+		return r == ' ' || r == '"' || r == '\\' || !strconv.IsPrint(r)
+	}) >= 0
+	if needsQuote {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// 按 e.order 或 logFieldOrder 生成文本格式的日志行，colored 为 true 时为控制台加上颜色
+func (e accessLogEntry) text(colored bool) string {
+	order := e.order
+	if order == nil {
+		order = logFieldOrder
+	}
+	parts := make([]string, 0, len(order)+len(e.extra))
+	for _, name := range order {
+		switch name {
+		case "ip":
+			if colored {
+				parts = append(parts, colorCyan+e.IP+colorReset)
+			} else {
+				parts = append(parts, e.IP)
+			}
+		case "method":
+			if colored {
+				parts = append(parts, "["+coloredMethod(e.Method)+"]")
+			} else {
+				parts = append(parts, "["+e.Method+"]")
+			}
+		case "path":
+			if colored {
+				parts = append(parts, colorYellow+e.Path+colorReset)
+			} else {
+				parts = append(parts, e.Path)
+			}
+		case "status":
+			parts = append(parts, strconv.Itoa(e.Status))
+		case "duration":
+			parts = append(parts, strconv.FormatInt(e.Duration, 10))
+		case "bytes":
+			parts = append(parts, strconv.FormatInt(e.Bytes, 10))
+		case "fields":
+			for _, kv := range e.extra {
+				parts = append(parts, kv.Key+"="+textFieldValue(kv.Value))
+			}
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// 按指定格式写一条不带颜色的访问日志
+func logAccess(logger *log.Logger, format string, entry accessLogEntry) {
+	if format == "json" {
+		writeJSONLog(logger, entry)
+		return
+	}
+	logger.Println(entry.text(false))
+}
+
+// JSON 日志直接写入日志记录器的输出，不带 log 包的时间前缀，保证每行都是合法的 JSON
+func writeJSONLog(logger *log.Logger, entry accessLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	logger.Writer().Write(append(line, '\n'))
+}
+
+// 与 http.Dir 相同的方式将 URL 路径映射到 root 下的文件系统路径
+func staticPath(root, urlPath string) string {
+	return filepath.Join(root, filepath.FromSlash(path.Clean("/"+urlPath)))
+}
+
+// 包装静态文件处理器，拒绝提供命名管道、设备等非常规文件，避免处理器被无限期阻塞
+func regularFilesOnly(root string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := staticPath(root, r.URL.Path)
+		info, err := os.Stat(name)
+		if err == nil && info.IsDir() {
+			// 目录请求时 http.FileServer 会提供其中的 index.html，同样需要检查
+			if indexInfo, indexErr := os.Stat(filepath.Join(name, "index.html")); indexErr == nil {
+				info = indexInfo
+			}
+		}
+		if err == nil && !info.IsDir() && !info.Mode().IsRegular() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 为常规文件设置基于修改时间和大小的强 ETag，使 http.FileServer 能够正确处理
+// If-Range（以及 If-None-Match），断点续传时验证器匹配返回 206，不匹配返回完整的 200
+func withETag(root string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, err := os.Stat(staticPath(root, r.URL.Path))
+		if err == nil && info.Mode().IsRegular() {
+			w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 静态文件内容的内存 LRU 缓存，按修改时间和大小判断是否失效
+var (
+	staticCacheSize       int64 // 缓存的总字节数上限，为 0 时不启用
+	staticCacheMaxEntries int   // 缓存的条目数上限，为 0 时只按字节数限制
+	staticCacheMutex      sync.Mutex
+	staticCacheBytes      int64
+	staticCacheList       = list.New() // 最近使用的条目在前
+	staticCacheIndex      = make(map[string]*list.Element)
+)
+
+// 超过该大小的文件不进入缓存，直接由 http.FileServer 从磁盘提供
+const staticCacheMaxFile = 1 << 20
+
+type staticCacheEntry struct {
+	name    string
+	modTime time.Time
+	data    []byte
+}
+
+// 返回文件的缓存内容，缓存中没有或已失效时从磁盘读取并放入缓存
+func cachedFile(name string, info os.FileInfo) ([]byte, error) {
+	staticCacheMutex.Lock()
+	if elem, ok := staticCacheIndex[name]; ok {
+		entry := elem.Value.(*staticCacheEntry)
+		if entry.modTime.Equal(info.ModTime()) && int64(len(entry.data)) == info.Size() {
+			staticCacheList.MoveToFront(elem)
+			staticCacheMutex.Unlock()
+			return entry.data, nil
+		}
+		staticCacheList.Remove(elem)
+		delete(staticCacheIndex, name)
+		staticCacheBytes -= int64(len(entry.data))
+	}
+	staticCacheMutex.Unlock()
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	// 读取期间文件可能被修改，大小不一致时不缓存
+	if int64(len(data)) != info.Size() {
+		return data, nil
+	}
+
+	staticCacheMutex.Lock()
+	defer staticCacheMutex.Unlock()
+	if elem, ok := staticCacheIndex[name]; ok {
+		// 并发请求已经放入缓存
+		staticCacheList.Remove(elem)
+		staticCacheBytes -= int64(len(elem.Value.(*staticCacheEntry).data))
+	}
+	staticCacheIndex[name] = staticCacheList.PushFront(&staticCacheEntry{name: name, modTime: info.ModTime(), data: data})
+	staticCacheBytes += int64(len(data))
+	// 字节数或条目数任一超出上限时淘汰最久未使用的条目
+	for staticCacheBytes > staticCacheSize || (staticCacheMaxEntries > 0 && staticCacheList.Len() > staticCacheMaxEntries) {
+		oldest := staticCacheList.Back()
+		entry := oldest.Value.(*staticCacheEntry)
+		staticCacheList.Remove(oldest)
+		delete(staticCacheIndex, entry.name)
+		staticCacheBytes -= int64(len(entry.data))
+	}
+	return data, nil
+}
+
+// 从内存缓存提供较小的常规文件。目录、以 / 结尾的路径和 index.html 仍交给 http.FileServer，
+// 以保留其重定向行为
+func withStaticCache(root string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") || strings.HasSuffix(r.URL.Path, "/index.html") {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		name := staticPath(root, r.URL.Path)
+		info, err := os.Stat(name)
+		if err != nil || !info.Mode().IsRegular() || info.Size() > staticCacheMaxFile || info.Size() > staticCacheSize {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		data, err := cachedFile(name, info)
+		if err != nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		http.ServeContent(w, r, info.Name(), info.ModTime(), bytes.NewReader(data))
+	})
+}
+
+// 为 true 时忽略格式错误的 Range 头并返回完整的 200，而不是 416
+var lenientRange bool
+
+// 检查 Range 头是否符合 bytes=first-last[,...] 的语法，不检查范围是否超出文件大小
+func wellFormedRange(header string) bool {
+	specs, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return false
+	}
+	for _, spec := range strings.Split(specs, ",") {
+		first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+		if !ok || (first == "" && last == "") {
+			return false
+		}
+		var start, end int64
+		var err error
+		if first != "" {
+			if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 {
+				return false
+			}
+		}
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < 0 {
+				return false
+			}
+			if first != "" && end < start {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 删除格式错误的 Range 头并记录，格式正确但无法满足的范围仍由 http.FileServer 返回 416
+func lenientRangeHeader(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get("Range"); header != "" && !wellFormedRange(header) {
+			consoleLogger.Printf(colorYellow+"Ignoring malformed Range %q from %s for %s\n"+colorReset, header, clientIP(r), r.URL.Path)
+			r.Header.Del("Range")
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 禁用内容嗅探：所有响应带上 X-Content-Type-Options: nosniff，静态文件只按扩展名确定类型
+var noSniff bool
+
+func noSniffHeader(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 在 http.FileServer 嗅探内容之前按扩展名设置 Content-Type，未知扩展名使用 application/octet-stream
+func extensionContentType(root string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := staticPath(root, r.URL.Path)
+		info, err := os.Stat(name)
+		if err == nil && info.IsDir() {
+			// 目录请求由其中的 index.html 响应
+			name = filepath.Join(name, "index.html")
+			info, err = os.Stat(name)
+		}
+		if err == nil && info.Mode().IsRegular() {
+			contentType := mime.TypeByExtension(filepath.Ext(name))
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			w.Header().Set("Content-Type", contentType)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 为 true 时，存在 index.html 的目录请求返回 301 重定向到 index.html，否则直接提供其内容
+var indexRedirect bool
+
+// 将目录请求重定向到其中的 index.html。http.FileServer 会把 /index.html 重定向回目录，
+// 因此这里直接提供 index.html，避免重定向循环
+func redirectToIndex(root string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := staticPath(root, r.URL.Path)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/"):
+			if info, err := os.Stat(filepath.Join(name, "index.html")); err == nil && info.Mode().IsRegular() {
+				target := r.URL.Path + "index.html"
+				if r.URL.RawQuery != "" {
+					target += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, target, http.StatusMovedPermanently)
+				return
+			}
+		case path.Base(r.URL.Path) == "index.html":
+			file, err := os.Open(name)
+			if err != nil {
+				break
+			}
+			defer file.Close()
+			if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+				http.ServeContent(w, r, "index.html", info.ModTime(), file)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 在访问日志中记录所提供静态文件的 SHA-256，结果按文件路径缓存，修改时间或大小变化后重新计算
+var (
+	logFileHash   bool
+	fileHashCache = make(map[string]fileHashEntry)
+	fileHashMutex sync.Mutex
+)
+
+type fileHashEntry struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+func fileSHA256(name string, info os.FileInfo) (string, error) {
+	fileHashMutex.Lock()
+	entry, ok := fileHashCache[name]
+	fileHashMutex.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.hash, nil
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	fileHashMutex.Lock()
+	fileHashCache[name] = fileHashEntry{modTime: info.ModTime(), size: info.Size(), hash: hash}
+	fileHashMutex.Unlock()
+	return hash, nil
+}
+
+func withFileHash(root string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := staticPath(root, r.URL.Path)
+		if info, err := os.Stat(name); err == nil && info.Mode().IsRegular() {
+			if hash, err := fileSHA256(name, info); err == nil {
+				addLogField(r, "sha256", hash)
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 自定义目录列表模板，未设置时使用 http.FileServer 的默认列表
+var listingTemplate *template.Template
+
+// 目录列表模板中的单个条目
+type ListingEntry struct {
+	Name    string
+	URL     string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// 传递给目录列表模板的数据
+type ListingData struct {
+	Path    string
+	Entries []ListingEntry
+}
+
+// 对没有 index.html 的目录使用自定义模板渲染列表，其余请求交给 handler
+func customListing(root string, tmpl *template.Template, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := staticPath(root, r.URL.Path)
+		info, err := os.Stat(name)
+		// 不以 / 结尾的目录请求由 http.FileServer 负责重定向
+		if err != nil || !info.IsDir() || !strings.HasSuffix(r.URL.Path, "/") {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if _, err := os.Stat(filepath.Join(name, "index.html")); err == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		dirEntries, err := os.ReadDir(name)
+		if err != nil {
+			http.Error(w, "Error reading directory", http.StatusInternalServerError)
+			return
+		}
+
+		data := ListingData{Path: r.URL.Path}
+		for _, entry := range dirEntries {
+			entryInfo, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			entryName := entry.Name()
+			if entry.IsDir() {
+				entryName += "/"
+			}
+			data.Entries = append(data.Entries, ListingEntry{
+				Name:    entryName,
+				URL:     (&url.URL{Path: entryName}).String(),
+				Size:    entryInfo.Size(),
+				ModTime: entryInfo.ModTime(),
+				IsDir:   entry.IsDir(),
+			})
+		}
+
+		// 先渲染到缓冲区，模板出错时可以返回完整的错误响应
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			http.Error(w, "Error rendering directory listing", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		buf.WriteTo(w)
+	})
+}
+
+// Markdown 渲染的默认包装模板
+const defaultMarkdownTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+{{.Content}}
+</body>
+</html>
+`
+
+var (
+	renderMarkdown     bool // 是否将 .md 文件渲染为 HTML 返回
+	markdownTemplate   = template.Must(template.New("markdown").Parse(defaultMarkdownTemplate))
+	markdownCache      = make(map[string]markdownCacheEntry) // 按文件路径缓存渲染结果
+	markdownCacheMutex sync.Mutex
+)
+
+// 渲染结果缓存，文件修改时间变化后失效
+type markdownCacheEntry struct {
+	modTime time.Time
+	html    []byte
+}
+
+// 传递给 Markdown 包装模板的数据
+type MarkdownPage struct {
+	Title   string
+	Path    string
+	Content template.HTML
+}
+
+func renderMarkdownFile(name, urlPath string, modTime time.Time) ([]byte, error) {
+	markdownCacheMutex.Lock()
+	entry, ok := markdownCache[name]
+	markdownCacheMutex.Unlock()
+	if ok && entry.modTime.Equal(modTime) {
+		return entry.html, nil
+	}
+
+	source, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var content bytes.Buffer
+	if err := goldmark.Convert(source, &content); err != nil {
+		return nil, err
+	}
+
+	var page bytes.Buffer
+	err = markdownTemplate.Execute(&page, MarkdownPage{
+		Title:   path.Base(urlPath),
+		Path:    urlPath,
+		Content: template.HTML(content.String()),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	markdownCacheMutex.Lock()
+	markdownCache[name] = markdownCacheEntry{modTime: modTime, html: page.Bytes()}
+	markdownCacheMutex.Unlock()
+	return page.Bytes(), nil
+}
+
+// 将 .md 文件渲染为 HTML 返回，其余请求交给 handler
+func markdownRenderer(root string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(strings.ToLower(r.URL.Path), ".md") {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		name := staticPath(root, r.URL.Path)
+		info, err := os.Stat(name)
+		if err != nil || !info.Mode().IsRegular() {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		html, err := renderMarkdownFile(name, r.URL.Path, info.ModTime())
+		if err != nil {
+			http.Error(w, "Error rendering markdown", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(html))
+	})
+}
+
+// 为 true 时，没有 index.html 但包含 .md 文件的目录返回生成的索引页，链接到其中渲染后的 Markdown 文件
+var markdownIndex bool
+
+var markdownIndexTemplate = template.Must(template.New("markdown-index").Parse(`<h1>Index of {{.Path}}</h1>
+<ul>
+{{range .Entries}}<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{end}}</ul>
+`))
+
+// 为 Markdown 目录生成索引页，使用与 Markdown 文件相同的包装模板
+func markdownDirectoryIndex(root string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := staticPath(root, r.URL.Path)
+		info, err := os.Stat(name)
+		if err != nil || !info.IsDir() || !strings.HasSuffix(r.URL.Path, "/") {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if _, err := os.Stat(filepath.Join(name, "index.html")); err == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		dirEntries, err := os.ReadDir(name)
+		if err != nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		data := ListingData{Path: r.URL.Path}
+		for _, entry := range dirEntries {
+			if entry.IsDir() || !strings.HasSuffix(strings.ToLower(entry.Name()), ".md") {
+				continue
+			}
+			data.Entries = append(data.Entries, ListingEntry{
+				Name: entry.Name(),
+				URL:  (&url.URL{Path: entry.Name()}).String(),
+			})
+		}
+		// 没有 Markdown 文件的目录仍使用普通的目录列表
+		if len(data.Entries) == 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		var content, page bytes.Buffer
+		if err := markdownIndexTemplate.Execute(&content, data); err != nil {
+			http.Error(w, "Error rendering markdown index", http.StatusInternalServerError)
+			return
+		}
+		err = markdownTemplate.Execute(&page, MarkdownPage{
+			Title:   "Index of " + r.URL.Path,
+			Path:    r.URL.Path,
+			Content: template.HTML(content.String()),
+		})
+		if err != nil {
+			http.Error(w, "Error rendering markdown index", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		page.WriteTo(w)
+	})
+}
+
+// 为 true 时，静态文件的 5xx 响应按 Accept 头返回 JSON 错误或 HTML 错误页，而不是纯文本
+var negotiateStaticErrors bool
+
+// 静态文件 5xx 响应的 JSON 格式
+type ErrorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+const staticErrorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.Error}}</title>
+</head>
+<body>
+<h1>{{.Status}} {{.Error}}</h1>
+</body>
+</html>
+`
+
+var staticErrorTemplate = template.Must(template.New("error").Parse(staticErrorPage))
+
+// 拦截 5xx 响应：丢弃内层处理器写出的响应体，改为写出协商后的错误页
+type staticErrorWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	wroteHeader bool
+	intercepted bool
+}
+
+func (sw *staticErrorWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (sw *staticErrorWriter) WriteHeader(statusCode int) {
+	if sw.wroteHeader {
+		return
+	}
+	sw.wroteHeader = true
+	if statusCode < 500 {
+		sw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	sw.intercepted = true
+
+	header := sw.ResponseWriter.Header()
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	header.Del("ETag")
+	header.Del("Last-Modified")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Add("Vary", "Accept")
+	body := ErrorResponse{Error: http.StatusText(statusCode), Status: statusCode}
+	if negotiateContentType(sw.r.Header.Get("Accept"), []string{"text/html", "application/json"}) == "application/json" {
+		header.Set("Content-Type", "application/json")
+		sw.ResponseWriter.WriteHeader(statusCode)
+		writeJSON(sw.ResponseWriter, sw.r, body)
+		return
+	}
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	sw.ResponseWriter.WriteHeader(statusCode)
+	staticErrorTemplate.Execute(sw.ResponseWriter, body)
+}
+
+func (sw *staticErrorWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if sw.intercepted {
+		return len(b), nil
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// 保留底层 ResponseWriter 的 ReadFrom，http.FileServer 提供文件时仍可使用 sendfile
+func (sw *staticErrorWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if sw.intercepted {
+		return io.Copy(io.Discard, src)
+	}
+	return io.Copy(sw.ResponseWriter, src)
+}
+
+func negotiatedErrors(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(&staticErrorWriter{ResponseWriter: w, r: r}, r)
+	})
+}
+
+// 降级运行（Redis 不可用、lame-duck 或正在关闭）时注入 HTML 页面的维护提示，为空时不注入
+var (
+	maintenanceBanner string
+	redisDegraded     atomic.Bool
+)
+
+// 检查 Redis 是否可用的间隔
+const redisHealthInterval = 5 * time.Second
+
+// 定期 PING Redis，记录其是否可用，状态变化时输出日志
+func watchRedisHealth() {
+	go func() {
+		for range time.Tick(redisHealthInterval) {
+			err := redisClient.Ping(ctx).Err()
+			if degraded := err != nil; redisDegraded.Swap(degraded) != degraded {
+				if degraded {
+					consoleLogger.Printf(colorRed+"Redis is unavailable, showing the maintenance banner: %v\n"+colorReset, err)
+				} else {
+					consoleLogger.Printf(colorGreen + "Redis is available again\n" + colorReset)
+				}
+			}
+		}
+	}()
+}
+
+func degradedState() bool {
+	return redisDegraded.Load() || lameDuck.Load() || !ready.Load()
+}
+
+// 提示条使用固定定位，追加在文档末尾也会显示在页面顶部
+func maintenanceBannerHTML() string {
+	return `<div role="alert" style="position:fixed;top:0;left:0;right:0;z-index:2147483647;padding:8px;background:#fff3cd;color:#664d03;font:14px sans-serif;text-align:center">` +
+		template.HTMLEscapeString(maintenanceBanner) + "</div>\n"
+}
+
+// 只处理完整的 200 text/html 响应：原样转发响应体，结束后追加提示条，不需要缓冲整个页面
+type bannerWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	wroteHeader bool
+	inject      bool
+}
+
+func (bw *bannerWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+func (bw *bannerWriter) WriteHeader(statusCode int) {
+	if bw.wroteHeader {
+		return
+	}
+	bw.wroteHeader = true
+	header := bw.ResponseWriter.Header()
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if statusCode == http.StatusOK && mediaType == "text/html" && header.Get("Content-Encoding") == "" && bw.r.Method != http.MethodHead {
+		bw.inject = true
+		// 响应体与文件内容不再一致，长度、校验值和范围请求都不再适用
+		header.Del("Content-Length")
+		header.Del("ETag")
+		header.Del("Last-Modified")
+		header.Del("Accept-Ranges")
+		header.Set("Cache-Control", "no-cache")
+	}
+	bw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (bw *bannerWriter) Write(b []byte) (int, error) {
+	if !bw.wroteHeader {
+		bw.WriteHeader(http.StatusOK)
+	}
+	return bw.ResponseWriter.Write(b)
+}
+
+// 保留底层 ResponseWriter 的 ReadFrom，http.FileServer 提供文件时仍可使用 sendfile
+func (bw *bannerWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !bw.wroteHeader {
+		bw.WriteHeader(http.StatusOK)
+	}
+	return io.Copy(bw.ResponseWriter, src)
+}
+
+func injectMaintenanceBanner(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !degradedState() {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		// 降级期间忽略条件请求和范围请求，让客户端拿到带提示条的完整页面而不是 304 或 206
+		r.Header.Del("If-None-Match")
+		r.Header.Del("If-Modified-Since")
+		r.Header.Del("Range")
+		bw := &bannerWriter{ResponseWriter: w, r: r}
+		handler.ServeHTTP(bw, r)
+		if bw.inject {
+			io.WriteString(w, maintenanceBannerHTML())
+		}
+	})
+}
+
+// 每次请求前确认根目录仍然存在，目录在运行时被删除或卸载时返回 503 并记录警告，
+// 目录恢复后自动继续提供服务
+func rootGuard(root string, handler http.Handler) http.Handler {
+	var unavailable atomic.Bool
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, err := os.Stat(root)
+		if err != nil || !info.IsDir() {
+			if !unavailable.Swap(true) {
+				consoleLogger.Printf(colorRed+"Static root %s is unavailable: %v\n"+colorReset, root, err)
+				fileLogger.Printf("Static root %s is unavailable: %v\n", root, err)
+			}
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if unavailable.Swap(false) {
+			consoleLogger.Printf(colorGreen+"Static root %s is available again\n"+colorReset, root)
+			fileLogger.Printf("Static root %s is available again\n", root)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 站点地图：遍历根目录中的 .html 文件生成 /sitemap.xml，结果缓存并按间隔重新生成
+var (
+	sitemapInterval = time.Hour
+	sitemapBaseURL  string // 为空时根据请求的协议和 Host 生成
+)
+
+type sitemapEntry struct {
+	path    string
+	lastMod time.Time
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// 遍历根目录收集 .html 文件，跳过隐藏文件和目录，index.html 以所在目录的 URL 表示
+func buildSitemap(root string) ([]sitemapEntry, error) {
+	var entries []sitemapEntry
+	err := filepath.WalkDir(root, func(name string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name != root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() || !strings.EqualFold(filepath.Ext(name), ".html") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return nil
+		}
+		urlPath := "/" + filepath.ToSlash(rel)
+		if path.Base(urlPath) == "index.html" {
+			urlPath = strings.TrimSuffix(urlPath, "index.html")
+		}
+		entries = append(entries, sitemapEntry{path: urlPath, lastMod: info.ModTime()})
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	return entries, err
+}
+
+func sitemapHandler(root string) http.HandlerFunc {
+	var (
+		mu        sync.Mutex
+		entries   []sitemapEntry
+		generated time.Time
+	)
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if generated.IsZero() || time.Since(generated) >= sitemapInterval {
+			built, err := buildSitemap(root)
+			if err != nil {
+				consoleLogger.Printf(colorRed+"Error generating sitemap: %v\n"+colorReset, err)
+			}
+			// 生成失败时保留上一次的结果
+			if err == nil || entries == nil {
+				entries = built
+			}
+			generated = time.Now()
+		}
+		current := entries
+		mu.Unlock()
+
+		baseURL := strings.TrimSuffix(sitemapBaseURL, "/")
+		if baseURL == "" {
+			scheme := "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+			baseURL = scheme + "://" + r.Host
+		}
+
+		urlSet := sitemapURLSet{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+		for _, entry := range current {
+			urlSet.URLs = append(urlSet.URLs, sitemapURL{
+				Loc:     baseURL + (&url.URL{Path: entry.path}).EscapedPath(),
+				LastMod: entry.lastMod.UTC().Format("2006-01-02"),
+			})
+		}
+		data, err := xml.MarshalIndent(urlSet, "", "  ")
+		if err != nil {
+			http.Error(w, "Error generating sitemap", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		io.WriteString(w, xml.Header)
+		w.Write(data)
+	}
+}
+
+// 预先生成的目录索引：启动时遍历根目录生成 JSON 目录树并缓存，按间隔或收到 SIGHUP 时重新生成
+var (
+	directoryIndexPath      string        // 提供索引的路径，为空时不生成
+	directoryIndexInterval  time.Duration // 重新生成的间隔，为 0 时只在收到 SIGHUP 时重新生成
+	directoryIndexRoot      string
+	directoryIndexData      []byte
+	directoryIndexGenerated time.Time
+	directoryIndexMutex     sync.RWMutex
+)
+
+type directoryIndexEntry struct {
+	Name     string                `json:"name"`
+	Path     string                `json:"path"`
+	Type     string                `json:"type"`
+	Size     int64                 `json:"size,omitempty"`
+	ModTime  time.Time             `json:"mod_time"`
+	Children []directoryIndexEntry `json:"children,omitempty"`
+}
+
+// 递归列出目录内容，与静态文件服务一致地跳过隐藏文件和非普通文件
+func buildDirectoryIndex(dir, urlPath string) ([]directoryIndexEntry, error) {
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := []directoryIndexEntry{}
+	for _, item := range items {
+		if strings.HasPrefix(item.Name(), ".") {
+			continue
+		}
+		info, err := item.Info()
+		if err != nil {
+			continue
+		}
+		entry := directoryIndexEntry{
+			Name:    item.Name(),
+			Path:    path.Join(urlPath, item.Name()),
+			ModTime: info.ModTime().UTC(),
+		}
+		switch {
+		case item.IsDir():
+			entry.Type = "dir"
+			entry.Path += "/"
+			entry.Children, err = buildDirectoryIndex(filepath.Join(dir, item.Name()), entry.Path)
+			if err != nil {
+				return nil, err
+			}
+		case item.Type().IsRegular():
+			entry.Type = "file"
+			entry.Size = info.Size()
+		default:
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// 重新生成目录索引，失败时保留上一次的结果
+func refreshDirectoryIndex() error {
+	directoryIndexMutex.RLock()
+	root := directoryIndexRoot
+	directoryIndexMutex.RUnlock()
+
+	entries, err := buildDirectoryIndex(root, "/")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	data, err := json.Marshal(struct {
+		GeneratedAt time.Time             `json:"generated_at"`
+		Entries     []directoryIndexEntry `json:"entries"`
+	}{now.UTC(), entries})
+	if err != nil {
+		return err
+	}
+
+	directoryIndexMutex.Lock()
+	directoryIndexData = data
+	directoryIndexGenerated = now
+	directoryIndexMutex.Unlock()
+	return nil
+}
+
+// 按间隔重新生成目录索引
+func startDirectoryIndexRefresher() {
+	go func() {
+		for range time.Tick(directoryIndexInterval) {
+			if err := refreshDirectoryIndex(); err != nil {
+				consoleLogger.Printf(colorRed+"Error refreshing directory index: %v\n"+colorReset, err)
+			}
+		}
+	}()
+}
+
+func directoryIndexHandler(w http.ResponseWriter, r *http.Request) {
+	if handleAPIMethods(w, r) {
+		return
+	}
+	directoryIndexMutex.RLock()
+	data, generated := directoryIndexData, directoryIndexGenerated
+	directoryIndexMutex.RUnlock()
+
+	// 缓存的索引直接返回，同时支持 If-Modified-Since 和 Range
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeContent(w, r, "", generated, bytes.NewReader(data))
+}
+
+// 可以按虚拟主机单独配置的静态文件选项，默认取自 -index-redirect 和 -listing-template
+type staticOptions struct {
+	indexRedirect   bool
+	listingTemplate *template.Template
+}
+
+// 静态文件处理器按当前配置使用的中间件，由外到内排列，与 newStaticHandler 保持一致
+func staticMiddlewareNames(opts staticOptions) []string {
+	var names []string
+	if maintenanceBanner != "" {
+		names = append(names, "injectMaintenanceBanner")
+	}
+	if negotiateStaticErrors {
+		names = append(names, "negotiatedErrors")
+	}
+	names = append(names, "rootGuard", "regularFilesOnly")
+	if markdownIndex {
+		names = append(names, "markdownDirectoryIndex")
+	}
+	if opts.listingTemplate != nil {
+		names = append(names, "customListing")
+	}
+	if renderMarkdown {
+		names = append(names, "markdownRenderer")
+	}
+	if logFileHash {
+		names = append(names, "withFileHash")
+	}
+	if lenientRange {
+		names = append(names, "lenientRangeHeader")
+	}
+	names = append(names, "withETag")
+	if noSniff {
+		names = append(names, "extensionContentType")
+	}
+	if opts.indexRedirect {
+		names = append(names, "redirectToIndex")
+	}
+	if staticCacheSize > 0 {
+		names = append(names, "withStaticCache")
+	}
+	return append(names, "FileServer")
+}
+
+// 构建指定根目录的静态文件处理器
+func newStaticHandler(root string, opts staticOptions) http.Handler {
+	var handler http.Handler = http.FileServer(http.Dir(root))
+	if staticCacheSize > 0 {
+		handler = withStaticCache(root, handler)
+	}
+	if opts.indexRedirect {
+		handler = redirectToIndex(root, handler)
+	}
+	if noSniff {
+		handler = extensionContentType(root, handler)
+	}
+	handler = withETag(root, handler)
+	if lenientRange {
+		handler = lenientRangeHeader(handler)
+	}
+	if logFileHash {
+		handler = withFileHash(root, handler)
+	}
+	if renderMarkdown {
+		handler = markdownRenderer(root, handler)
+	}
+	if opts.listingTemplate != nil {
+		handler = customListing(root, opts.listingTemplate, handler)
+	}
+	if markdownIndex {
+		handler = markdownDirectoryIndex(root, handler)
+	}
+	handler = rootGuard(root, regularFilesOnly(root, handler))
+	if negotiateStaticErrors {
+		handler = negotiatedErrors(handler)
+	}
+	if maintenanceBanner != "" {
+		handler = injectMaintenanceBanner(handler)
+	}
+	return handler
+}
+
+// 虚拟主机：按请求的 Host 选择静态文件根目录，未配置的主机使用 -root
+var vhostPairs pairList
+
+// 解析 -vhost 的值：root[;index-redirect=bool][;listing=file]，未指定的选项沿用全局设置
+func parseVhost(value string, defaults staticOptions) (string, staticOptions, error) {
+	parts := strings.Split(value, ";")
+	root := strings.TrimSpace(parts[0])
+	if root == "" {
+		return "", defaults, fmt.Errorf("missing root directory")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", defaults, err
+	}
+	opts := defaults
+	for _, part := range parts[1:] {
+		key, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "index-redirect":
+			enabled, err := strconv.ParseBool(val)
+			if err != nil {
+				return "", defaults, fmt.Errorf("invalid index-redirect %q", val)
+			}
+			opts.indexRedirect = enabled
+		case "listing":
+			if val == "" {
+				// 空值表示使用 http.FileServer 的默认目录列表
+				opts.listingTemplate = nil
+				continue
+			}
+			tmpl, err := template.ParseFiles(val)
+			if err != nil {
+				return "", defaults, fmt.Errorf("parsing listing template: %v", err)
+			}
+			opts.listingTemplate = tmpl
+		default:
+			return "", defaults, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return root, opts, nil
+}
+
+// 按 Host（忽略端口和大小写）分发到对应虚拟主机的处理器
+func selectVhost(hosts map[string]http.Handler, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if handler, ok := hosts[strings.ToLower(host)]; ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+// keep-alive 连接的空闲超时，为 0 时与 net/http 一样使用 ReadTimeout（未设置时不超时）。
+// logIdleCloses 为 true 时记录因空闲超时而关闭的连接，便于调整 keep-alive 设置
+var (
+	idleTimeout    time.Duration
+	logIdleCloses  bool
+	idleSince      = make(map[net.Conn]time.Time)
+	idleSinceMutex sync.Mutex
+)
+
+// 由 trackConnState 调用：记录连接进入空闲状态的时间，连接从空闲状态关闭且
+// 空闲时长达到 IdleTimeout 时认为是服务端超时关闭，客户端主动关闭的空闲连接不记录
+func trackIdleConn(conn net.Conn, state http.ConnState) {
+	idleSinceMutex.Lock()
+	since, wasIdle := idleSince[conn]
+	delete(idleSince, conn)
+	if state == http.StateIdle {
+		idleSince[conn] = time.Now()
+	}
+	idleSinceMutex.Unlock()
+
+	if state == http.StateClosed && wasIdle {
+		if idle := time.Since(since); idle >= idleTimeout {
+			consoleLogger.Printf("Connection from %s closed after %s idle (idle timeout %s)\n",
+				conn.RemoteAddr(), idle.Round(time.Millisecond), idleTimeout)
+		}
+	}
+}
+
+// 进程生命周期内的请求统计，用于关闭时输出汇总
+var (
+	startTime         = time.Now()
+	totalRequests     atomic.Int64
+	totalBytesSent    atomic.Int64
+	statusClassCounts [6]atomic.Int64 // 按状态码类别（1xx-5xx）计数，下标为 statusCode/100
+)
+
+// 包装整个服务的处理器，累计请求数、发送字节数以及各状态码类别的数量
+func trackStats(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		updatePeak(&peakInFlight, inFlightRequests.Add(1))
+		defer inFlightRequests.Add(-1)
+
+		lrw := NewLoggingResponseWriter(w)
+		handler.ServeHTTP(lrw, r)
+
+		totalRequests.Add(1)
+		totalBytesSent.Add(lrw.length)
+		if class := lrw.statusCode / 100; class >= 1 && class <= 5 {
+			statusClassCounts[class].Add(1)
+		}
+		if lrw.statusCode >= 500 {
+			recordRecentError(r, lrw.statusCode)
+		}
+	})
+}
+
+// 最近的 5xx 响应，供 /admin/status 显示；只记录路径，不记录可能包含敏感信息的查询字符串
+type recentError struct {
+	Time   time.Time
+	Method string
+	Path   string
+	Status int
+}
+
+const maxRecentErrors = 10
+
+var (
+	recentErrors      []recentError // 最新的在前
+	recentErrorsMutex sync.Mutex
+)
+
+func recordRecentError(r *http.Request, status int) {
+	recentErrorsMutex.Lock()
+	defer recentErrorsMutex.Unlock()
+	recentErrors = append([]recentError{{Time: time.Now(), Method: r.Method, Path: r.URL.Path, Status: status}}, recentErrors...)
+	if len(recentErrors) > maxRecentErrors {
+		recentErrors = recentErrors[:maxRecentErrors]
+	}
+}
+
+// 当前和峰值的并发请求数、连接数，用于容量规划
+var (
+	inFlightRequests atomic.Int64
+	peakInFlight     atomic.Int64
+	openConns        atomic.Int64
+	peakConns        atomic.Int64
+)
+
+// 当前值超过峰值时更新峰值
+func updatePeak(peak *atomic.Int64, current int64) {
+	for {
+		old := peak.Load()
+		if current <= old || peak.CompareAndSwap(old, current) {
+			return
+		}
+	}
+}
+
+// 启动后的慢启动：在窗口期内同时打开的连接数上限从 1 线性增加到 slowStartConns，
+// 让冷缓存和连接池逐步承接流量，窗口结束后不再限制。TLS 证书重新加载成功后 TLS 监听器重新开始慢启动
+var (
+	slowStartWindow time.Duration // 为 0 时不启用
+	slowStartConns  = 1000
+)
+
+type slowStartListener struct {
+	net.Listener
+	start     time.Time
+	mu        sync.Mutex
+	active    int
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// 当前允许同时打开的连接数，窗口结束后返回 -1 表示不限制。调用方持有 mu
+func (l *slowStartListener) limit() int {
+	elapsed := time.Since(l.start)
+	if elapsed >= slowStartWindow {
+		return -1
+	}
+	return 1 + int(float64(slowStartConns-1)*float64(elapsed)/float64(slowStartWindow))
+}
+
+// 与 netutil.LimitListener 相同，达到上限时先等待连接关闭或上限增加，再接受新连接
+// 监听器关闭后立即返回 net.ErrClosed，不再等待
+func (l *slowStartListener) Accept() (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		limit := l.limit()
+		if limit < 0 {
+			l.mu.Unlock()
+			return l.Listener.Accept()
+		}
+		if l.active < limit {
+			l.active++
+			l.mu.Unlock()
+			break
+		}
+		l.mu.Unlock()
+		select {
+		case <-l.closed:
+			return nil, net.ErrClosed
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	return &slowStartConn{Conn: conn, release: l.release}, nil
+}
+
+func (l *slowStartListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// 从 1 个连接重新开始慢启动，之前窗口结束后接受的连接不计入上限
+func (l *slowStartListener) restart() {
+	l.mu.Lock()
+	l.start = time.Now()
+	l.mu.Unlock()
+}
+
+func (l *slowStartListener) release() {
+	l.mu.Lock()
+	l.active--
+	l.mu.Unlock()
+}
+
+// 窗口期内接受的连接关闭时释放名额
+type slowStartConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *slowStartConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// 监听服务器的地址，启用慢启动时包装监听器
+func listen(srv *http.Server) (net.Listener, error) {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil || slowStartWindow <= 0 {
+		return ln, err
+	}
+	return &slowStartListener{Listener: ln, start: time.Now(), closed: make(chan struct{})}, nil
+}
+
+// 作为 http.Server.ConnState 使用，统计打开的连接数
+func trackConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		updatePeak(&peakConns, openConns.Add(1))
+	case http.StateHijacked, http.StateClosed:
+		openConns.Add(-1)
+	}
+	if logIdleCloses {
+		trackIdleConn(conn, state)
+	}
+}
+
+// 关闭时输出的运行汇总
+type ShutdownSummary struct {
+	Requests        int64            `json:"requests"`
+	BytesSent       int64            `json:"bytes_sent"`
+	UptimeSeconds   float64          `json:"uptime_seconds"`
+	StatusClasses   map[string]int64 `json:"status_classes"`
+	PeakInFlight    int64            `json:"peak_in_flight"`
+	PeakConnections int64            `json:"peak_connections"`
+}
+
+func buildShutdownSummary() ShutdownSummary {
+	summary := ShutdownSummary{
+		Requests:        totalRequests.Load(),
+		BytesSent:       totalBytesSent.Load(),
+		UptimeSeconds:   time.Since(startTime).Seconds(),
+		StatusClasses:   make(map[string]int64),
+		PeakInFlight:    peakInFlight.Load(),
+		PeakConnections: peakConns.Load(),
+	}
+	for class := 1; class <= 5; class++ {
+		summary.StatusClasses[fmt.Sprintf("%dxx", class)] = statusClassCounts[class].Load()
+	}
+	return summary
+}
+
+// 记录运行汇总到日志，并在指定了文件时以 JSON 格式写入
+func writeShutdownSummary(summaryFile string) {
+	summary := buildShutdownSummary()
+	line := fmt.Sprintf("Shutdown summary: requests=%d bytes_sent=%d uptime=%s 1xx=%d 2xx=%d 3xx=%d 4xx=%d 5xx=%d peak_in_flight=%d peak_connections=%d",
+		summary.Requests, summary.BytesSent, time.Duration(summary.UptimeSeconds*float64(time.Second)).Round(time.Second),
+		summary.StatusClasses["1xx"], summary.StatusClasses["2xx"], summary.StatusClasses["3xx"],
+		summary.StatusClasses["4xx"], summary.StatusClasses["5xx"], summary.PeakInFlight, summary.PeakConnections)
+	consoleLogger.Println(line)
+	fileLogger.Println(line)
+
+	if summaryFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		consoleLogger.Printf(colorRed+"Error encoding shutdown summary: %v\n"+colorReset, err)
+		return
+	}
+	if err := os.WriteFile(summaryFile, append(data, '\n'), 0666); err != nil {
+		consoleLogger.Printf(colorRed+"Error writing shutdown summary: %v\n"+colorReset, err)
+	}
+}
+
+var ctx = context.Background()
+var redisClient *redis.Client
+
+// 记录执行时间超过阈值的 Redis 命令，与请求整体耗时无关，用于发现 Redis 端的延迟问题
+type slowRedisHook struct {
+	threshold time.Duration
+}
+
+type redisStartKey struct{}
+
+func (h slowRedisHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (h slowRedisHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.check(ctx, cmd.Name(), redisCommandKey(cmd))
+	return nil
+}
+
+func (h slowRedisHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (h slowRedisHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	names := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		names[i] = cmd.Name()
+	}
+	h.check(ctx, "pipeline("+strings.Join(names, ",")+")", "")
+	return nil
+}
+
+func (h slowRedisHook) check(ctx context.Context, op, key string) {
+	start, ok := ctx.Value(redisStartKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	if duration := time.Since(start); duration >= h.threshold {
+		consoleLogger.Printf(colorYellow+"Slow Redis operation: %s %s took %dms\n"+colorReset, op, key, duration.Milliseconds())
+		fileLogger.Printf("Slow Redis operation: %s %s took %dms\n", op, key, duration.Milliseconds())
+	}
+}
+
+// 返回命令操作的 key（第一个参数），没有时为空字符串。AUTH 和 HELLO 的参数包含密码，不返回
+func redisCommandKey(cmd redis.Cmder) string {
+	args := cmd.Args()
+	if len(args) < 2 {
+		return ""
+	}
+	switch cmd.Name() {
+	case "auth", "hello":
+		return ""
+	}
+	return fmt.Sprint(args[1])
+}
+
+// -debug 模式下记录每条 Redis 命令及其 key，只输出命令名和 key，不输出值和密码
+type debugRedisHook struct{}
+
+func (debugRedisHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	consoleLogger.Printf("Redis command: %s %s\n", strings.ToUpper(cmd.Name()), redisCommandKey(cmd))
+	return ctx, nil
+}
+
+func (debugRedisHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (debugRedisHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	for _, cmd := range cmds {
+		consoleLogger.Printf("Redis command: %s %s (pipeline)\n", strings.ToUpper(cmd.Name()), redisCommandKey(cmd))
+	}
+	return ctx, nil
+}
+
+func (debugRedisHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// 为 true 时 JSON 响应先编码到缓冲区并设置 Content-Length，避免分块传输。
+// net/http 只会为不超过 2KB 且在处理函数返回前写完的响应自动设置 Content-Length
+var bufferJSON bool
+
+// 写出 JSON 响应体，调用方负责设置 Content-Type 等响应头。先完整编码再写出：
+// 编码失败时还能返回 500。小响应写入的是连接的缓冲区，客户端已经断开时 Write 往往仍然成功，
+// 因此同时检查请求上下文；设置了 Content-Length 时立即刷出，刷出失败也能在这里发现。
+// 客户端断开（EPIPE、ECONNRESET 或请求上下文被取消）只在 -debug 时记录，其他写出失败
+// （包括超过 -request-timeout）作为错误记录
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		consoleLogger.Printf(colorRed+"Error encoding JSON response: %v\n"+colorReset, err)
+		http.Error(w, "Encoding error", http.StatusInternalServerError)
+		return
+	}
+	data = append(data, '\n')
+	if bufferJSON {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	}
+	_, err = w.Write(data)
+	if err == nil && bufferJSON {
+		// 已经声明了长度，刷出不会改为分块传输；http.TimeoutHandler 等不支持刷出时忽略
+		if flushErr := http.NewResponseController(w).Flush(); !errors.Is(flushErr, http.ErrNotSupported) {
+			err = flushErr
+		}
+	}
+	if err == nil {
+		err = r.Context().Err()
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, http.ErrHandlerTimeout), errors.Is(err, context.DeadlineExceeded):
+		consoleLogger.Printf(colorRed+"Error writing JSON response for %s: %v\n"+colorReset, r.URL.Path, err)
+	case clientDisconnected(r, err):
+		if debugMode {
+			consoleLogger.Printf(colorYellow+"Client disconnected while writing JSON response for %s: %v\n"+colorReset, r.URL.Path, err)
+		}
+	default:
+		consoleLogger.Printf(colorRed+"Error writing JSON response for %s: %v\n"+colorReset, r.URL.Path, err)
+	}
+}
+
+// 写出失败是否因为客户端断开：连接已关闭或被重置，或者请求上下文已被取消（HTTP/2 流被重置时也是如此）
+func clientDisconnected(r *http.Request, err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) || errors.Is(r.Context().Err(), context.Canceled)
+}
+
+// 定义一个结构体用于JSON响应
+type CountResponse struct {
+	Page         string      `json:"page"`
+	Count        int64       `json:"count"`
+	ConfirmToken string      `json:"confirm_token,omitempty"`
+	Trend        *CountTrend `json:"trend,omitempty"`
+}
+
+// count 字段的编码方式：never 始终为数字，unsafe 超出 JavaScript 安全整数范围时为字符串，always 始终为字符串
+var countAsString = "never"
+
+// JavaScript 能精确表示的最大整数 2^53-1
+const maxSafeInteger = 1<<53 - 1
+
+func (c CountResponse) MarshalJSON() ([]byte, error) {
+	type plain CountResponse
+	asString := countAsString == "always" ||
+		(countAsString == "unsafe" && (c.Count > maxSafeInteger || c.Count < -maxSafeInteger))
+	if !asString {
+		return json.Marshal(plain(c))
+	}
+
+	// 外层的 Count 字段覆盖内嵌结构体中的同名字段
+	return json.Marshal(struct {
+		plain
+		Count int64 `json:"count,string"`
+	}{plain(c), c.Count})
+}
+
+// 响应中报告的计数范围，只影响返回值，Redis 中存储的计数不受影响；countCeiling 为 0 时不设上限
+var (
+	countFloor   int64
+	countCeiling int64
+)
+
+func displayCount(count int64) int64 {
+	if count < countFloor {
+		return countFloor
+	}
+	if countCeiling > 0 && count > countCeiling {
+		return countCeiling
+	}
+	return count
+}
+
+// JSONP 回调名称必须是合法的 JavaScript 标识符（允许以 . 分隔的成员访问），防止注入脚本
+var jsonpCallbackPattern = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+const maxJSONPCallbackLength = 128
+
+func validJSONPCallback(callback string) bool {
+	return len(callback) <= maxJSONPCallbackLength && jsonpCallbackPattern.MatchString(callback)
+}
+
+// /count 支持的响应类型，按优先级排列
+var countContentTypes = []string{"application/json", "text/plain"}
+
+// 为 true 时，客户端明确只接受不支持的类型时返回 406，否则回退为 JSON
+var strictAccept bool
+
+// 根据 Accept 头选择响应类型，没有可接受的类型时返回空字符串
+func negotiateContentType(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		// 取最具体的匹配范围的 q 值：完整类型 > type/* > */*
+		q, specificity := 0.0, -1
+		for _, part := range strings.Split(accept, ",") {
+			fields := strings.Split(part, ";")
+			mediaRange := strings.ToLower(strings.TrimSpace(fields[0]))
+			rangeQ := 1.0
+			for _, param := range fields[1:] {
+				if key, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(key, "q") {
+					if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+						rangeQ = parsed
+					}
+				}
+			}
+
+			match := -1
+			switch {
+			case mediaRange == offer:
+				match = 2
+			case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaRange, "*")):
+				match = 1
+			case mediaRange == "*/*":
+				match = 0
+			}
+			if match > specificity {
+				q, specificity = rangeQ, match
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// API 路由允许的方法
+const apiAllowedMethods = "GET, HEAD, OPTIONS"
+
+// 处理 API 路由上的 OPTIONS 请求，返回 204 和 Allow 头；已处理时返回 true
+func handleOptions(w http.ResponseWriter, r *http.Request, allow string) bool {
+	if r.Method != http.MethodOptions {
+		return false
+	}
+	w.Header().Set("Allow", allow)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// 处理只读 API 路由的方法：OPTIONS 返回 204，GET 和 HEAD 以外的方法返回 405，
+// 两者都带相同的 Allow 头；已处理时返回 true
+func handleAPIMethods(w http.ResponseWriter, r *http.Request) bool {
+	if handleOptions(w, r, apiAllowedMethods) {
+		return true
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", apiAllowedMethods)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+	return false
+}
+
+// Redis 在计数超出 int64 范围时返回 "ERR increment or decrement would overflow"
+func isRedisOverflow(err error) bool {
+	return strings.Contains(err.Error(), "would overflow")
+}
+
+// 单次 INCRBY 最多增加的计数，超出部分丢弃并记录日志，为 0 时不限制
+var maxIncrement int64
+
+// 允许计数的页面集合，为 nil 时允许任何页面
+var pageAllowlist map[string]bool
+
+// 从逗号分隔的列表和文件（每行一个页面，# 开头为注释）构建允许计数的页面集合
+func loadPageAllowlist(inline, file string) (map[string]bool, error) {
+	if inline == "" && file == "" {
+		return nil, nil
+	}
+	allowlist := make(map[string]bool)
+	for _, page := range strings.Split(inline, ",") {
+		if page = strings.TrimSpace(page); page != "" {
+			allowlist[page] = true
+		}
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				allowlist[line] = true
+			}
+		}
+	}
+	return allowlist, nil
+}
+
+// 计数阈值通知：页面计数越过配置的阈值时，异步向 webhook 地址 POST 一条 JSON 消息
+var (
+	webhookURL        string
+	webhookThresholds []int64 // 升序排列
+	webhookClient     = &http.Client{Timeout: 10 * time.Second}
+)
+
+// 发送给 webhook 的消息
+type ThresholdEvent struct {
+	Page      string    `json:"page"`
+	Threshold int64     `json:"threshold"`
+	Count     int64     `json:"count"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func parseThresholds(value string) ([]int64, error) {
+	var thresholds []int64
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		threshold, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("invalid threshold %q", part)
+		}
+		thresholds = append(thresholds, threshold)
+	}
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] < thresholds[j] })
+	return thresholds, nil
+}
+
+// 投递失败、等待在该页面下一次计数时重新发送的阈值，数量有上限，已满时不再记录
+type webhookRetryKey struct {
+	page      string
+	threshold int64
+}
+
+const maxWebhookRetries = 10000
+
+var (
+	webhookRetries      = make(map[webhookRetryKey]bool)
+	webhookRetriesMutex sync.Mutex
+)
+
+// 计数从 oldCount 增加到 newCount 时，对越过的每个阈值发送一次通知，之前投递失败的阈值也一并重试。
+// 通过 Redis SET NX 标记已触发的阈值，保证多实例和重试时每个阈值只触发一次；
+// 投递失败时删除标记，webhook 恢复后不会丢失通知
+func notifyThresholds(page string, oldCount, newCount int64) {
+	for _, threshold := range webhookThresholds {
+		if threshold > newCount {
+			continue
+		}
+		key := webhookRetryKey{page, threshold}
+		if threshold <= oldCount {
+			webhookRetriesMutex.Lock()
+			retry := webhookRetries[key]
+			webhookRetriesMutex.Unlock()
+			if !retry {
+				continue
+			}
+		}
+		go func(threshold int64) {
+			marker := fmt.Sprintf("page.webhook.%s.%d", page, threshold)
+			first, err := redisClient.SetNX(ctx, marker, 1, 0).Result()
+			if err != nil {
+				consoleLogger.Printf(colorRed+"Error recording webhook for %s at %d: %v\n"+colorReset, page, threshold, err)
+				return
+			}
+			if !first {
+				return
+			}
+			err = postThresholdEvent(ThresholdEvent{Page: page, Threshold: threshold, Count: newCount, Timestamp: time.Now()})
+			webhookRetriesMutex.Lock()
+			defer webhookRetriesMutex.Unlock()
+			if err == nil {
+				delete(webhookRetries, key)
+				return
+			}
+			consoleLogger.Printf(colorRed+"Error sending webhook for %s at %d, retrying on the next hit: %v\n"+colorReset, page, threshold, err)
+			if err := redisClient.Del(ctx, marker).Err(); err != nil {
+				consoleLogger.Printf(colorRed+"Error releasing webhook marker for %s at %d: %v\n"+colorReset, page, threshold, err)
+				return
+			}
+			if webhookRetries[key] || len(webhookRetries) < maxWebhookRetries {
+				webhookRetries[key] = true
+			}
+		}(threshold)
+	}
+}
+
+// 发送一次阈值通知，连接失败或返回非 2xx 状态码时返回错误
+func postThresholdEvent(event ThresholdEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Redis 出错时返回最近一次成功读取的计数，而不是 500。缓存的页面数有上限，
+// 已满时不再记录新页面
+var (
+	countStaleOnError bool
+	lastCounts        = make(map[string]int64)
+	lastCountsMutex   sync.Mutex
+)
+
+const maxStaleCounts = 10000
+
+func rememberCount(page string, count int64) {
+	if !countStaleOnError {
+		return
+	}
+	lastCountsMutex.Lock()
+	defer lastCountsMutex.Unlock()
+	if _, ok := lastCounts[page]; ok || len(lastCounts) < maxStaleCounts {
+		lastCounts[page] = count
+	}
+}
+
+// Redis 出错时使用：有缓存的计数时返回它并标记为过期，否则写出错误响应
+func staleOrError(w http.ResponseWriter, page string, err error) (int64, bool) {
+	if countStaleOnError {
+		lastCountsMutex.Lock()
+		count, ok := lastCounts[page]
+		lastCountsMutex.Unlock()
+		if ok {
+			w.Header().Set("X-Count-Stale", "true")
+			w.Header().Set("Warning", `110 - "Response is Stale"`)
+			return count, true
+		}
+	}
+	redisError(w, err)
+	return 0, false
+}
+
+// Redis 拒绝认证或权限不足（密码错误、未认证、ACL 不允许）时的错误，重试无法恢复
+func isRedisAuthError(err error) bool {
+	message := err.Error()
+	for _, prefix := range []string{"NOAUTH", "WRONGPASS", "NOPERM"} {
+		if strings.HasPrefix(message, prefix) {
+			return true
+		}
+	}
+	return strings.Contains(message, "called without any password configured")
+}
+
+// 上次记录 Redis 认证错误的时间（UnixNano），每分钟最多记录一次
+var lastRedisAuthLog atomic.Int64
+
+// 写出 Redis 错误响应：认证错误返回 503 和 X-Error-Code: redis-auth，便于与其他数据库错误区分
+func redisError(w http.ResponseWriter, err error) {
+	if !isRedisAuthError(err) {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UnixNano()
+	if last := lastRedisAuthLog.Load(); now-last >= int64(time.Minute) && lastRedisAuthLog.CompareAndSwap(last, now) {
+		consoleLogger.Printf(colorRed+"Redis rejected the credentials, check -redis-password: %v\n"+colorReset, err)
+	}
+	w.Header().Set("X-Error-Code", "redis-auth")
+	http.Error(w, "Database authentication failed", http.StatusServiceUnavailable)
+}
+
+// 启动时连接 Redis 失败后的重试次数和首次重试间隔，之后每次重试间隔加倍，最长 30 秒
+var (
+	redisConnectRetries  int
+	redisConnectInterval time.Duration
+)
+
+const maxRedisConnectInterval = 30 * time.Second
+
+// 启动时检查 Redis 连接，编排环境中 Redis 可能比服务稍晚就绪，按退避间隔重试
+func pingRedis(retries int, interval time.Duration) error {
+	err := redisClient.Ping(ctx).Err()
+	// 认证错误不会因为等待而恢复，不再重试
+	for attempt := 1; err != nil && !isRedisAuthError(err) && attempt <= retries; attempt++ {
+		consoleLogger.Printf(colorYellow+"Redis is not available (%v), retrying in %s (%d/%d)\n"+colorReset, err, interval, attempt, retries)
+		time.Sleep(interval)
+		if interval *= 2; interval > maxRedisConnectInterval {
+			interval = maxRedisConnectInterval
+		}
+		err = redisClient.Ping(ctx).Err()
+	}
+	return err
+}
+
+// 转发计数事件：每次计数时异步向外部分析服务 POST 一条 JSON 事件。事件先进入有界队列，
+// 由单个 goroutine 发送，队列已满时丢弃事件并记录警告，不阻塞计数请求。
+// analyticsOnly 为 true 时只转发事件，不使用 Redis 计数
+var (
+	analyticsURL   string
+	analyticsOnly  bool
+	analyticsQueue chan AnalyticsEvent
+)
+
+// 发送给分析服务的计数事件
+type AnalyticsEvent struct {
+	Page      string    `json:"page"`
+	IP        string    `json:"ip"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func startAnalyticsForwarder(queueSize int) {
+	analyticsQueue = make(chan AnalyticsEvent, queueSize)
+	go func() {
+		for event := range analyticsQueue {
+			postAnalyticsEvent(event)
+		}
+	}()
+}
+
+func forwardHit(page, ip string) {
+	select {
+	case analyticsQueue <- AnalyticsEvent{Page: page, IP: ip, Timestamp: time.Now()}:
+	default:
+		consoleLogger.Printf(colorYellow+"Analytics queue is full, dropping event for %s\n"+colorReset, page)
+	}
+}
+
+func postAnalyticsEvent(event AnalyticsEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	resp, err := webhookClient.Post(analyticsURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		consoleLogger.Printf(colorRed+"Error forwarding analytics event for %s: %v\n"+colorReset, event.Page, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		consoleLogger.Printf(colorRed+"Analytics event for %s returned %s\n"+colorReset, event.Page, resp.Status)
+	}
+}
+
+// Idempotency-Key 的有效期，为 0 时忽略该请求头
+var idempotencyWindow time.Duration
+
+const maxIdempotencyKeyLength = 255
+
+// 通过 SET NX 占用幂等键：占用成功表示第一次请求，由调用方计数后写入结果；
+// 否则返回已保存的结果，第一次请求尚未完成时返回当前计数
+func replayIdempotentHit(key, redisKey string) (int64, bool, error) {
+	first, err := redisClient.SetNX(ctx, key, "", idempotencyWindow).Result()
+	if err != nil || first {
+		return 0, false, err
+	}
+	stored, err := redisClient.Get(ctx, key).Result()
+	if err == redis.Nil || (err == nil && stored == "") {
+		count, err := currentCount(redisKey)
+		return count, true, err
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	count, err := strconv.ParseInt(stored, 10, 64)
+	return count, true, err
+}
+
+// 两阶段计数的确认窗口：/count 只登记一次待确认的访问，页面渲染完成后通过 /count/confirm 确认才计数；
+// 窗口期内未确认的访问随 Redis 键过期被丢弃，为 0 时直接计数
+var confirmWindow time.Duration
+
+// 登记一次待确认的访问，返回确认令牌
+func addPendingHit(page string) (string, error) {
+	token := newRequestID()
+	err := redisClient.Set(ctx, "page.pending."+token, page, confirmWindow).Err()
+	return token, err
+}
+
+// 确认一次待确认的访问。并发确认同一令牌时只有删除成功的请求计数
+func confirmHandler(w http.ResponseWriter, r *http.Request) {
+	if handleOptions(w, r, "GET, POST, OPTIONS") {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Token parameter is missing", http.StatusBadRequest)
+		return
+	}
+	pendingKey := "page.pending." + token
+	page, err := redisClient.Get(ctx, pendingKey).Result()
+	if err == redis.Nil {
+		http.Error(w, "Unknown or expired token", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		redisError(w, err)
+		return
+	}
+	deleted, err := redisClient.Del(ctx, pendingKey).Result()
+	if err != nil {
+		redisError(w, err)
+		return
+	}
+	if deleted == 0 {
+		http.Error(w, "Unknown or expired token", http.StatusNotFound)
+		return
+	}
+
+	newCount, err := incrementCount(page)
+	if err != nil {
+		if isRedisOverflow(err) {
+			http.Error(w, "Count for page "+page+" has reached the maximum value", http.StatusConflict)
+			return
+		}
+		redisError(w, err)
+		return
+	}
+	rememberCount(page, newCount)
+	afterHit(page, clientIP(r), newCount)
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, r, CountResponse{Page: page, Count: displayCount(newCount)})
+}
+
+// 访问趋势：启用后每次计数同时累加页面当前分钟的计数桶，/count?trend=true 比较最近一小时与前一小时的访问量
+var trendsEnabled bool
+
+// 计数桶保留两小时，多留一分钟避免比较时最早的桶刚好过期
+const trendBucketTTL = 2*time.Hour + time.Minute
+
+type CountTrend struct {
+	LastHour  int64  `json:"last_hour"`
+	PriorHour int64  `json:"prior_hour"`
+	Direction string `json:"direction"` // up、down 或 flat
+}
+
+func trendBucketKey(page string, minute int64) string {
+	return "page.trend." + page + "." + strconv.FormatInt(minute, 10)
+}
+
+// 累加当前分钟的计数桶，失败只记录日志，不影响计数本身
+func recordTrendHit(page string) {
+	key := trendBucketKey(page, time.Now().Unix()/60)
+	pipe := redisClient.Pipeline()
+	pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, trendBucketTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		consoleLogger.Printf(colorRed+"Error recording trend for %s: %v\n"+colorReset, page, err)
+	}
+}
+
+// 读取最近 120 个分钟桶，分别求和最近一小时和前一小时的访问量
+func pageTrend(page string) (*CountTrend, error) {
+	now := time.Now().Unix() / 60
+	keys := make([]string, 0, 120)
+	for i := int64(0); i < 120; i++ {
+		keys = append(keys, trendBucketKey(page, now-i))
+	}
+	values, err := redisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	trend := &CountTrend{Direction: "flat"}
+	for i, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			continue
+		}
+		if i < 60 {
+			trend.LastHour += n
+		} else {
+			trend.PriorHour += n
+		}
+	}
+	switch {
+	case trend.LastHour > trend.PriorHour:
+		trend.Direction = "up"
+	case trend.LastHour < trend.PriorHour:
+		trend.Direction = "down"
+	}
+	return trend, nil
+}
+
+// 同一 IP 在窗口期内对同一页面的重复请求不再计数，为 0 时不去重
+var (
+	dedupWindow time.Duration
+	dedupReject bool // 为 true 时重复请求返回 429，而不是当前计数
+)
+
+// 通过 Redis SET NX EX 判断是否为窗口期内的重复请求，多个实例共享同一个锁
+func isDuplicateHit(ip, page string) (bool, error) {
+	first, err := redisClient.SetNX(ctx, "page.dedup."+page+"."+ip, 1, dedupWindow).Result()
+	return !first, err
+}
+
+// 读取页面当前的计数，不存在时为 0
+func currentCount(redisKey string) (int64, error) {
+	count, err := redisClient.Get(ctx, redisKey).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return count, err
+}
+
+// 为页面计数一次：启用批量写入时累计到进程内，否则直接 INCR
+func incrementCount(page string) (int64, error) {
+	redisKey := "page.count." + page
+	if countBatchInterval > 0 {
+		return batchIncr(page, redisKey)
+	}
+	return redisClient.Incr(ctx, redisKey).Result()
+}
+
+// 读取页面的当前计数而不计数，包括批量写入中尚未写入 Redis 的增量
+func peekCount(page string) (int64, error) {
+	count, err := currentCount("page.count." + page)
+	if err == nil && countBatchInterval > 0 {
+		count += unflushedCount(page)
+	}
+	return count, err
+}
+
+// 一次访问计数成功后通知 webhook、转发分析事件并记录趋势
+func afterHit(page, ip string, newCount int64) {
+	if webhookURL != "" {
+		notifyThresholds(page, newCount-1, newCount)
+	}
+	if analyticsURL != "" {
+		forwardHit(page, ip)
+	}
+	if trendsEnabled {
+		recordTrendHit(page)
+	}
+}
+
+// 计数批量写入：在进程内累计各页面的增量，每隔 countBatchInterval 以一次 INCRBY 写入 Redis，
+// 降低高写入量时 Redis 的压力。响应中的计数为 Redis 中的值加上尚未写入的增量，是一个估计值
+var (
+	countBatchInterval time.Duration // 为 0 时每次请求直接 INCR
+	countBatchMutex    sync.Mutex
+	countBatchBase     = make(map[string]int64) // 最近一次从 Redis 得到的计数
+	countBatchFlushing = make(map[string]int64) // 正在写入 Redis 的增量
+	countBatchPending  = make(map[string]int64) // 尚未写入的增量
+	countFlushMutex    sync.Mutex               // 保证同一时间只有一次写入
+)
+
+// 记录一次增量并返回估计的计数，页面在本进程中第一次出现时先从 Redis 读取基准值
+func batchIncr(page, redisKey string) (int64, error) {
+	countBatchMutex.Lock()
+	_, seeded := countBatchBase[page]
+	countBatchMutex.Unlock()
+	if !seeded {
+		count, err := currentCount(redisKey)
+		if err != nil {
+			return 0, err
+		}
+		countBatchMutex.Lock()
+		if _, ok := countBatchBase[page]; !ok {
+			countBatchBase[page] = count
+		}
+		countBatchMutex.Unlock()
+	}
+
+	countBatchMutex.Lock()
+	defer countBatchMutex.Unlock()
+	countBatchPending[page]++
+	return countBatchBase[page] + countBatchFlushing[page] + countBatchPending[page], nil
+}
+
+// 页面尚未写入 Redis 的增量，用于只读取计数的请求
+func unflushedCount(page string) int64 {
+	countBatchMutex.Lock()
+	defer countBatchMutex.Unlock()
+	return countBatchFlushing[page] + countBatchPending[page]
+}
+
+// 将累计的增量写入 Redis。写入失败的增量留到下一次重试；超出 int64 范围的增量无法写入，记录后丢弃。
+// 本轮没有增量的页面不再保留基准值，下次出现时重新读取，使内存只与活跃页面数有关
+func flushCountBatch() {
+	countFlushMutex.Lock()
+	defer countFlushMutex.Unlock()
+
+	countBatchMutex.Lock()
+	countBatchFlushing, countBatchPending = countBatchPending, make(map[string]int64)
+	flushing := countBatchFlushing
+	countBatchMutex.Unlock()
+	if len(flushing) == 0 {
+		countBatchMutex.Lock()
+		base := make(map[string]int64, len(countBatchPending))
+		for page := range countBatchPending {
+			base[page] = countBatchBase[page]
+		}
+		countBatchBase = base
+		countBatchMutex.Unlock()
+		return
+	}
+
+	pipe := redisClient.Pipeline()
+	results := make(map[string]*redis.IntCmd, len(flushing))
+	for page, delta := range flushing {
+		if maxIncrement > 0 && delta > maxIncrement {
+			consoleLogger.Printf(colorYellow+"Clamping %d increments for %s to -max-increment %d\n"+colorReset, delta, page, maxIncrement)
+			delta = maxIncrement
+		}
+		results[page] = pipe.IncrBy(ctx, "page.count."+page, delta)
+	}
+	pipe.Exec(ctx)
+
+	countBatchMutex.Lock()
+	defer countBatchMutex.Unlock()
+	base := make(map[string]int64, len(flushing))
+	for page, cmd := range results {
+		count, err := cmd.Result()
+		switch {
+		case err == nil:
+			base[page] = count
+		case isRedisOverflow(err):
+			consoleLogger.Printf(colorRed+"Dropping %d increments for %s: count has reached the maximum value\n"+colorReset, flushing[page], page)
+		default:
+			consoleLogger.Printf(colorRed+"Error flushing %d increments for %s: %v\n"+colorReset, flushing[page], page, err)
+			countBatchPending[page] += flushing[page]
+			base[page] = countBatchBase[page]
+		}
+	}
+	for page := range countBatchPending {
+		if _, ok := base[page]; !ok {
+			if count, ok := countBatchBase[page]; ok {
+				base[page] = count
+			}
+		}
+	}
+	countBatchBase = base
+	countBatchFlushing = make(map[string]int64)
+}
+
+func flushCountBatchLoop() {
+	ticker := time.NewTicker(countBatchInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		flushCountBatch()
+	}
+}
+
+// 为页面记录一次访问并返回计数，HEAD 请求和去重窗口内的重复请求只读取当前计数。
+// 失败时已写出错误响应并返回 false
+// confirm 为 true 且启用了 -confirm-window 时只登记待确认的访问，返回当前计数和确认令牌
+func recordHit(w http.ResponseWriter, r *http.Request, page string, confirm bool) (int64, string, bool) {
+	redisKey := "page.count." + page
+
+	// HEAD 请求必须是安全的，只读取当前计数，不参与去重也不触发 webhook
+	peek := r.Method == http.MethodHead
+
+	// 只转发事件时没有可以返回的计数
+	if analyticsOnly {
+		if !peek {
+			forwardHit(page, clientIP(r))
+		}
+		return 0, "", true
+	}
+
+	// 带 Idempotency-Key 的重试在窗口期内返回第一次请求的结果，不再计数
+	idempotencyKey := ""
+	if key := r.Header.Get("Idempotency-Key"); key != "" && idempotencyWindow > 0 && !peek {
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return 0, "", false
+		}
+		idempotencyKey = "page.idempotency." + page + "." + key
+		count, replayed, err := replayIdempotentHit(idempotencyKey, redisKey)
+		if err != nil {
+			count, ok := staleOrError(w, page, err)
+			return count, "", ok
+		}
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+			return count, "", true
+		}
+	}
+
+	// 这次请求没有计数就返回时释放占用的幂等键，让客户端的重试能够重新计数而不是被当作重放
+	releaseIdempotencyKey := func() {
+		if idempotencyKey != "" {
+			redisClient.Del(ctx, idempotencyKey)
+		}
+	}
+
+	var err error
+	duplicate := false
+	if dedupWindow > 0 && !peek {
+		duplicate, err = isDuplicateHit(clientIP(r), page)
+		if err != nil {
+			releaseIdempotencyKey()
+			count, ok := staleOrError(w, page, err)
+			return count, "", ok
+		}
+	}
+
+	// 重复请求默认只返回当前计数并标记为未计数，-dedup-reject 时返回 429
+	if duplicate {
+		if dedupReject {
+			releaseIdempotencyKey()
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return 0, "", false
+		}
+		w.Header().Set("X-Count-Suppressed", "true")
+	}
+
+	pending := confirm && confirmWindow > 0 && !duplicate && !peek
+	token := ""
+	var newCount int64
+	switch {
+	case duplicate || peek || pending:
+		newCount, err = peekCount(page)
+		if err == nil && pending {
+			token, err = addPendingHit(page)
+		}
+	default:
+		newCount, err = incrementCount(page)
+	}
+	if err != nil {
+		releaseIdempotencyKey()
+		if isRedisOverflow(err) {
+			http.Error(w, "Count for page "+page+" has reached the maximum value", http.StatusConflict)
+			return 0, "", false
+		}
+		count, ok := staleOrError(w, page, err)
+		return count, "", ok
+	}
+	rememberCount(page, newCount)
+	if idempotencyKey != "" {
+		redisClient.SetXX(ctx, idempotencyKey, newCount, idempotencyWindow)
+	}
+
+	if pending {
+		// 待确认的访问在确认时才通知 webhook 和转发事件
+		w.Header().Set("X-Confirm-Token", token)
+		return newCount, token, true
+	}
+
+	if !duplicate && !peek {
+		afterHit(page, clientIP(r), newCount)
+	}
+
+	return newCount, "", true
+}
+
+func countHandler(w http.ResponseWriter, r *http.Request) {
+	// OPTIONS 和写方法都不应触发计数
+	if handleAPIMethods(w, r) {
+		return
+	}
+
+	page := r.URL.Query().Get("page")
+	if page == "" {
+		http.Error(w, "Page parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	// 不在允许列表中的页面不创建计数
+	if pageAllowlist != nil && !pageAllowlist[page] {
+		http.Error(w, "Unknown page", http.StatusNotFound)
+		return
+	}
+
+	// 未启用趋势时拒绝 trend 参数，而不是静默忽略
+	withTrend := r.URL.Query().Get("trend") == "true"
+	if withTrend && !trendsEnabled {
+		http.Error(w, "Trends are not enabled", http.StatusBadRequest)
+		return
+	}
+
+	// 在计数之前校验 JSONP 回调，非法请求不应产生计数
+	callback := r.URL.Query().Get("callback")
+	if callback != "" && !validJSONPCallback(callback) {
+		http.Error(w, "Invalid callback parameter", http.StatusBadRequest)
+		return
+	}
+
+	// 在计数之前完成内容协商，406 的请求不应产生计数；JSONP 请求始终返回 JavaScript
+	contentType := "application/json"
+	if callback == "" {
+		contentType = negotiateContentType(r.Header.Get("Accept"), countContentTypes)
+		if contentType == "" {
+			if strictAccept {
+				http.Error(w, "Not Acceptable: supported types are "+strings.Join(countContentTypes, ", "), http.StatusNotAcceptable)
+				return
+			}
+			contentType = "application/json"
+		}
+		w.Header().Set("Vary", "Accept")
+	}
+
+	newCount, token, ok := recordHit(w, r, page, true)
+	if !ok {
+		return
+	}
+	if analyticsOnly {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// 创建响应对象
+	response := CountResponse{
+		Page:         page,
+		Count:        displayCount(newCount),
+		ConfirmToken: token,
+	}
+	if withTrend {
+		trend, err := pageTrend(page)
+		if err != nil {
+			redisError(w, err)
+			return
+		}
+		response.Trend = trend
+	}
+
+	// JSONP 请求将 JSON 包装在回调函数中返回
+	if callback != "" {
+		data, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, "Encoding error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		fmt.Fprintf(w, "%s(%s);", callback, data)
+		return
+	}
+
+	if contentType == "text/plain" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%d\n", response.Count)
+		return
+	}
+
+	// 设置响应头为JSON
+	w.Header().Set("Content-Type", "application/json")
+
+	// 编码并发送JSON响应
+	writeJSON(w, r, response)
+}
+
+// 1x1 透明 GIF
+var beaconGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// 跟踪像素：计数后返回 1x1 透明 GIF，页面无需 JavaScript 即可通过 <img> 记录访问
+func countGIFHandler(w http.ResponseWriter, r *http.Request) {
+	if handleAPIMethods(w, r) {
+		return
+	}
+
+	page := r.URL.Query().Get("page")
+	if page == "" {
+		http.Error(w, "Page parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if pageAllowlist != nil && !pageAllowlist[page] {
+		http.Error(w, "Unknown page", http.StatusNotFound)
+		return
+	}
+
+	// 像素在页面渲染时才会加载，本身就代表一次成功的访问，不需要确认
+	if _, _, ok := recordHit(w, r, page, false); !ok {
+		return
+	}
+
+	// 禁止缓存，否则浏览器再次加载页面时不会请求像素
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Content-Length", strconv.Itoa(len(beaconGIF)))
+	w.Write(beaconGIF)
+}
+
+// gRPC 计数服务，供服务间调用。与 /count 共用 Redis 客户端和计数逻辑（允许列表、批量写入、
+// webhook、分析事件和趋势），但没有按 IP 去重和幂等键。请求和响应使用 wrapperspb 中的
+// 包装类型，不需要 protoc 生成代码：GetCount 和 IncrementCount 都以页面名（StringValue）为参数，返回计数（Int64Value）；
+// GetTopPages 以页面数（Int32Value）为参数，返回与状态页相同的计数最高的页面（ListValue）
+var grpcPort string
+
+type countServiceServer interface {
+	GetCount(context.Context, *wrapperspb.StringValue) (*wrapperspb.Int64Value, error)
+	IncrementCount(context.Context, *wrapperspb.StringValue) (*wrapperspb.Int64Value, error)
+	GetTopPages(context.Context, *wrapperspb.Int32Value) (*structpb.ListValue, error)
+}
+
+type grpcCountService struct{}
+
+// 检查是否可以处理计数请求，返回的错误已经是 gRPC 状态
+func checkGRPCPage(page string) error {
+	if !warmedUp.Load() {
+		return status.Error(codes.Unavailable, "warming up")
+	}
+	if page == "" {
+		return status.Error(codes.InvalidArgument, "page is missing")
+	}
+	if pageAllowlist != nil && !pageAllowlist[page] {
+		return status.Error(codes.NotFound, "unknown page")
+	}
+	return nil
+}
+
+func (grpcCountService) GetCount(_ context.Context, page *wrapperspb.StringValue) (*wrapperspb.Int64Value, error) {
+	if err := checkGRPCPage(page.GetValue()); err != nil {
+		return nil, err
+	}
+	count, err := peekCount(page.GetValue())
+	if err != nil {
+		return nil, grpcRedisError(err)
+	}
+	return wrapperspb.Int64(displayCount(count)), nil
+}
+
+func (grpcCountService) IncrementCount(ctx context.Context, page *wrapperspb.StringValue) (*wrapperspb.Int64Value, error) {
+	if err := checkGRPCPage(page.GetValue()); err != nil {
+		return nil, err
+	}
+	count, err := incrementCount(page.GetValue())
+	if err != nil {
+		if isRedisOverflow(err) {
+			return nil, status.Error(codes.FailedPrecondition, "count for page "+page.GetValue()+" has reached the maximum value")
+		}
+		return nil, grpcRedisError(err)
+	}
+	rememberCount(page.GetValue(), count)
+	ip := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		ip, _, _ = net.SplitHostPort(p.Addr.String())
+	}
+	afterHit(page.GetValue(), ip, count)
+	return wrapperspb.Int64(displayCount(count)), nil
+}
+
+// 返回 -page-metrics-interval 最近一次刷新的计数中最高的 limit 个页面，每项为 {"page": 页面名, "count": 计数}，
+// 按计数从高到低排列。limit 不大于 0 时返回状态页上的页面数
+func (grpcCountService) GetTopPages(_ context.Context, limit *wrapperspb.Int32Value) (*structpb.ListValue, error) {
+	if !warmedUp.Load() {
+		return nil, status.Error(codes.Unavailable, "warming up")
+	}
+	if pageMetricsInterval <= 0 {
+		return nil, status.Error(codes.FailedPrecondition, "top pages require -page-metrics-interval")
+	}
+	n := int(limit.GetValue())
+	if n <= 0 {
+		n = statusTopPages
+	}
+	pages, counts := topPages(n)
+	list := &structpb.ListValue{Values: make([]*structpb.Value, 0, len(pages))}
+	for _, page := range pages {
+		list.Values = append(list.Values, structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+			"page":  structpb.NewStringValue(page),
+			"count": structpb.NewNumberValue(float64(displayCount(counts[page]))),
+		}}))
+	}
+	return list, nil
+}
+
+// 与 redisError 对应：认证错误返回 Unavailable 并在消息中说明，其他错误返回 Internal
+func grpcRedisError(err error) error {
+	if isRedisAuthError(err) {
+		return status.Error(codes.Unavailable, "database authentication failed")
+	}
+	return status.Error(codes.Internal, "database error")
+}
+
+func countServiceHandler(method func(countServiceServer, context.Context, *wrapperspb.StringValue) (*wrapperspb.Int64Value, error), fullMethod string) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		in := new(wrapperspb.StringValue)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return method(srv.(countServiceServer), ctx, in)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}
+		return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return method(srv.(countServiceServer), ctx, req.(*wrapperspb.StringValue))
+		})
+	}
+}
+
+func getTopPagesHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wrapperspb.Int32Value)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(countServiceServer).GetTopPages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/httpserver.CountService/GetTopPages"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(countServiceServer).GetTopPages(ctx, req.(*wrapperspb.Int32Value))
+	})
+}
+
+// 手写的服务描述，相当于 protoc 根据以下定义生成的代码：
+//
+//	service CountService {
+//	  rpc GetCount(google.protobuf.StringValue) returns (google.protobuf.Int64Value);
+//	  rpc IncrementCount(google.protobuf.StringValue) returns (google.protobuf.Int64Value);
+//	  rpc GetTopPages(google.protobuf.Int32Value) returns (google.protobuf.ListValue);
+//	}
+var countServiceDesc = grpc.ServiceDesc{
+	ServiceName: "httpserver.CountService",
+	HandlerType: (*countServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "GetCount", Handler: countServiceHandler(countServiceServer.GetCount, "/httpserver.CountService/GetCount")},
+		{MethodName: "IncrementCount", Handler: countServiceHandler(countServiceServer.IncrementCount, "/httpserver.CountService/IncrementCount")},
+		{MethodName: "GetTopPages", Handler: getTopPagesHandler},
+	},
+	Metadata: "httpserver/count.proto",
+}
+
+func newGRPCServer() *grpc.Server {
+	srv := grpc.NewServer()
+	srv.RegisterService(&countServiceDesc, grpcCountService{})
+	return srv
+}
+
+// 页面计数指标：定期从 Redis 读取各页面的计数，以 Prometheus gauge 的形式输出
+var (
+	pageMetricsInterval time.Duration // 刷新间隔，为 0 时不输出页面计数指标
+	pageMetricsMax      int           // 最多输出的页面数量，避免指标基数爆炸
+	pageCounts          map[string]int64
+	pageCountsMutex     sync.RWMutex
+)
+
+// 扫描所有页面计数，保留计数最高的 pageMetricsMax 个页面
+func refreshPageCounts() error {
+	counts := make(map[string]int64)
+	iter := redisClient.Scan(ctx, 0, "page.count.*", 1000).Iterator()
+	var keys []string
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		values, err := redisClient.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, value := range values {
+			str, ok := value.(string)
+			if !ok {
+				continue
+			}
+			if count, err := strconv.ParseInt(str, 10, 64); err == nil {
+				counts[strings.TrimPrefix(keys[i], "page.count.")] = count
+			}
+		}
+		keys = keys[:0]
+		return nil
+	}
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == 1000 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if len(counts) > pageMetricsMax {
+		pages := make([]string, 0, len(counts))
+		for page := range counts {
+			pages = append(pages, page)
+		}
+		sort.Slice(pages, func(i, j int) bool { return counts[pages[i]] > counts[pages[j]] })
+		for _, page := range pages[pageMetricsMax:] {
+			delete(counts, page)
+		}
+	}
+
+	pageCountsMutex.Lock()
+	pageCounts = counts
+	pageCountsMutex.Unlock()
+	return nil
+}
+
+// 返回最近一次刷新的计数中最高的 n 个页面（按计数从高到低）和对应的计数。
+// 刷新时整体替换 pageCounts，返回的 map 不会再被修改
+func topPages(n int) ([]string, map[string]int64) {
+	pageCountsMutex.RLock()
+	counts := pageCounts
+	pageCountsMutex.RUnlock()
+	pages := make([]string, 0, len(counts))
+	for page := range counts {
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool { return counts[pages[i]] > counts[pages[j]] })
+	if len(pages) > n {
+		pages = pages[:n]
+	}
+	return pages, counts
+}
+
+func refreshPageCountsLoop() {
+	for {
+		if err := refreshPageCounts(); err != nil {
+			consoleLogger.Printf(colorRed+"Error refreshing page metrics: %v\n"+colorReset, err)
+		}
+		time.Sleep(pageMetricsInterval)
+	}
+}
+
+// 转义 Prometheus 标签值中的反斜杠、双引号和换行
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// 以 Prometheus 文本格式输出运行指标
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP http_requests_total Total number of HTTP requests served, by status class.")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	for class := 1; class <= 5; class++ {
+		fmt.Fprintf(w, "http_requests_total{class=\"%dxx\"} %d\n", class, statusClassCounts[class].Load())
+	}
+	fmt.Fprintln(w, "# HELP http_response_bytes_total Total number of response bytes sent.")
+	fmt.Fprintln(w, "# TYPE http_response_bytes_total counter")
+	fmt.Fprintf(w, "http_response_bytes_total %d\n", totalBytesSent.Load())
+	fmt.Fprintln(w, "# HELP process_uptime_seconds Time since the server started.")
+	fmt.Fprintln(w, "# TYPE process_uptime_seconds gauge")
+	fmt.Fprintf(w, "process_uptime_seconds %g\n", time.Since(startTime).Seconds())
+	fmt.Fprintln(w, "# HELP http_requests_in_flight Number of requests currently being served.")
+	fmt.Fprintln(w, "# TYPE http_requests_in_flight gauge")
+	fmt.Fprintf(w, "http_requests_in_flight %d\n", inFlightRequests.Load())
+	fmt.Fprintln(w, "# HELP http_requests_in_flight_peak Highest number of concurrent requests since the server started.")
+	fmt.Fprintln(w, "# TYPE http_requests_in_flight_peak gauge")
+	fmt.Fprintf(w, "http_requests_in_flight_peak %d\n", peakInFlight.Load())
+	fmt.Fprintln(w, "# HELP http_connections_open Number of open client connections.")
+	fmt.Fprintln(w, "# TYPE http_connections_open gauge")
+	fmt.Fprintf(w, "http_connections_open %d\n", openConns.Load())
+	fmt.Fprintln(w, "# HELP http_connections_peak Highest number of open client connections since the server started.")
+	fmt.Fprintln(w, "# TYPE http_connections_peak gauge")
+	fmt.Fprintf(w, "http_connections_peak %d\n", peakConns.Load())
+	fmt.Fprintln(w, "# HELP log_write_errors_total Number of access log lines that could not be written to the log file.")
+	fmt.Fprintln(w, "# TYPE log_write_errors_total counter")
+	fmt.Fprintf(w, "log_write_errors_total %d\n", logWriteErrors.Load())
+
+	if pageMetricsInterval <= 0 {
+		return
+	}
+	writePageCountMetrics(w)
+}
+
+// 以 Prometheus 文本格式输出最近一次读取的页面计数，按页面排序
+func writePageCountMetrics(w io.Writer) {
+	pageCountsMutex.RLock()
+	defer pageCountsMutex.RUnlock()
+	pages := make([]string, 0, len(pageCounts))
+	for page := range pageCounts {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+	fmt.Fprintln(w, "# HELP page_view_count Current view count of a page.")
+	fmt.Fprintln(w, "# TYPE page_view_count gauge")
+	for _, page := range pages {
+		fmt.Fprintf(w, "page_view_count{page=\"%s\"} %d\n", prometheusLabelEscaper.Replace(page), pageCounts[page])
+	}
+}
+
+// Prometheus Pushgateway：定期把页面计数推送到 Pushgateway，进程退出前再推送一次，
+// 短时运行的实例退出后指标仍然保留
+var (
+	pushgatewayURL      string // 为空时不推送
+	pushgatewayJob      = "httpserver"
+	pushgatewayInterval = time.Minute
+	pushgatewayClient   = &http.Client{Timeout: 10 * time.Second}
+)
+
+// 推送失败后的重试次数，等待时间从 1s 开始每次翻倍
+const pushgatewayRetries = 3
+
+// 重新读取页面计数并以 PUT 替换 Pushgateway 中该 job 的全部指标，不再存在的页面随之删除
+func pushPageCounts() error {
+	if err := refreshPageCounts(); err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	writePageCountMetrics(&body)
+	target := strings.TrimSuffix(pushgatewayURL, "/") + "/metrics/job/" + url.PathEscape(pushgatewayJob)
+	req, err := http.NewRequest(http.MethodPut, target, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := pushgatewayClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("pushgateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+func pushPageCountsWithRetry() {
+	wait := time.Second
+	err := pushPageCounts()
+	for attempt := 1; err != nil && attempt <= pushgatewayRetries; attempt++ {
+		consoleLogger.Printf(colorYellow+"Error pushing page counts (%v), retrying in %s (%d/%d)\n"+colorReset, err, wait, attempt, pushgatewayRetries)
+		time.Sleep(wait)
+		wait *= 2
+		err = pushPageCounts()
+	}
+	if err != nil {
+		consoleLogger.Printf(colorRed+"Error pushing page counts to %s: %v\n"+colorReset, pushgatewayURL, err)
+	}
+}
+
+func pushPageCountsLoop() {
+	for range time.Tick(pushgatewayInterval) {
+		pushPageCountsWithRetry()
+	}
+}
+
+// 功能开关，从 JSON 文件加载，收到 SIGHUP 时重新加载
+var (
+	featureFlagsFile  string
+	featureFlags      map[string]interface{}
+	featureFlagsMutex sync.RWMutex
+)
+
+func loadFeatureFlags() error {
+	data, err := os.ReadFile(featureFlagsFile)
+	if err != nil {
+		return err
+	}
+
+	var flags map[string]interface{}
+	if err := json.Unmarshal(data, &flags); err != nil {
+		return err
+	}
+
+	featureFlagsMutex.Lock()
+	featureFlags = flags
+	featureFlagsMutex.Unlock()
+	return nil
+}
+
+func flagsHandler(w http.ResponseWriter, r *http.Request) {
+	if handleAPIMethods(w, r) {
+		return
+	}
+
+	// loadFeatureFlags 整体替换 map 而不修改它，复制引用后即可释放锁，
+	// 读取较慢的客户端不会阻塞 SIGHUP 重新加载
+	featureFlagsMutex.RLock()
+	flags := featureFlags
+	featureFlagsMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, r, flags)
+}
+
+// 服务是否已准备好接收流量：监听器开始接受连接且预热完成后置为 true，
+// 收到终止信号后置为 false，供负载均衡器摘除实例
+var ready atomic.Bool
+
+// 启动预热是否已完成，完成后不再改变。预热期间计数 API 返回 503，
+// 而关闭前的 -preshutdown-delay 期间计数 API 照常处理请求
+var warmedUp atomic.Bool
+
+// lame-duck 模式：就绪检查返回 503 让负载均衡器摘除实例，但继续正常处理请求。
+// 通过管理接口在运行时切换，与进程生命周期无关
+var lameDuck atomic.Bool
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	if !ready.Load() || lameDuck.Load() {
+		http.Error(w, "Not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// 先让就绪检查失败，等待 delay 让负载均衡器停止转发新流量后再开始关闭，期间请求照常处理
+func enterPreShutdown(delay time.Duration) {
+	ready.Store(false)
+	if delay > 0 {
+		consoleLogger.Printf("Not ready, waiting %s before shutting down\n", delay)
+		time.Sleep(delay)
+	}
+}
+
+// 连接 Redis，失败时按 -redis-connect-retries 重试，仍然失败时退出
+func connectRedis() {
+	if err := pingRedis(redisConnectRetries, redisConnectInterval); err != nil {
+		if isRedisAuthError(err) {
+			consoleLogger.Fatal("Redis rejected the credentials, check -redis-password: ", err)
+		}
+		consoleLogger.Fatal("Error connecting to Redis: ", err)
+	}
+}
+
+// 启动预热：在监听器开始接受连接之后连接 Redis 并启动依赖 Redis 的后台任务，
+// 完成后才标记为就绪，此前 /readyz 返回 503
+func warmUp() {
+	if redisClient != nil {
+		connectRedis()
+		if pageMetricsInterval > 0 {
+			go refreshPageCountsLoop()
+		}
+		if countBatchInterval > 0 {
+			go flushCountBatchLoop()
+		}
+		if pushgatewayURL != "" {
+			go pushPageCountsLoop()
+		}
+		if maintenanceBanner != "" {
+			watchRedisHealth()
+		}
+	}
+	warmedUp.Store(true)
+	ready.Store(true)
+	consoleLogger.Println("Ready")
+}
+
+// 预热完成前返回 503，避免在 Redis 连接建立之前处理计数请求
+func requireWarmedUp(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !warmedUp.Load() {
+			http.Error(w, "Warming up", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 为 true 时静态文件也只在就绪后提供，预热完成前和关闭前的 -preshutdown-delay 期间返回 503
+var staticRequireReady bool
+
+func requireReady(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "Not ready", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 管理接口使用的令牌，为空时不注册管理接口
+var adminToken string
+
+// 校验请求携带的管理令牌（Authorization: Bearer <token>、X-Admin-Token，
+// 或者以令牌为密码的 Basic 认证，便于在浏览器中打开 /admin/status）
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Admin-Token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		} else if _, password, ok := r.BasicAuth(); ok {
+			token = password
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// 日志轮转结果
+type RotateLogsResponse struct {
+	Archived string `json:"archived"`
+	Current  string `json:"current"`
+}
+
+// 按需轮转日志文件，适用于不方便发送信号的环境
+func rotateLogsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	archived, err := rotateLogFile()
+	if err != nil {
+		http.Error(w, "Error rotating log file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	consoleLogger.Printf("Rotated log file to %s\n", archived)
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, r, RotateLogsResponse{Archived: archived, Current: "server.log"})
+}
+
+// lame-duck 模式的当前状态
+type LameDuckResponse struct {
+	LameDuck bool `json:"lame_duck"`
+}
+
+// GET 返回当前状态，POST ?enabled=true|false 切换
+func lameDuckHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		if lameDuck.Swap(enabled) != enabled {
+			if enabled {
+				consoleLogger.Println("Entering lame-duck mode, /readyz now returns 503")
+			} else {
+				consoleLogger.Println("Leaving lame-duck mode")
+			}
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, r, LameDuckResponse{LameDuck: lameDuck.Load()})
+}
+
+// 已注册的路由及其使用的中间件，用于 -print-routes 输出
+type routeInfo struct {
+	Pattern     string
+	Middlewares []string
+}
+
+var routes []routeInfo
+
+// 请求超时：-request-timeout 为所有路由的默认值，-route-timeout 按路由模式覆盖，为 0 时不限制
+var (
+	requestTimeout    time.Duration
+	routeTimeoutPairs pairList
+	routeTimeouts     map[string]time.Duration
+)
+
+func parseRouteTimeouts(pairs pairList) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration, len(pairs))
+	for _, kv := range pairs {
+		d, err := time.ParseDuration(kv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout for %s: %v", kv.Key, err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("invalid timeout for %s: must not be negative", kv.Key)
+		}
+		timeouts[kv.Key] = d
+	}
+	return timeouts, nil
+}
+
+// API 路由的描述，/api 只列出已注册且在此表中的路由
+type apiParam struct {
+	Name        string `json:"name"`
+	Required    bool   `json:"required"`
+	Description string `json:"description"`
+}
+
+type apiEndpoint struct {
+	Path        string     `json:"path"`
+	Methods     []string   `json:"methods"`
+	Params      []apiParam `json:"params,omitempty"`
+	Description string     `json:"description"`
+}
+
+var apiEndpoints = []apiEndpoint{
+	{
+		Path:    "/count",
+		Methods: []string{"GET", "HEAD", "OPTIONS"},
+		Params: []apiParam{
+			{Name: "page", Required: true, Description: "Page to count"},
+			{Name: "callback", Description: "JSONP callback name; the response is JavaScript calling it"},
+			{Name: "trend", Description: "true to include views in the last hour vs the prior hour (requires -trends)"},
+		},
+		Description: "Increment and return the view count of a page (HEAD returns the current count without incrementing)",
+	},
+	{
+		Path:        "/count.gif",
+		Methods:     []string{"GET", "HEAD", "OPTIONS"},
+		Params:      []apiParam{{Name: "page", Required: true, Description: "Page to count"}},
+		Description: "Increment the view count of a page and return a 1x1 transparent GIF",
+	},
+	{
+		Path:        "/count/confirm",
+		Methods:     []string{"GET", "POST", "OPTIONS"},
+		Params:      []apiParam{{Name: "token", Required: true, Description: "Confirmation token returned by /count"}},
+		Description: "Confirm a pending view returned by /count and increment its count",
+	},
+	{Path: "/flags", Methods: []string{"GET", "HEAD", "OPTIONS"}, Description: "Current feature flags as a JSON object"},
+	{Path: "/readyz", Methods: []string{"GET"}, Description: "Readiness probe, 503 while shutting down"},
+	{Path: "/metrics", Methods: []string{"GET"}, Description: "Prometheus metrics"},
+	{Path: "/sitemap.xml", Methods: []string{"GET"}, Description: "Generated sitemap of the HTML files under the root"},
+	{Path: "/admin/rotate-logs", Methods: []string{"POST"}, Description: "Rotate server.log (requires the admin token)"},
+	{Path: "/admin/lame-duck", Methods: []string{"GET", "POST"}, Params: []apiParam{{Name: "enabled", Description: "true or false, required for POST"}}, Description: "Show or toggle lame-duck mode, in which /readyz returns 503 but requests are still served (requires the admin token)"},
+	{Path: "/admin/status", Methods: []string{"GET"}, Description: "HTML status dashboard with request stats, Redis health, top pages and recent errors (requires the admin token, also accepted as the Basic auth password)"},
+	{Path: "/admin/time", Methods: []string{"GET"}, Description: "Clock skew between the server and Redis (requires the admin token)"},
+	{Path: "/api", Methods: []string{"GET", "HEAD", "OPTIONS"}, Description: "This manifest of the available API routes"},
+}
+
+// 返回已注册 API 路由的 JSON 描述，按路径排序
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	if handleAPIMethods(w, r) {
+		return
+	}
+
+	registered := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		registered[route.Pattern] = true
+	}
+	endpoints := []apiEndpoint{}
+	for _, endpoint := range apiEndpoints {
+		if registered[endpoint.Path] {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Path < endpoints[j].Path })
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, r, struct {
+		Endpoints []apiEndpoint `json:"endpoints"`
+	}{endpoints})
+}
+
+// 为 true 时不提供静态文件，根路径返回 API 描述，其他未注册的路径返回 JSON 格式的 404
+var noStatic bool
+
+func apiRootHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		apiHandler(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	writeJSON(w, r, ErrorResponse{Error: http.StatusText(http.StatusNotFound), Status: http.StatusNotFound})
+}
+
+// 注册路由并记录其中间件。middlewares 以 logRequest 开头时由这里包装 logRequest，
+// 让它位于超时之外，记录的状态码就是客户端实际收到的状态码。
+// 配置了超时的 API 路由包装 http.TimeoutHandler，超时返回 503；静态文件路由改用 streamTimeout
+func handleRoute(pattern string, handler http.Handler, middlewares ...string) {
+	logged := len(middlewares) > 0 && middlewares[0] == "logRequest"
+	if logged {
+		middlewares = middlewares[1:]
+	} else {
+		// 匹配 -route-log-fields 中除 / 以外的前缀的 API 路由默认不记录访问日志，此时为其加上 logRequest
+		for _, set := range routeLogFieldSets {
+			if set.prefix != "/" && strings.HasPrefix(pattern, set.prefix) {
+				logged = true
+				break
+			}
+		}
+	}
+	timeout, ok := routeTimeouts[pattern]
+	if !ok {
+		timeout = requestTimeout
+	}
+	if timeout > 0 {
+		if pattern == "/" && !noStatic {
+			handler = streamTimeout(handler, timeout)
+		} else {
+			handler = http.TimeoutHandler(handler, timeout, "Request timed out")
+		}
+		middlewares = append([]string{"timeout(" + timeout.String() + ")"}, middlewares...)
+	}
+	if logged {
+		handler = logRequest(handler)
+		middlewares = append([]string{"logRequest"}, middlewares...)
+	}
+	http.Handle(pattern, handler)
+	routes = append(routes, routeInfo{Pattern: pattern, Middlewares: middlewares})
+}
+
+// 静态文件路由的超时。http.TimeoutHandler 会缓冲整个响应体并隐藏 ReadFrom，大文件无法流式传输，
+// 因此这里只给请求上下文设置截止时间，并通过 http.ResponseController 设置连接的写截止时间：
+// 截止时间前没有写出响应时返回 503，已经开始发送的响应在截止时间到达后被中断
+func streamTimeout(handler http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline := time.Now().Add(timeout)
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(deadline); err == nil {
+			// 请求结束后清除写截止时间，避免影响同一 keep-alive 连接上的后续请求
+			defer rc.SetWriteDeadline(time.Time{})
+		}
+
+		lrw := NewLoggingResponseWriter(w)
+		handler.ServeHTTP(lrw, r.WithContext(ctx))
+		if !lrw.wroteHeader && ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, "Request timed out", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// 输出所有已注册的路由，global 为对所有路由生效的服务级中间件
+func printRoutes(global []string) {
+	sorted := make([]routeInfo, len(routes))
+	copy(sorted, routes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Pattern < sorted[j].Pattern })
+
+	for _, route := range sorted {
+		chain := append(append([]string{}, global...), route.Middlewares...)
+		consoleLogger.Printf("Route %-24s %s\n", route.Pattern, strings.Join(chain, " -> "))
+	}
+}
+
+// 证书重新加载器：监视证书和私钥所在的目录，文件更新后自动加载新证书，无需发送信号
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	onReload func() // 重新加载成功后调用
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.mu.Unlock()
+	return nil
+}
+
+// 设置重新加载成功后的回调，可以在 watch 之后调用
+func (cr *certReloader) setOnReload(f func()) {
+	cr.mu.Lock()
+	cr.onReload = f
+	cr.mu.Unlock()
+}
+
+// 作为 tls.Config.GetCertificate 使用，每次握手返回当前的证书
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// 监视目录而不是文件本身：证书通常通过重命名或替换符号链接（如 Kubernetes secret）更新，
+// 直接监视文件会在替换后失效
+func (cr *certReloader) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := map[string]bool{filepath.Dir(cr.certFile): true, filepath.Dir(cr.keyFile): true}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		// 证书和私钥通常先后写入，合并短时间内的多个事件后再加载
+		var reload <-chan time.Time
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				reload = time.After(500 * time.Millisecond)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				consoleLogger.Printf(colorRed+"Error watching TLS certificate: %v\n"+colorReset, err)
+			case <-reload:
+				reload = nil
+				// 加载失败（例如证书与私钥暂时不匹配）时继续使用旧证书
+				if err := cr.load(); err != nil {
+					consoleLogger.Printf(colorRed+"Error reloading TLS certificate: %v\n"+colorReset, err)
+				} else {
+					consoleLogger.Printf("Reloaded TLS certificate from %s\n", cr.certFile)
+					cr.mu.RLock()
+					onReload := cr.onReload
+					cr.mu.RUnlock()
+					if onReload != nil {
+						onReload()
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// 客户端证书认证模式：none 不请求证书，request 请求但不校验，require-and-verify 要求由 -client-ca 签发的有效证书
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+// 读取 PEM 格式的 CA 证书包，用于校验客户端证书
+func loadClientCAs(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// 服务器与 Redis 的时间及两者的偏差
+type TimeSkewResponse struct {
+	ServerTime time.Time `json:"server_time"`
+	RedisTime  time.Time `json:"redis_time"`
+	SkewMs     float64   `json:"skew_ms"`
+	RTTMs      float64   `json:"rtt_ms"`
+}
+
+// 返回服务器时间和 Redis TIME 命令的结果，用于排查 TTL 等与时间相关的问题
+func timeSkewHandler(w http.ResponseWriter, r *http.Request) {
+	before := time.Now()
+	redisTime, err := redisClient.Time(r.Context()).Result()
+	after := time.Now()
+	if err != nil {
+		redisError(w, err)
+		return
+	}
+
+	// 以请求往返的中点作为与 Redis 时间对应的服务器时间
+	rtt := after.Sub(before)
+	serverTime := before.Add(rtt / 2)
+	response := TimeSkewResponse{
+		ServerTime: serverTime,
+		RedisTime:  redisTime,
+		SkewMs:     float64(redisTime.Sub(serverTime)) / float64(time.Millisecond),
+		RTTMs:      float64(rtt) / float64(time.Millisecond),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, r, response)
+}
+
+// 运维状态页：汇总 /metrics 中的运行指标、Redis 状态、计数最高的页面和最近的错误，每 5 秒自动刷新
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>Server status</title>
+<style>body{font:14px sans-serif;margin:2em}table{border-collapse:collapse;margin-bottom:1.5em}td,th{border:1px solid #ccc;padding:4px 8px;text-align:left}</style>
+</head>
+<body>
+<h1>Server status</h1>
+<table>
+<tr><th>Uptime</th><td>{{.Uptime}}</td></tr>
+<tr><th>Requests</th><td id="requests">{{.Requests}}</td></tr>
+<tr><th>By status</th><td>{{range $i, $class := .StatusClasses}}{{if $i}}, {{end}}{{$class.Key}}={{$class.Value}}{{end}}</td></tr>
+<tr><th>Bytes sent</th><td>{{.BytesSent}}</td></tr>
+<tr><th>In flight</th><td>{{.InFlight}} (peak {{.PeakInFlight}})</td></tr>
+<tr><th>Connections</th><td>{{.OpenConns}} (peak {{.PeakConns}})</td></tr>
+<tr><th>Ready</th><td>{{.Ready}}{{if .LameDuck}} (lame duck){{end}}</td></tr>
+<tr><th>Redis</th><td>{{.Redis}}</td></tr>
+<tr><th>Log write errors</th><td>{{.LogWriteErrors}}</td></tr>
+</table>
+<h2>Top pages</h2>
+{{if .TopPages}}<table>
+<tr><th>Page</th><th>Count</th></tr>
+{{range .TopPages}}<tr><td>{{.Key}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>{{else}}<p>No page counts (enable -page-metrics-interval).</p>{{end}}
+<h2>Recent errors</h2>
+{{if .RecentErrors}}<table>
+<tr><th>Time</th><th>Request</th><th>Status</th></tr>
+{{range .RecentErrors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Method}} {{.Path}}</td><td>{{.Status}}</td></tr>
+{{end}}</table>{{else}}<p>No 5xx responses.</p>{{end}}
+</body>
+</html>
+`))
+
+// 状态页最多显示的页面数
+const statusTopPages = 10
+
+func statusPageHandler(w http.ResponseWriter, r *http.Request) {
+	redisStatus := "not used"
+	if redisClient != nil {
+		pingCtx, cancel := context.WithTimeout(r.Context(), time.Second)
+		defer cancel()
+		if err := redisClient.Ping(pingCtx).Err(); err != nil {
+			redisStatus = "unavailable: " + err.Error()
+		} else {
+			redisStatus = "ok"
+		}
+	}
+
+	pages, counts := topPages(statusTopPages)
+	top := make([]keyValue, 0, len(pages))
+	for _, page := range pages {
+		top = append(top, keyValue{Key: page, Value: strconv.FormatInt(counts[page], 10)})
+	}
+
+	recentErrorsMutex.Lock()
+	errs := append([]recentError(nil), recentErrors...)
+	recentErrorsMutex.Unlock()
+
+	var classes []keyValue
+	for class := 1; class <= 5; class++ {
+		classes = append(classes, keyValue{Key: fmt.Sprintf("%dxx", class), Value: strconv.FormatInt(statusClassCounts[class].Load(), 10)})
+	}
+
+	var page bytes.Buffer
+	err := statusPageTemplate.Execute(&page, map[string]any{
+		"Uptime":         time.Since(startTime).Round(time.Second),
+		"Requests":       totalRequests.Load(),
+		"StatusClasses":  classes,
+		"BytesSent":      totalBytesSent.Load(),
+		"InFlight":       inFlightRequests.Load(),
+		"PeakInFlight":   peakInFlight.Load(),
+		"OpenConns":      openConns.Load(),
+		"PeakConns":      peakConns.Load(),
+		"Ready":          ready.Load(),
+		"LameDuck":       lameDuck.Load(),
+		"Redis":          redisStatus,
+		"LogWriteErrors": logWriteErrors.Load(),
+		"TopPages":       top,
+		"RecentErrors":   errs,
+	})
+	if err != nil {
+		http.Error(w, "Error rendering status page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(page.Bytes())
+}
+
+// 可用于优雅关闭的信号，SIGHUP 保留用于重新加载配置
+var shutdownSignalNames = map[string]os.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGQUIT": syscall.SIGQUIT,
+}
+
+// 解析逗号分隔的信号名称，名称可省略 SIG 前缀且不区分大小写
+func parseShutdownSignals(value string) ([]os.Signal, error) {
+	var signals []os.Signal
+	for _, part := range strings.Split(value, ",") {
+		name := strings.ToUpper(strings.TrimSpace(part))
+		if name == "" {
+			continue
+		}
+		if !strings.HasPrefix(name, "SIG") {
+			name = "SIG" + name
+		}
+		if name == "SIGHUP" {
+			return nil, fmt.Errorf("SIGHUP is reserved for reloading configuration")
+		}
+		sig, ok := shutdownSignalNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported shutdown signal %q", part)
+		}
+		signals = append(signals, sig)
+	}
+	if len(signals) == 0 {
+		return nil, fmt.Errorf("no shutdown signals configured")
+	}
+	return signals, nil
+}
+
+// 监听 SIGHUP 信号并重新加载配置文件
+func watchReloadSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			if featureFlagsFile != "" {
+				if err := loadFeatureFlags(); err != nil {
+					consoleLogger.Printf(colorRed+"Error reloading feature flags: %v\n"+colorReset, err)
+				} else {
+					consoleLogger.Printf("Reloaded feature flags from %s\n", featureFlagsFile)
+				}
+			}
+			if directoryIndexPath != "" {
+				if err := refreshDirectoryIndex(); err != nil {
+					consoleLogger.Printf(colorRed+"Error reloading directory index: %v\n"+colorReset, err)
+				} else {
+					consoleLogger.Println("Reloaded directory index")
+				}
+			}
+		}
+	}()
+}
+
+func main() {
+	// 定义命令行参数，默认端口为 8080
+	var port string
+	flag.StringVar(&port, "p", "8080", "Define what TCP port to bind to")
+
+	// 远程 syslog 选项
+	var syslogAddr, syslogFacility string
+	flag.StringVar(&syslogAddr, "syslog", "", "Also send access logs to a remote syslog server (e.g. udp://logs.example.com:514)")
+	flag.StringVar(&syslogFacility, "syslog-facility", "local0", "Syslog facility used for access logs")
+	flag.BoolVar(&syslogOnly, "syslog-only", false, "Send access logs to -syslog instead of server.log (other server messages still go to server.log)")
+
+	var listingTemplateFile string
+	flag.StringVar(&listingTemplateFile, "listing-template", "", "Go HTML template used to render directory listings")
+
+	var preShutdownDelay time.Duration
+	flag.DurationVar(&preShutdownDelay, "preshutdown-delay", 0, "After a termination signal, report not ready on /readyz for this long before shutting down")
+
+	flag.StringVar(&adminToken, "admin-token", "", "Token required by the /admin/ endpoints (disabled when empty)")
+
+	flag.Var(&contextValues, "context", "key=value pairs injected into every request context; values may reference environment variables such as $DEPLOY_ID (repeatable)")
+	flag.BoolVar(&logContextValue, "log-context", false, "Append the -context key=value pairs to access log lines")
+
+	var markdownTemplateFile string
+	flag.BoolVar(&renderMarkdown, "render-markdown", false, "Render requested .md files to HTML")
+	flag.BoolVar(&markdownIndex, "markdown-index", false, "Generate an index page linking the .md files of directories without an index.html (requires -render-markdown)")
+	flag.StringVar(&markdownTemplateFile, "markdown-template", "", "Go HTML template wrapping rendered markdown (receives .Title, .Path and .Content)")
+
+	flag.BoolVar(&debugMode, "debug", false, "Enable debugging features such as -delay and logging of every Redis command (never use in production)")
+	flag.Var(&delayPairs, "delay", "path=duration pairs delaying matching requests, e.g. /count=500ms (requires -debug; a trailing / matches a prefix)")
+
+	var printRoutesFlag, dryRun bool
+	flag.BoolVar(&printRoutesFlag, "print-routes", false, "Log every registered route and its middlewares at startup")
+	flag.BoolVar(&dryRun, "dry-run", false, "Validate the configuration, print the routes and exit without serving")
+
+	var noCount bool
+	flag.BoolVar(&noStatic, "no-static", false, "Do not serve static files; / returns a JSON description of the API (API-only deployments)")
+	flag.BoolVar(&noCount, "no-count", false, "Disable the /count API and do not connect to Redis (static file serving only)")
+
+	// Redis 连接选项
+	var redisAddr, redisPassword string
+	var redisDB int
+	flag.StringVar(&redisAddr, "redis-addr", "localhost:6379", "Redis server address")
+	flag.StringVar(&redisPassword, "redis-password", "", "Redis password")
+	flag.IntVar(&redisDB, "redis-db", 0, "Redis database number")
+	var redisSlowThreshold time.Duration
+	flag.DurationVar(&redisSlowThreshold, "redis-slow-threshold", 0, "Log a warning for Redis operations slower than this (0 disables)")
+
+	flag.DurationVar(&pageMetricsInterval, "page-metrics-interval", 0, "Refresh per-page count gauges on /metrics at this interval (0 disables)")
+	flag.StringVar(&pushgatewayURL, "pushgateway-url", "", "Periodically push per-page counts to this Prometheus Pushgateway, e.g. http://pushgateway:9091 (also pushed on shutdown)")
+	flag.StringVar(&pushgatewayJob, "pushgateway-job", "httpserver", "Job name the page counts are pushed under")
+	flag.DurationVar(&pushgatewayInterval, "pushgateway-interval", time.Minute, "How often page counts are pushed to -pushgateway-url")
+	flag.IntVar(&pageMetricsMax, "page-metrics-max", 100, "Maximum number of pages exported on /metrics (highest counts first)")
+
+	flag.DurationVar(&dedupWindow, "dedup-window", 0, "Ignore repeated /count hits from the same IP for the same page within this window (0 disables)")
+	flag.BoolVar(&trendsEnabled, "trends", false, "Keep per-minute view buckets in Redis for two hours so /count?trend=true can compare the last hour with the prior hour")
+	flag.DurationVar(&confirmWindow, "confirm-window", 0, "Two-phase counting: /count returns a confirm_token and only counts once /count/confirm is called within this window; unconfirmed views expire uncounted (0 counts immediately)")
+	flag.DurationVar(&idempotencyWindow, "idempotency-window", 24*time.Hour, "How long an Idempotency-Key on /count is remembered; retries with the same key are not counted again (0 ignores the header)")
+	flag.BoolVar(&dedupReject, "dedup-reject", false, "Answer repeated /count hits within -dedup-window with 429 instead of the current count")
+
+	flag.IntVar(&maxPathLength, "max-path-length", 4096, "Reject requests whose URL path is longer than this with 414 (0 disables)")
+	flag.IntVar(&maxQueryLength, "max-query-length", 4096, "Reject requests whose raw query string is longer than this with 414 (0 disables)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "How long an idle keep-alive connection is kept open (0 means no limit)")
+	flag.BoolVar(&logIdleCloses, "log-idle-closes", false, "Log connections closed by the idle timeout (requires -idle-timeout)")
+	flag.DurationVar(&requestTimeout, "request-timeout", 0, "Default time limit for handling a request, after which 503 is returned (0 disables)")
+	flag.Var(&routeTimeoutPairs, "route-timeout", "route=duration pairs overriding -request-timeout for a registered route, e.g. /count=2s (0 disables for that route)")
+	var rootDir string
+	flag.StringVar(&rootDir, "root", ".", "Directory to serve static files from")
+	flag.Var(&vhostPairs, "vhost", "host=root pairs serving a host from its own directory, e.g. example.com=/var/www/example (options: root;index-redirect=bool;listing=file)")
+
+	flag.StringVar(&maintenanceBanner, "maintenance-banner", "", "Message shown in a banner appended to static HTML pages while Redis is down, in lame-duck mode or shutting down (empty disables)")
+	flag.BoolVar(&staticRequireReady, "static-require-ready", false, "Answer static file requests with 503 while /readyz reports not ready (during startup warm-up and -preshutdown-delay)")
+
+	flag.StringVar(&suspiciousPaths, "reject-suspicious-paths", "off", "Reject paths with null bytes, control characters or encoded traversal with 400: off, basic or strict (also encoded slashes and dot segments)")
+	flag.DurationVar(&slowStartWindow, "slow-start", 0, "After startup, ramp the number of concurrent connections from 1 to -slow-start-conns over this window (0 disables)")
+	flag.IntVar(&slowStartConns, "slow-start-conns", 1000, "Concurrent connection limit reached at the end of the -slow-start window, after which connections are unlimited")
+	flag.IntVar(&maxInFlight, "max-in-flight", 0, "Maximum requests handled at once; more wait in a queue and their wait time is logged as wait= (0 disables)")
+	flag.IntVar(&maxConnsPerIP, "max-conns-per-ip", 0, "Maximum concurrent requests from one client IP; more get 429 (0 disables)")
+	flag.BoolVar(&requireHost, "require-host", false, "Reject requests without a Host header (e.g. from HTTP/1.0 clients) with 400")
+	flag.Int64Var(&maxBodySize, "max-body-size", 0, "Reject request bodies larger than this many bytes with 413, before 100 Continue is sent (0 disables)")
+
+	// TLS 选项：指定 -tls-port 时在该端口同时提供 HTTPS 服务
+	var tlsPort, certFile, keyFile string
+	flag.StringVar(&tlsPort, "tls-port", "", "Also serve HTTPS on this TCP port (requires -cert and -key)")
+	flag.StringVar(&grpcPort, "grpc-port", "", "Also serve the gRPC CountService (GetCount, IncrementCount, GetTopPages) on this TCP port")
+	flag.StringVar(&certFile, "cert", "", "TLS certificate file (PEM)")
+	flag.StringVar(&keyFile, "key", "", "TLS private key file (PEM)")
+	var clientCAFile, clientAuth string
+	flag.StringVar(&clientCAFile, "client-ca", "", "CA bundle (PEM) used to verify TLS client certificates")
+	flag.StringVar(&clientAuth, "client-auth", "none", "TLS client certificate authentication: none, request or require-and-verify (requires -client-ca)")
+
+	flag.StringVar(&requestIDHeader, "request-id-header", "X-Request-ID", "Header carrying the request ID, read from requests and echoed in responses")
+	flag.BoolVar(&requestIDTraceparent, "request-id-traceparent", false, "Use the trace ID of a W3C traceparent header when the request ID header is missing")
+
+	flag.StringVar(&logDurationUnit, "log-duration-unit", "ms", "Unit of the request duration in access logs: ms, us or ns")
+	flag.BoolVar(&logSNI, "log-sni", false, "Log the TLS SNI server name of HTTPS requests as sni=")
+	flag.BoolVar(&logOnStart, "log-on-start", false, "Also log a started line with the request ID when a request begins, and add id= to the completion line")
+	var logFieldList string
+	var redactParamList string
+	flag.BoolVar(&logQuery, "log-query", false, "Include the query string in logged paths")
+	flag.StringVar(&redactParamList, "log-redact-params", "", "Comma-separated query parameters whose values are logged as [REDACTED] (requires -log-query), e.g. token,email")
+	var colorMethodList string
+	flag.StringVar(&colorMethodList, "color-methods", "all", "Methods whose console access log lines are colored: all, none, mutating (POST, PUT, PATCH, DELETE) or a comma-separated list")
+	flag.Var(&routeLogFieldPairs, "route-log-fields", "prefix=fields pairs overriding -log-fields for paths under a prefix, with fields separated by |, e.g. /count=ip|method|path|status|duration|bytes|fields,/assets/=status|path (also logs matching API routes)")
+	flag.StringVar(&logFieldList, "log-fields", "", "Comma-separated fields of text access logs in output order, a subset of ip,method,path,status,duration,bytes,fields")
+	flag.StringVar(&consoleLogFormat, "console-log-format", "text", "Format of access logs on stdout: text or json")
+	flag.StringVar(&fileLogFormat, "file-log-format", "text", "Format of access logs in server.log and syslog: text or json")
+	flag.StringVar(&countAsString, "count-as-string", "never", "Encode the /count \"count\" field as a JSON string: never, unsafe (above 2^53-1) or always")
+
+	flag.Int64Var(&countFloor, "count-floor", 0, "Report at least this count from /count (the stored count is unaffected)")
+	flag.Int64Var(&countCeiling, "count-ceiling", 0, "Report at most this count from /count (the stored count keeps growing, 0 disables)")
+
+	flag.BoolVar(&strictAccept, "strict-accept", false, "Return 406 from /count when the Accept header allows neither JSON nor plain text")
+
+	var allowlistPages, allowlistFile string
+	flag.StringVar(&allowlistPages, "page-allowlist", "", "Comma-separated list of pages that /count may count (others return 404)")
+	flag.StringVar(&allowlistFile, "page-allowlist-file", "", "File listing pages that /count may count, one per line")
+
+	var thresholds string
+	var analyticsQueueSize int
+	flag.StringVar(&analyticsURL, "analytics-url", "", "POST a JSON event (page, ip, timestamp) to this URL for every counted hit, asynchronously")
+	flag.IntVar(&analyticsQueueSize, "analytics-queue", 1000, "Maximum number of analytics events waiting to be sent; further events are dropped")
+	flag.BoolVar(&analyticsOnly, "analytics-only", false, "Only forward hits to -analytics-url instead of counting them in Redis (/count returns 202)")
+
+	flag.DurationVar(&countBatchInterval, "count-batch-interval", 0, "Aggregate /count increments in memory and write them to Redis with one INCRBY per page at this interval (0 increments on every request)")
+	flag.Int64Var(&maxIncrement, "max-increment", 0, "Largest amount a single INCRBY may add to a page count; larger -count-batch-interval batches are clamped and the excess dropped (0 is unlimited)")
+	flag.BoolVar(&bufferJSON, "buffer-json", false, "Encode JSON responses into a buffer first so they carry Content-Length instead of using chunked encoding")
+	flag.BoolVar(&countStaleOnError, "count-stale-on-error", false, "When Redis fails, answer /count with the last known count and X-Count-Stale: true instead of 500")
+	flag.IntVar(&redisConnectRetries, "redis-connect-retries", 0, "Retry the startup Redis connection this many times before giving up")
+	flag.DurationVar(&redisConnectInterval, "redis-connect-interval", time.Second, "Delay before the first Redis connection retry, doubled after each attempt (up to 30s)")
+
+	flag.StringVar(&webhookURL, "webhook-url", "", "POST a JSON event to this URL when a page count crosses one of -webhook-thresholds")
+	flag.StringVar(&thresholds, "webhook-thresholds", "", "Comma-separated page count thresholds for -webhook-url, e.g. 100,1000")
+
+	var rotateIntervalFlag string
+	flag.StringVar(&rotateIntervalFlag, "rotate-interval", "daily", "How often server.log is rotated: hourly, daily or a duration such as 30m")
+	flag.DurationVar(&logWriteWarnInterval, "log-write-warn-interval", time.Minute, "Minimum time between console warnings about failed log file writes (e.g. disk full)")
+	flag.DurationVar(&rotateRetryInterval, "rotate-retry-interval", time.Minute, "Minimum time between log rotation attempts after a failed rotation")
+
+	flag.BoolVar(&noSniff, "nosniff", false, "Send X-Content-Type-Options: nosniff and type static files by extension only (unknown extensions get application/octet-stream)")
+
+	flag.BoolVar(&indexRedirect, "index-redirect", false, "Redirect directory requests to their index.html with 301 instead of serving it transparently")
+
+	var sitemapEnabled bool
+	flag.BoolVar(&sitemapEnabled, "sitemap", false, "Serve /sitemap.xml generated from the .html files under the root")
+	flag.DurationVar(&sitemapInterval, "sitemap-interval", time.Hour, "How long a generated sitemap is cached before it is regenerated")
+	flag.StringVar(&directoryIndexPath, "index-json", "", "Serve a JSON index of the whole directory tree under the root at this path, e.g. /index.json, generated at startup and on SIGHUP")
+	flag.DurationVar(&directoryIndexInterval, "index-json-interval", 0, "How often the -index-json index is regenerated (0 only regenerates on SIGHUP)")
+	flag.StringVar(&sitemapBaseURL, "sitemap-base-url", "", "Base URL for sitemap entries, e.g. https://example.com (defaults to the request's scheme and host)")
+
+	var trustedProxyList string
+	flag.StringVar(&trustedProxyList, "trusted-proxies", "", "Comma-separated IPs or CIDRs of proxies whose forwarded headers are trusted")
+	flag.IntVar(&forwardedHops, "forwarded-hops", 0, "Number of trusted proxies that append to X-Forwarded-For; the client IP is that many entries from the right, only for requests from -trusted-proxies (0 ignores the header)")
+	flag.StringVar(&geoHeader, "geo-header", "", "Header carrying the client country set by a trusted proxy, e.g. CF-IPCountry, logged as country=")
+
+	var shutdownSignalList string
+	flag.StringVar(&shutdownSignalList, "shutdown-signals", "SIGINT,SIGTERM", "Comma-separated signals that trigger a graceful shutdown (SIGINT, SIGTERM, SIGQUIT)")
+
+	flag.BoolVar(&negotiateStaticErrors, "static-error-pages", false, "Answer static 5xx errors with a JSON body when Accept prefers JSON and an HTML page otherwise")
+	flag.BoolVar(&lenientRange, "lenient-range", false, "Ignore malformed Range headers on static files and send the full file instead of 416")
+	flag.Int64Var(&staticCacheSize, "static-cache-size", 0, "Bytes of memory for an LRU cache of small static files (files over 1 MiB are never cached, 0 disables)")
+	flag.IntVar(&staticCacheMaxEntries, "static-cache-entries", 0, "Maximum number of files in the -static-cache-size cache, evicting the least recently used (requires -static-cache-size, 0 limits by bytes only)")
+
+	flag.BoolVar(&logFileHash, "log-file-hash", false, "Log the SHA-256 of each served static file (cached until the file changes)")
+
+	var summaryFile string
+	flag.StringVar(&summaryFile, "summary-file", "", "Write a JSON summary of the run to this file on shutdown")
+
+	flag.StringVar(&featureFlagsFile, "flags-file", "", "JSON file of feature flags served at /flags (reloaded on SIGHUP)")
+
+	// 添加 -h 和 --help 选项
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse() // 解析命令行参数
+
+	interval, err := parseRotateInterval(rotateIntervalFlag)
+	if err != nil {
+		consoleLogger.Fatalf("Invalid -rotate-interval %q: %v", rotateIntervalFlag, err)
+	}
+	rotateInterval = interval
+	lastLogDate = currentLogPeriod()
+
+	if _, ok := durationUnits[logDurationUnit]; !ok {
+		consoleLogger.Fatalf("Invalid -log-duration-unit %q: expected ms, us or ns", logDurationUnit)
+	}
+	if redactParamList != "" {
+		if !logQuery {
+			consoleLogger.Fatal("-log-redact-params requires -log-query")
+		}
+		logRedactParams = make(map[string]bool)
+		for _, name := range strings.Split(redactParamList, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				logRedactParams[strings.ToLower(name)] = true
+			}
+		}
+	}
+	if colorMethods, err = parseColorMethods(colorMethodList); err != nil {
+		consoleLogger.Fatal("Error parsing -color-methods: ", err)
+	}
+	if logFieldList != "" {
+		order, err := parseLogFields(logFieldList)
+		if err != nil {
+			consoleLogger.Fatal("Error parsing -log-fields: ", err)
+		}
+		logFieldOrder = order
+	}
+	if len(routeLogFieldPairs) > 0 {
+		sets, err := parseRouteLogFields(routeLogFieldPairs)
+		if err != nil {
+			consoleLogger.Fatal("Error parsing -route-log-fields: ", err)
+		}
+		routeLogFieldSets = sets
+	}
+	for name, format := range map[string]string{"console-log-format": consoleLogFormat, "file-log-format": fileLogFormat} {
+		if format != "text" && format != "json" {
+			consoleLogger.Fatalf("Invalid -%s %q: expected text or json", name, format)
+		}
+	}
+
+	switch countAsString {
+	case "never", "unsafe", "always":
+	default:
+		consoleLogger.Fatalf("Invalid -count-as-string %q: expected never, unsafe or always", countAsString)
+	}
+
+	if countCeiling > 0 && countFloor > countCeiling {
+		consoleLogger.Fatalf("Invalid -count-floor %d: greater than -count-ceiling %d", countFloor, countCeiling)
+	}
+
+	allowlist, err := loadPageAllowlist(allowlistPages, allowlistFile)
+	if err != nil {
+		consoleLogger.Fatal("Error loading page allowlist: ", err)
+	}
+	pageAllowlist = allowlist
+
+	shutdownSignals, err := parseShutdownSignals(shutdownSignalList)
+	if err != nil {
+		consoleLogger.Fatal("Error parsing -shutdown-signals: ", err)
+	}
+
+	if trustedProxies, err = parseTrustedProxies(trustedProxyList); err != nil {
+		consoleLogger.Fatal("Error parsing -trusted-proxies: ", err)
+	}
+	if slowStartWindow > 0 && slowStartConns < 1 {
+		consoleLogger.Fatal("-slow-start-conns must be at least 1")
+	}
+	if forwardedHops < 0 {
+		consoleLogger.Fatal("-forwarded-hops must not be negative")
+	}
+	if forwardedHops > 0 && len(trustedProxies) == 0 {
+		consoleLogger.Fatal("-forwarded-hops requires -trusted-proxies")
+	}
+
+	if webhookThresholds, err = parseThresholds(thresholds); err != nil {
+		consoleLogger.Fatal("Error parsing -webhook-thresholds: ", err)
+	}
+
+	// 展开上下文值中引用的环境变量，例如部署 ID
+	for i := range contextValues {
+		contextValues[i].Value = os.ExpandEnv(contextValues[i].Value)
+	}
+
+	if len(delayPairs) > 0 {
+		if debugMode {
+			delays, err := parsePathDelays(delayPairs)
+			if err != nil {
+				consoleLogger.Fatal("Error parsing -delay: ", err)
+			}
+			pathDelays = delays
+		} else {
+			consoleLogger.Println(colorYellow + "Ignoring -delay because -debug is not set" + colorReset)
+		}
+	}
+
+	// 没有 Host 的请求无法选择虚拟主机
+	if len(vhostPairs) > 0 {
+		requireHost = true
+	}
+
+	if markdownIndex && !renderMarkdown {
+		consoleLogger.Fatal("-markdown-index requires -render-markdown")
+	}
+	if maxIncrement < 0 {
+		consoleLogger.Fatal("-max-increment must not be negative")
+	}
+	if staticCacheMaxEntries > 0 && staticCacheSize <= 0 {
+		consoleLogger.Fatal("-static-cache-entries requires -static-cache-size")
+	}
+
+	switch suspiciousPaths {
+	case "off", "basic", "strict":
+	default:
+		consoleLogger.Fatalf("Invalid -reject-suspicious-paths %q: expected off, basic or strict", suspiciousPaths)
+	}
+
+	if logIdleCloses && idleTimeout <= 0 {
+		consoleLogger.Fatal("-log-idle-closes requires -idle-timeout")
+	}
+
+	if len(routeTimeoutPairs) > 0 {
+		timeouts, err := parseRouteTimeouts(routeTimeoutPairs)
+		if err != nil {
+			consoleLogger.Fatal("Error parsing -route-timeout: ", err)
+		}
+		routeTimeouts = timeouts
+	}
+
+	if syslogAddr != "" {
+		writer, err := newSyslogWriter(syslogAddr, syslogFacility)
+		if err != nil {
+			consoleLogger.Fatal("Error connecting to syslog server: ", err)
+		}
+		syslogLogger = log.New(writer, "", 0)
+	} else if syslogOnly {
+		consoleLogger.Fatal("-syslog-only requires -syslog")
+	}
+
+	if analyticsOnly {
+		switch {
+		case analyticsURL == "":
+			consoleLogger.Fatal("-analytics-only requires -analytics-url")
+		case dedupWindow > 0, webhookURL != "", pageMetricsInterval > 0, confirmWindow > 0, trendsEnabled, pushgatewayURL != "":
+			consoleLogger.Fatal("-analytics-only cannot be combined with -dedup-window, -webhook-url, -page-metrics-interval, -confirm-window, -trends or -pushgateway-url, which need Redis")
+		}
+	}
+	if pushgatewayURL != "" && noCount {
+		consoleLogger.Fatal("-pushgateway-url cannot be combined with -no-count")
+	}
+	if grpcPort != "" && (noCount || analyticsOnly) {
+		consoleLogger.Fatal("-grpc-port cannot be combined with -no-count or -analytics-only, the gRPC service reads counts from Redis")
+	}
+	if analyticsURL != "" {
+		startAnalyticsForwarder(analyticsQueueSize)
+	}
+
+	// 禁用计数或只转发事件时完全不连接 Redis
+	if !noCount && !analyticsOnly {
+		redisClient = redis.NewClient(&redis.Options{
+			Addr:     redisAddr,
+			Password: redisPassword,
+			DB:       redisDB,
+		})
+		if redisSlowThreshold > 0 {
+			redisClient.AddHook(slowRedisHook{threshold: redisSlowThreshold})
+		}
+		if debugMode {
+			redisClient.AddHook(debugRedisHook{})
+		}
+	}
+
+	if featureFlagsFile != "" {
+		if err := loadFeatureFlags(); err != nil {
+			consoleLogger.Fatal("Error loading feature flags: ", err)
+		}
+		handleRoute("/flags", http.HandlerFunc(flagsHandler))
+	}
+	watchReloadSignal()
+
+	if listingTemplateFile != "" {
+		tmpl, err := template.ParseFiles(listingTemplateFile)
+		if err != nil {
+			consoleLogger.Fatal("Error parsing listing template: ", err)
+		}
+		listingTemplate = tmpl
+	}
+
+	if markdownTemplateFile != "" {
+		tmpl, err := template.ParseFiles(markdownTemplateFile)
+		if err != nil {
+			consoleLogger.Fatal("Error parsing markdown template: ", err)
+		}
+		markdownTemplate = tmpl
+	}
+
+	if adminToken != "" {
+		handleRoute("/admin/rotate-logs", requireAdmin(rotateLogsHandler), "requireAdmin")
+		handleRoute("/admin/lame-duck", requireAdmin(lameDuckHandler), "requireAdmin")
+		handleRoute("/admin/status", requireAdmin(statusPageHandler), "requireAdmin")
+		if redisClient != nil {
+			handleRoute("/admin/time", requireAdmin(timeSkewHandler), "requireAdmin")
+		}
+	}
+
+	handleRoute("/api", http.HandlerFunc(apiHandler))
+	handleRoute("/readyz", http.HandlerFunc(readyzHandler))
+	handleRoute("/metrics", http.HandlerFunc(metricsHandler))
+	if !noCount {
+		handleRoute("/count", requireWarmedUp(http.HandlerFunc(countHandler)), "requireWarmedUp")
+		handleRoute("/count.gif", requireWarmedUp(http.HandlerFunc(countGIFHandler)), "requireWarmedUp")
+		if confirmWindow > 0 {
+			handleRoute("/count/confirm", requireWarmedUp(http.HandlerFunc(confirmHandler)), "requireWarmedUp")
+		}
+	}
+	if noStatic {
+		switch {
+		case noCount:
+			consoleLogger.Fatal("-no-static cannot be combined with -no-count, nothing would be served")
+		case sitemapEnabled, directoryIndexPath != "", len(vhostPairs) > 0:
+			consoleLogger.Fatal("-no-static cannot be combined with -sitemap, -index-json or -vhost, which serve static files")
+		}
+		handleRoute("/", http.HandlerFunc(apiRootHandler), "logRequest")
+	} else {
+		// 设置文件服务器，使用绝对路径，目录被删除后重新创建时仍能找到它
+		staticRoot, err := filepath.Abs(rootDir)
+		if err != nil {
+			consoleLogger.Fatal("Error resolving static root: ", err)
+		}
+		if sitemapEnabled {
+			handleRoute("/sitemap.xml", sitemapHandler(staticRoot), "logRequest")
+		}
+		if directoryIndexPath != "" {
+			if !strings.HasPrefix(directoryIndexPath, "/") {
+				consoleLogger.Fatalf("Invalid -index-json %q: the path must start with /", directoryIndexPath)
+			}
+			directoryIndexRoot = staticRoot
+			if err := refreshDirectoryIndex(); err != nil {
+				consoleLogger.Fatal("Error generating directory index: ", err)
+			}
+			if directoryIndexInterval > 0 {
+				startDirectoryIndexRefresher()
+			}
+			handleRoute(directoryIndexPath, http.HandlerFunc(directoryIndexHandler), "logRequest")
+		}
+		defaultStatic := staticOptions{indexRedirect: indexRedirect, listingTemplate: listingTemplate}
+		var staticHandler http.Handler = newStaticHandler(staticRoot, defaultStatic)
+		staticNames := staticMiddlewareNames(defaultStatic)
+		if len(vhostPairs) > 0 {
+			hosts := make(map[string]http.Handler, len(vhostPairs))
+			for _, kv := range vhostPairs {
+				root, opts, err := parseVhost(kv.Value, defaultStatic)
+				if err != nil {
+					consoleLogger.Fatalf("Error parsing -vhost %s: %v", kv.Key, err)
+				}
+				hosts[strings.ToLower(kv.Key)] = newStaticHandler(root, opts)
+				consoleLogger.Printf("Serving %s from %s\n", kv.Key, root)
+			}
+			staticHandler = selectVhost(hosts, staticHandler)
+			staticNames = append([]string{"selectVhost"}, staticNames...)
+		}
+		if staticRequireReady {
+			staticHandler = requireReady(staticHandler)
+			staticNames = append([]string{"requireReady"}, staticNames...)
+		}
+		handleRoute("/", staticHandler, append([]string{"logRequest"}, staticNames...)...)
+	}
+
+	// 超时只能配置在已注册的路由上，拼写错误不应被静默忽略
+	for pattern := range routeTimeouts {
+		found := false
+		for _, route := range routes {
+			if route.Pattern == pattern {
+				found = true
+				break
+			}
+		}
+		if !found {
+			consoleLogger.Fatal("Error parsing -route-timeout: unknown route ", pattern)
+		}
+	}
+
+	var handler http.Handler = limitPathLength(limitBodySize(withRequestID(injectContext(delayRequests(http.DefaultServeMux)))))
+	globalMiddlewares := []string{"limitPathLength", "limitBodySize", "withRequestID", "injectContext", "delayRequests"}
+	if maxInFlight > 0 {
+		inFlightSlots = make(chan struct{}, maxInFlight)
+		handler = limitInFlight(handler)
+		globalMiddlewares = append([]string{"limitInFlight"}, globalMiddlewares...)
+	}
+	if maxConnsPerIP > 0 {
+		handler = limitConcurrencyPerIP(handler)
+		globalMiddlewares = append([]string{"limitConcurrencyPerIP"}, globalMiddlewares...)
+	}
+	if suspiciousPaths != "off" {
+		handler = rejectSuspiciousPaths(handler)
+		globalMiddlewares = append([]string{"rejectSuspiciousPaths"}, globalMiddlewares...)
+	}
+	if requireHost {
+		handler = requireHostHeader(handler)
+		globalMiddlewares = append([]string{"requireHostHeader"}, globalMiddlewares...)
+	}
+	if noSniff {
+		handler = noSniffHeader(handler)
+		globalMiddlewares = append([]string{"noSniffHeader"}, globalMiddlewares...)
+	}
+	// trackStats 在最外层，被限流或拒绝的请求也计入 /metrics、状态页和关闭时的汇总
+	handler = trackStats(handler)
+	globalMiddlewares = append([]string{"trackStats"}, globalMiddlewares...)
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: handler,
+	}
+	servers := []*http.Server{server}
+
+	var tlsServer *http.Server
+	var reloader *certReloader
+	if tlsPort != "" {
+		if certFile == "" || keyFile == "" {
+			consoleLogger.Fatal("-tls-port requires both -cert and -key")
+		}
+		var err error
+		reloader, err = newCertReloader(certFile, keyFile)
+		if err != nil {
+			consoleLogger.Fatal("Error loading TLS certificate: ", err)
+		}
+		if err := reloader.watch(); err != nil {
+			consoleLogger.Fatal("Error watching TLS certificate: ", err)
+		}
+		tlsConfig := &tls.Config{GetCertificate: reloader.GetCertificate}
+		authType, ok := clientAuthModes[clientAuth]
+		if !ok {
+			consoleLogger.Fatalf("Invalid -client-auth %q: expected none, request or require-and-verify", clientAuth)
+		}
+		tlsConfig.ClientAuth = authType
+		if clientCAFile != "" {
+			pool, err := loadClientCAs(clientCAFile)
+			if err != nil {
+				consoleLogger.Fatal("Error loading client CA bundle: ", err)
+			}
+			tlsConfig.ClientCAs = pool
+		} else if authType == tls.RequireAndVerifyClientCert {
+			consoleLogger.Fatal("-client-auth require-and-verify requires -client-ca")
+		}
+		tlsServer = &http.Server{
+			Addr:      ":" + tlsPort,
+			Handler:   handler,
+			TLSConfig: tlsConfig,
+		}
+		servers = append(servers, tlsServer)
+	}
+
+	for _, srv := range servers {
+		srv.IdleTimeout = idleTimeout
+		srv.ConnState = trackConnState
+	}
+
+	if printRoutesFlag || dryRun {
+		printRoutes(globalMiddlewares)
+	}
+	if dryRun {
+		if redisClient != nil {
+			connectRedis()
+		}
+		consoleLogger.Println("Dry run, exiting")
+		return
+	}
+
+	consoleLogger.Printf(colorGreen+"Starting server on :%s\n"+colorReset, port)
+	if noCount {
+		consoleLogger.Println("Page counting is disabled (-no-count), Redis is not used")
+	} else if analyticsOnly {
+		consoleLogger.Println("Hits are forwarded to " + analyticsURL + " only (-analytics-only), Redis is not used")
+	}
+	if slowStartWindow > 0 {
+		consoleLogger.Printf("Slow start: ramping up to %d concurrent connections over %s\n", slowStartConns, slowStartWindow)
+	}
+	// 预热期间收到的终止信号在预热完成后处理
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, shutdownSignals...)
+
+	// 先绑定所有监听器，预热期间 /readyz 已经可以返回 503
+	ln, err := listen(server)
+	if err != nil {
 		consoleLogger.Fatal("Error starting server: ", err)
 	}
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			consoleLogger.Fatal("Error starting server: ", err)
+		}
+	}()
+	if tlsServer != nil {
+		consoleLogger.Printf(colorGreen+"Starting TLS server on :%s\n"+colorReset, tlsPort)
+		tlsLn, err := listen(tlsServer)
+		if err != nil {
+			consoleLogger.Fatal("Error starting TLS server: ", err)
+		}
+		// 证书更新后客户端可能集中重新连接，同样逐步放行
+		if l, ok := tlsLn.(*slowStartListener); ok {
+			reloader.setOnReload(l.restart)
+		}
+		go func() {
+			if err := tlsServer.ServeTLS(tlsLn, "", ""); err != nil && err != http.ErrServerClosed {
+				consoleLogger.Fatal("Error starting TLS server: ", err)
+			}
+		}()
+	}
+	var grpcServer *grpc.Server
+	if grpcPort != "" {
+		consoleLogger.Printf(colorGreen+"Starting gRPC server on :%s\n"+colorReset, grpcPort)
+		grpcLn, err := net.Listen("tcp", ":"+grpcPort)
+		if err != nil {
+			consoleLogger.Fatal("Error starting gRPC server: ", err)
+		}
+		grpcServer = newGRPCServer()
+		go func() {
+			if err := grpcServer.Serve(grpcLn); err != nil {
+				consoleLogger.Fatal("Error starting gRPC server: ", err)
+			}
+		}()
+	}
+	warmUp()
+
+	// 等待终止信号后优雅关闭，处理完进行中的请求
+	sig := <-stop
+	consoleLogger.Printf("Received %s\n", sig)
+
+	enterPreShutdown(preShutdownDelay)
+
+	consoleLogger.Println("Shutting down server...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// 所有监听器并行关闭，共享同一个超时
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				consoleLogger.Printf(colorRed+"Error during shutdown of %s: %v\n"+colorReset, srv.Addr, err)
+			}
+		}(srv)
+	}
+	// gRPC 服务器等待进行中的调用完成，超时后强制关闭
+	if grpcServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopped := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-shutdownCtx.Done():
+				consoleLogger.Printf(colorRed+"Error during shutdown of :%s: %v\n"+colorReset, grpcPort, shutdownCtx.Err())
+				grpcServer.Stop()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 写入批量累计但尚未写入的增量，避免丢失计数
+	if countBatchInterval > 0 && redisClient != nil {
+		flushCountBatch()
+	}
+	// 在批量增量写入之后推送，Pushgateway 中保留的是最终的计数
+	if pushgatewayURL != "" && redisClient != nil {
+		pushPageCountsWithRetry()
+	}
 
+	writeShutdownSummary(summaryFile)
 }
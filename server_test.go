@@ -0,0 +1,5214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"image/gif"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestRegularFilesOnlyServesRegularFiles(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler := regularFilesOnly(root, http.FileServer(http.Dir(root)))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/hello.txt", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Fatalf("got %d %q, want 200 \"hello\"", rec.Code, rec.Body.String())
+	}
+
+	// 不存在的文件仍由 http.FileServer 返回 404
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/missing.txt", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("missing file: status %d, want 404", rec.Code)
+	}
+}
+
+func TestSyslogReceivesAccessLog(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	writer, err := newSyslogWriter("udp://"+pc.LocalAddr().String(), "local0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldLogger := syslogLogger
+	syslogLogger = log.New(writer, "", 0)
+	defer func() { syslogLogger = oldLogger }()
+
+	handler := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hello", nil))
+
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no syslog message received: %v", err)
+	}
+	msg := string(buf[:n])
+	// local0 (16) * 8 + info (6)
+	if !strings.HasPrefix(msg, "<134>") {
+		t.Errorf("message %q does not start with the local0.info priority", msg)
+	}
+	if !strings.Contains(msg, "192.0.2.1 [GET] /hello 200 ") {
+		t.Errorf("message %q does not contain the access log line", msg)
+	}
+}
+
+func TestSyslogOnlySkipsFileLog(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	writer, err := newSyslogWriter("udp://"+pc.LocalAddr().String(), "local0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldLogger, oldOnly := syslogLogger, syslogOnly
+	syslogLogger, syslogOnly = log.New(writer, "", 0), true
+	defer func() { syslogLogger, syslogOnly = oldLogger, oldOnly }()
+	logs := captureFileLog(t)
+
+	handler := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hello", nil))
+
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no syslog message received: %v", err)
+	}
+	if msg := string(buf[:n]); !strings.Contains(msg, "[GET] /hello 200 ") {
+		t.Errorf("message %q does not contain the access log line", msg)
+	}
+	if logs.String() != "" {
+		t.Errorf("access log written to the file with -syslog-only: %q", logs.String())
+	}
+
+	out, err := runMain(t, "-dry-run", "-no-count", "-root", t.TempDir(), "-syslog-only")
+	if err == nil || !strings.Contains(out, "-syslog-only requires -syslog") {
+		t.Fatalf("-syslog-only without -syslog was not rejected: %v\n%s", err, out)
+	}
+}
+
+func TestSyslogWriterReconnectsInBackground(t *testing.T) {
+	oldRetry := syslogRetryMin
+	syslogRetryMin = 20 * time.Millisecond
+	defer func() { syslogRetryMin = oldRetry }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	writer, err := newSyslogWriter("tcp://"+addr, "local0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	ln.Close()
+
+	// 对端关闭后的第一次写入可能仍然成功，之后的写入会失败并开始后台重连
+	failed := false
+	for i := 0; i < 50 && !failed; i++ {
+		_, err = writer.Write([]byte("lost\n"))
+		failed = err != nil
+		time.Sleep(time.Millisecond)
+	}
+	if !failed {
+		t.Fatal("writes to a closed syslog connection never failed")
+	}
+	// 重连期间直接丢弃，不在调用方的 goroutine 中拨号
+	if _, err := writer.Write([]byte("dropped\n")); err != errSyslogUnavailable {
+		t.Fatalf("write while reconnecting: err = %v, want errSyslogUnavailable", err)
+	}
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s again: %v", addr, err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+	}()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, err := writer.Write([]byte("back\n")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("syslog writer did not reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case line := <-received:
+		if !strings.HasSuffix(line, ": back\n") {
+			t.Fatalf("received %q after reconnecting", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing received after reconnecting")
+	}
+}
+
+// 替换功能开关文件并恢复原来的全局状态
+func useFlagsFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "flags.json")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldFile, oldFlags := featureFlagsFile, featureFlags
+	t.Cleanup(func() { featureFlagsFile, featureFlags = oldFile, oldFlags })
+	featureFlagsFile = file
+	if err := loadFeatureFlags(); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func getFlags(t *testing.T) map[string]interface{} {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	flagsHandler(rec, httptest.NewRequest("GET", "/flags", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /flags: status %d", rec.Code)
+	}
+	var flags map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &flags); err != nil {
+		t.Fatalf("GET /flags: %v in %q", err, rec.Body.String())
+	}
+	return flags
+}
+
+func TestFlagsEndpointReflectsReloadedFile(t *testing.T) {
+	file := useFlagsFile(t, `{"newHeader": true}`)
+	if flags := getFlags(t); flags["newHeader"] != true || len(flags) != 1 {
+		t.Fatalf("before reload: %v", flags)
+	}
+
+	if err := os.WriteFile(file, []byte(`{"newHeader": false, "theme": "dark"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadFeatureFlags(); err != nil {
+		t.Fatal(err)
+	}
+	if flags := getFlags(t); flags["newHeader"] != false || flags["theme"] != "dark" {
+		t.Fatalf("after reload: %v", flags)
+	}
+
+	// 无法解析的文件不会替换当前的功能开关
+	if err := os.WriteFile(file, []byte(`{"theme":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadFeatureFlags(); err == nil {
+		t.Fatal("loading an invalid flags file succeeded")
+	}
+	if flags := getFlags(t); flags["theme"] != "dark" {
+		t.Fatalf("after a failed reload: %v", flags)
+	}
+}
+
+// 写入时阻塞的 ResponseWriter，模拟读取很慢的客户端
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (bw *blockingWriter) Write(b []byte) (int, error) {
+	close(bw.writing)
+	<-bw.release
+	return bw.ResponseRecorder.Write(b)
+}
+
+func TestFlagsSlowClientDoesNotBlockReload(t *testing.T) {
+	useFlagsFile(t, `{"a": 1}`)
+	bw := &blockingWriter{httptest.NewRecorder(), make(chan struct{}), make(chan struct{})}
+	defer close(bw.release)
+	go flagsHandler(bw, httptest.NewRequest("GET", "/flags", nil))
+	<-bw.writing
+
+	reloaded := make(chan error, 1)
+	go func() { reloaded <- loadFeatureFlags() }()
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reload blocked while a client was still reading /flags")
+	}
+}
+
+func TestShutdownSummaryCountsRequests(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "hello") })
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/ok", http.StatusFound) })
+	mux.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) })
+	srv := httptest.NewServer(trackStats(mux))
+	defer srv.Close()
+
+	// 计数器是进程级的，其他测试也会增加它们，因此只比较差值
+	before := buildShutdownSummary()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for _, path := range []string{"/ok", "/ok", "/moved", "/missing", "/fail"} {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	file := filepath.Join(t.TempDir(), "summary.json")
+	writeShutdownSummary(file)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var after ShutdownSummary
+	if err := json.Unmarshal(data, &after); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := after.Requests - before.Requests; got != 5 {
+		t.Errorf("requests: got %d more, want 5", got)
+	}
+	if got := after.BytesSent - before.BytesSent; got < int64(2*len("hello")) {
+		t.Errorf("bytes_sent: got %d more, want at least %d", got, 2*len("hello"))
+	}
+	want := map[string]int64{"2xx": 2, "3xx": 1, "4xx": 1, "5xx": 1}
+	for class, n := range want {
+		if got := after.StatusClasses[class] - before.StatusClasses[class]; got != n {
+			t.Errorf("%s: got %d more, want %d", class, got, n)
+		}
+	}
+	if after.UptimeSeconds <= 0 {
+		t.Errorf("uptime_seconds = %v", after.UptimeSeconds)
+	}
+}
+
+// 测试用的最小 Redis 服务器，只实现服务器用到的命令，足以在没有真实 Redis 时覆盖计数逻辑
+type fakeRedis struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	data     map[string]string
+	expires  map[string]time.Time
+	commands []string                 // 收到的命令（大写），用于断言往返次数
+	clock    time.Duration            // TIME 命令返回的时间相对本机时间的偏差
+	delays   map[string]time.Duration // 按命令（大写）延迟回复，模拟慢的 Redis
+	authErr  string                   // 非空时所有命令都返回该错误，模拟密码错误或缺失
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	return startFakeRedisAt(t, "127.0.0.1:0")
+}
+
+// 在指定地址启动 fakeRedis，用于模拟稍后才启动的 Redis
+func startFakeRedisAt(t *testing.T, addr string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{ln: ln, data: make(map[string]string), expires: make(map[string]time.Time)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return fr
+}
+
+// 让全局 redisClient 指向 fr，测试结束后恢复
+func useFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	fr := startFakeRedis(t)
+	oldClient := redisClient
+	redisClient = redis.NewClient(&redis.Options{Addr: fr.ln.Addr().String(), MaxRetries: -1})
+	t.Cleanup(func() {
+		redisClient.Close()
+		redisClient = oldClient
+	})
+	return fr
+}
+
+func (fr *fakeRedis) get(key string) (string, bool) {
+	if at, ok := fr.expires[key]; ok && !time.Now().Before(at) {
+		delete(fr.data, key)
+		delete(fr.expires, key)
+	}
+	value, ok := fr.data[key]
+	return value, ok
+}
+
+// 返回收到某个命令的次数
+func (fr *fakeRedis) count(command string) int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	n := 0
+	for _, c := range fr.commands {
+		if c == command {
+			n++
+		}
+	}
+	return n
+}
+
+func (fr *fakeRedis) value(key string) string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	value, _ := fr.get(key)
+	return value
+}
+
+func (fr *fakeRedis) delay(command string, d time.Duration) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.delays == nil {
+		fr.delays = make(map[string]time.Duration)
+	}
+	fr.delays[command] = d
+}
+
+func (fr *fakeRedis) set(key, value string) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.data[key] = value
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readRESPCommand(reader)
+		if err != nil {
+			return
+		}
+		reply := fr.execute(args)
+		fr.mu.Lock()
+		d := fr.delays[strings.ToUpper(args[0])]
+		fr.mu.Unlock()
+		time.Sleep(d)
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func respBulk(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+
+func respInt(n int64) string { return fmt.Sprintf(":%d\r\n", n) }
+
+const respNil = "$-1\r\n"
+
+func (fr *fakeRedis) execute(args []string) string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	command := strings.ToUpper(args[0])
+	fr.commands = append(fr.commands, command)
+	if fr.authErr != "" {
+		return "-" + fr.authErr + "\r\n"
+	}
+
+	switch command {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT", "AUTH":
+		return "+OK\r\n"
+	case "GET":
+		if value, ok := fr.get(args[1]); ok {
+			return respBulk(value)
+		}
+		return respNil
+	case "MGET":
+		reply := fmt.Sprintf("*%d\r\n", len(args)-1)
+		for _, key := range args[1:] {
+			if value, ok := fr.get(key); ok {
+				reply += respBulk(value)
+			} else {
+				reply += respNil
+			}
+		}
+		return reply
+	case "SET", "SETNX":
+		key, value := args[1], args[2]
+		_, exists := fr.get(key)
+		var ttl time.Duration
+		nx, xx := command == "SETNX", false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "XX":
+				xx = true
+			case "EX", "PX":
+				n, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(n) * time.Second
+				if strings.ToUpper(args[i]) == "PX" {
+					ttl = time.Duration(n) * time.Millisecond
+				}
+				i++
+			}
+		}
+		if (nx && exists) || (xx && !exists) {
+			if command == "SETNX" {
+				return respInt(0)
+			}
+			return respNil
+		}
+		fr.data[key] = value
+		delete(fr.expires, key)
+		if ttl > 0 {
+			fr.expires[key] = time.Now().Add(ttl)
+		}
+		if command == "SETNX" {
+			return respInt(1)
+		}
+		return "+OK\r\n"
+	case "INCR", "INCRBY":
+		by := int64(1)
+		if command == "INCRBY" {
+			by, _ = strconv.ParseInt(args[2], 10, 64)
+		}
+		value, _ := fr.get(args[1])
+		n, err := strconv.ParseInt(value, 10, 64)
+		if value != "" && err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		if (by > 0 && n > math.MaxInt64-by) || (by < 0 && n < math.MinInt64-by) {
+			return "-ERR increment or decrement would overflow\r\n"
+		}
+		fr.data[args[1]] = strconv.FormatInt(n+by, 10)
+		return respInt(n + by)
+	case "DEL":
+		deleted := int64(0)
+		for _, key := range args[1:] {
+			if _, ok := fr.get(key); ok {
+				delete(fr.data, key)
+				delete(fr.expires, key)
+				deleted++
+			}
+		}
+		return respInt(deleted)
+	case "EXPIRE":
+		if _, ok := fr.get(args[1]); !ok {
+			return respInt(0)
+		}
+		seconds, _ := strconv.Atoi(args[2])
+		fr.expires[args[1]] = time.Now().Add(time.Duration(seconds) * time.Second)
+		return respInt(1)
+	case "SCAN":
+		// 一次返回全部匹配的键，游标始终为 0
+		pattern := "*"
+		for i := 2; i+1 < len(args); i++ {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		var keys []string
+		for key := range fr.data {
+			if matched, _ := path.Match(pattern, key); matched {
+				if _, ok := fr.get(key); ok {
+					keys = append(keys, key)
+				}
+			}
+		}
+		sort.Strings(keys)
+		reply := fmt.Sprintf("*2\r\n%s*%d\r\n", respBulk("0"), len(keys))
+		for _, key := range keys {
+			reply += respBulk(key)
+		}
+		return reply
+	case "TIME":
+		now := time.Now().Add(fr.clock)
+		return "*2\r\n" + respBulk(strconv.FormatInt(now.Unix(), 10)) + respBulk(strconv.Itoa(now.Nanosecond()/1000))
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+func TestCountOptionsAndWriteMethodsDoNotIncrement(t *testing.T) {
+	fr := useFakeRedis(t)
+	srv := httptest.NewServer(http.HandlerFunc(countHandler))
+	defer srv.Close()
+
+	for _, method := range []string{"OPTIONS", "POST", "PUT", "DELETE"} {
+		req, _ := http.NewRequest(method, srv.URL+"/count?page=home", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		want := http.StatusMethodNotAllowed
+		if method == "OPTIONS" {
+			want = http.StatusNoContent
+		}
+		if resp.StatusCode != want {
+			t.Errorf("%s /count: status %d, want %d", method, resp.StatusCode, want)
+		}
+		if allow := resp.Header.Get("Allow"); allow != apiAllowedMethods {
+			t.Errorf("%s /count: Allow %q, want %q", method, allow, apiAllowedMethods)
+		}
+	}
+	if n := fr.count("INCR"); n != 0 {
+		t.Fatalf("rejected methods sent %d INCR commands to Redis", n)
+	}
+
+	resp, err := http.Get(srv.URL + "/count?page=home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || fr.value("page.count.home") != "1" {
+		t.Fatalf("GET /count: status %d, stored count %q", resp.StatusCode, fr.value("page.count.home"))
+	}
+}
+
+func TestCustomListingTemplate(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"docs/sub", "site"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{"docs/a<b>.txt": "12345", "site/index.html": "home"}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmpl := template.Must(template.New("listing").Parse(
+		`<h1>{{.Path}}</h1>{{range .Entries}}<a href="{{.URL}}">{{.Name}}</a> {{.Size}} {{.IsDir}};{{end}}`))
+	handler := customListing(root, tmpl, http.FileServer(http.Dir(root)))
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		// 条目名称按模板转义，URL 经过百分号编码
+		{"/docs/", 200, `<h1>/docs/</h1><a href="a%3Cb%3E.txt">a&lt;b&gt;.txt</a> 5 false;<a href="sub/">sub/</a> `},
+		// 有 index.html 的目录和普通文件仍由 http.FileServer 处理
+		{"/site/", 200, "home"},
+		{"/docs/a%3Cb%3E.txt", 200, "12345"},
+		{"/docs", 301, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.status || !strings.HasPrefix(rec.Body.String(), tt.body) {
+			t.Errorf("GET %s: got %d %q, want %d starting with %q", tt.path, rec.Code, rec.Body.String(), tt.status, tt.body)
+		}
+	}
+}
+
+func TestPreShutdownDelayFailsReadinessButKeepsServing(t *testing.T) {
+	oldReady := ready.Load()
+	defer ready.Store(oldReady)
+	ready.Store(true)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "hello") })
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	status := func(path string) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := status("/readyz"); code != http.StatusOK {
+		t.Fatalf("/readyz before the signal: %d", code)
+	}
+	done := make(chan struct{})
+	go func() {
+		enterPreShutdown(500 * time.Millisecond)
+		close(done)
+	}()
+	for ready.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if code := status("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz during the delay: %d, want 503", code)
+	}
+	if code := status("/hello"); code != http.StatusOK {
+		t.Errorf("/hello during the delay: %d, want 200", code)
+	}
+	select {
+	case <-done:
+		t.Fatal("pre-shutdown returned before the delay")
+	default:
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("pre-shutdown did not return after the delay")
+	}
+}
+
+func TestCountJSONPCallback(t *testing.T) {
+	fr := useFakeRedis(t)
+
+	tests := []struct {
+		callback    string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"render", 200, "application/javascript", `render({"page":"home","count":1});`},
+		{"app.counters.render", 200, "application/javascript", `app.counters.render({"page":"home","count":2});`},
+		{"alert(1)//", 400, "text/plain; charset=utf-8", "Invalid callback parameter\n"},
+		{"</script><script>x", 400, "text/plain; charset=utf-8", "Invalid callback parameter\n"},
+		{"1abc", 400, "text/plain; charset=utf-8", "Invalid callback parameter\n"},
+		{strings.Repeat("a", maxJSONPCallbackLength+1), 400, "text/plain; charset=utf-8", "Invalid callback parameter\n"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		countHandler(rec, httptest.NewRequest("GET", "/count?page=home&callback="+url.QueryEscape(tt.callback), nil))
+		if rec.Code != tt.status || rec.Header().Get("Content-Type") != tt.contentType || rec.Body.String() != tt.body {
+			t.Errorf("callback %q: got %d %q %q, want %d %q %q", tt.callback,
+				rec.Code, rec.Header().Get("Content-Type"), rec.Body.String(), tt.status, tt.contentType, tt.body)
+		}
+	}
+	// 被拒绝的回调不产生计数
+	if got := fr.value("page.count.home"); got != "2" {
+		t.Fatalf("stored count %q, want 2", got)
+	}
+}
+
+// 在临时目录中运行，日志轮转使用工作目录中的 server.log；测试结束后恢复工作目录和 fileLogger
+func chdirToLogDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	oldDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	logFile, err := os.OpenFile("server.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldOutput, oldLogFile, oldLogDate := fileLogger.Writer(), currentLogFile, lastLogDate
+	fileLogger.SetOutput(checkedLogWriter{logFile})
+	t.Cleanup(func() {
+		fileLogger.SetOutput(oldOutput)
+		currentLogFile, lastLogDate = oldLogFile, oldLogDate
+		logFile.Close()
+		os.Chdir(oldDir)
+	})
+	return dir
+}
+
+func TestRotateLogsEndpoint(t *testing.T) {
+	dir := chdirToLogDir(t)
+	oldToken, oldInterval := adminToken, rotateInterval
+	adminToken, rotateInterval = "secret", 24*time.Hour
+	defer func() { adminToken, rotateInterval = oldToken, oldInterval }()
+	fileLogger.Println("before rotation")
+
+	srv := httptest.NewServer(requireAdmin(rotateLogsHandler))
+	defer srv.Close()
+	post := func(method, token string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	if resp := post("POST", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong token: status %d, want 401", resp.StatusCode)
+	}
+	if resp := post("GET", "secret"); resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "POST" {
+		t.Fatalf("GET: status %d, Allow %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+
+	resp := post("POST", "secret")
+	var result RotateLogsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST: status %d, decode error %v", resp.StatusCode, err)
+	}
+	if result.Current != "server.log" || result.Archived == "" || strings.ContainsRune(result.Archived, os.PathSeparator) {
+		t.Fatalf("unexpected response %+v", result)
+	}
+
+	fileLogger.Println("after rotation")
+	archived, err := os.ReadFile(filepath.Join(dir, result.Archived))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := os.ReadFile(filepath.Join(dir, "server.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(archived), "before rotation") || strings.Contains(string(archived), "after rotation") {
+		t.Errorf("archive %s contains %q", result.Archived, archived)
+	}
+	if !strings.Contains(string(current), "after rotation") || strings.Contains(string(current), "before rotation") {
+		t.Errorf("server.log contains %q", current)
+	}
+}
+
+// 并发安全的日志缓冲区
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *logBuffer) Write(b []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(b)
+}
+
+func (lb *logBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.String()
+}
+
+// 捕获写入 server.log 的访问日志
+func captureFileLog(t *testing.T) *logBuffer {
+	t.Helper()
+	lb := &logBuffer{}
+	oldOutput := fileLogger.Writer()
+	fileLogger.SetOutput(lb)
+	t.Cleanup(func() { fileLogger.SetOutput(oldOutput) })
+	return lb
+}
+
+// 每次写入都失败的 io.Writer，模拟磁盘已满
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, syscall.ENOSPC
+}
+
+func TestLogWriteFailuresWarnThrottled(t *testing.T) {
+	oldOutput := fileLogger.Writer()
+	fileLogger.SetOutput(checkedLogWriter{failingWriter{}})
+	defer fileLogger.SetOutput(oldOutput)
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+	oldInterval, oldWarning := logWriteWarnInterval, lastLogWriteWarning
+	logWriteWarnInterval, lastLogWriteWarning = time.Hour, time.Time{}
+	defer func() { logWriteWarnInterval, lastLogWriteWarning = oldInterval, oldWarning }()
+
+	handler := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	before := logWriteErrors.Load()
+	for i := 0; i < 20; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+			t.Fatalf("request %d failed while the log file is full: %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	warnings := func() int { return strings.Count(console.String(), "Error writing to the log file") }
+	if n := warnings(); n != 1 {
+		t.Fatalf("%d warnings for 20 failed writes, want 1:\n%s", n, console.String())
+	}
+	if !strings.Contains(console.String(), "no space left on device") {
+		t.Fatalf("warning does not carry the write error:\n%s", console.String())
+	}
+	failed := logWriteErrors.Load() - before
+	if failed < 20 {
+		t.Fatalf("log_write_errors_total grew by %d, want at least 20", failed)
+	}
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := fmt.Sprintf("log_write_errors_total %d\n", logWriteErrors.Load()); !strings.Contains(rec.Body.String(), want) {
+		t.Fatalf("/metrics does not report %q", want)
+	}
+
+	// 警告间隔过后再警告一次
+	logWriteWarningsMutex.Lock()
+	lastLogWriteWarning = time.Now().Add(-2 * time.Hour)
+	logWriteWarningsMutex.Unlock()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if n := warnings(); n != 2 {
+		t.Fatalf("%d warnings after the interval, want 2", n)
+	}
+}
+
+func TestIfRangeWithRange(t *testing.T) {
+	root := t.TempDir()
+	name := filepath.Join(root, "video.bin")
+	if err := os.WriteFile(name, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	handler := logRequest(withETag(root, http.FileServer(http.Dir(root))))
+
+	// 先取得 ETag
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("HEAD", "/video.bin", nil))
+	etag := rec.Header().Get("ETag")
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("expected a strong ETag, got %q", etag)
+	}
+
+	tests := []struct {
+		name    string
+		ifRange string
+		status  int
+		body    string
+	}{
+		{"matching etag", etag, http.StatusPartialContent, "234"},
+		{"stale etag", `"0-0"`, http.StatusOK, "0123456789"},
+		{"matching date", modTime.Format(http.TimeFormat), http.StatusPartialContent, "234"},
+		{"older date", modTime.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK, "0123456789"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureFileLog(t)
+			req := httptest.NewRequest("GET", "/video.bin", nil)
+			req.Header.Set("Range", "bytes=2-4")
+			req.Header.Set("If-Range", tt.ifRange)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status || rec.Body.String() != tt.body {
+				t.Fatalf("got %d %q, want %d %q", rec.Code, rec.Body.String(), tt.status, tt.body)
+			}
+			// 访问日志记录实际发送的状态码和字节数（格式为 状态码 耗时 字节数）
+			line := strings.TrimSpace(logs.String())
+			if !strings.Contains(line, fmt.Sprintf("[GET] /video.bin %d ", tt.status)) || !strings.HasSuffix(line, fmt.Sprintf(" %d", len(tt.body))) {
+				t.Fatalf("access log %q does not record %d with %d bytes", line, tt.status, len(tt.body))
+			}
+		})
+	}
+}
+
+func TestContextValuesReachHandlerAndLog(t *testing.T) {
+	var values pairList
+	if err := values.Set("env=staging, deploy=abc123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := values.Set("broken"); err == nil {
+		t.Fatal("a pair without = was accepted")
+	}
+	oldValues, oldLog := contextValues, logContextValue
+	contextValues, logContextValue = values, true
+	defer func() { contextValues, logContextValue = oldValues, oldLog }()
+	logs := captureFileLog(t)
+
+	var seen string
+	handler := injectContext(logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = contextValue(r.Context(), "env") + "/" + contextValue(r.Context(), "deploy")
+	})))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if seen != "staging/abc123" {
+		t.Errorf("handler saw %q, want staging/abc123", seen)
+	}
+	if line := logs.String(); !strings.HasSuffix(line, " env=staging deploy=abc123\n") {
+		t.Errorf("access log %q does not end with the context values", line)
+	}
+}
+
+func TestMarkdownRendering(t *testing.T) {
+	root := t.TempDir()
+	name := filepath.Join(root, "guide.md")
+	writeMarkdown := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(markdownRenderer(root, http.FileServer(http.Dir(root))))
+	defer srv.Close()
+	get := func() (string, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/guide.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.Header.Get("Content-Type"), string(body)
+	}
+
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeMarkdown("# Install\n\nRun *make*.\n", first)
+	contentType, body := get()
+	if contentType != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type %q", contentType)
+	}
+	for _, want := range []string{"<title>guide.md</title>", "<h1>Install</h1>", "<p>Run <em>make</em>.</p>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("rendered page does not contain %q:\n%s", want, body)
+		}
+	}
+
+	// 修改时间不变时返回缓存的渲染结果，变化后重新渲染
+	writeMarkdown("# Changed\n", first)
+	if _, body := get(); !strings.Contains(body, "<h1>Install</h1>") {
+		t.Errorf("expected the cached page while the modtime is unchanged:\n%s", body)
+	}
+	writeMarkdown("# Changed\n", first.Add(time.Minute))
+	if _, body := get(); !strings.Contains(body, "<h1>Changed</h1>") {
+		t.Errorf("expected a re-rendered page after the modtime changed:\n%s", body)
+	}
+}
+
+func TestCountOverflowReturnsConflict(t *testing.T) {
+	fr := useFakeRedis(t)
+	fr.set("page.count.viral", strconv.FormatInt(math.MaxInt64-1, 10))
+
+	rec := httptest.NewRecorder()
+	countHandler(rec, httptest.NewRequest("GET", "/count?page=viral", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("last increment before the maximum: status %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	countHandler(rec, httptest.NewRequest("GET", "/count?page=viral", nil))
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "has reached the maximum value") {
+		t.Fatalf("increment past the maximum: got %d %q, want 409 with a descriptive message", rec.Code, rec.Body.String())
+	}
+	if got := fr.value("page.count.viral"); got != strconv.FormatInt(math.MaxInt64, 10) {
+		t.Fatalf("stored count %s, want it to stay at the maximum", got)
+	}
+}
+
+func TestDelayRequests(t *testing.T) {
+	delays, err := parsePathDelays(pairList{{"/slow", "150ms"}, {"/assets/", "100ms"}, {"/assets/big", "1s"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parsePathDelays(pairList{{"/x", "soon"}}); err == nil {
+		t.Fatal("an invalid duration was accepted")
+	}
+	oldDelays := pathDelays
+	pathDelays = delays
+	defer func() { pathDelays = oldDelays }()
+	handler := delayRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		path     string
+		min, max time.Duration
+	}{
+		{"/slow", 150 * time.Millisecond, 600 * time.Millisecond},
+		// 只使用第一个匹配的配置，重叠的前缀不会叠加延迟
+		{"/assets/big", 100 * time.Millisecond, 600 * time.Millisecond},
+		{"/slow/other", 0, 50 * time.Millisecond},
+		{"/", 0, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.path, nil))
+		if elapsed := time.Since(start); elapsed < tt.min || elapsed > tt.max {
+			t.Errorf("GET %s took %s, want between %s and %s", tt.path, elapsed, tt.min, tt.max)
+		}
+	}
+
+	// 客户端断开时提前结束等待
+	reqCtx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/assets/big", nil).WithContext(reqCtx))
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("cancelled request still waited %s", elapsed)
+	}
+}
+
+// 设置了该环境变量时，测试二进制文件以给定的参数运行 main，用于测试命令行行为
+const mainArgsEnv = "HTTPSERVER_TEST_MAIN_ARGS"
+
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv(mainArgsEnv); ok {
+		os.Args = append([]string{os.Args[0]}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// 在临时目录中以子进程运行 main，返回合并后的输出
+func runMain(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Dir = t.TempDir()
+	cmd.Env = append(os.Environ(), mainArgsEnv+"="+strings.Join(args, "\n"))
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestPrintRoutesDryRun(t *testing.T) {
+	fr := startFakeRedis(t)
+	root := t.TempDir()
+	out, err := runMain(t, "-dry-run", "-redis-addr", fr.ln.Addr().String(), "-root", root)
+	if err != nil {
+		t.Fatalf("-dry-run failed: %v\n%s", err, out)
+	}
+	for _, want := range []string{
+		"Route /count ",
+		"Route /                        trackStats -> ",
+		" -> delayRequests -> logRequest -> ",
+		"Dry run, exiting",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "Starting server") {
+		t.Errorf("-dry-run started the server:\n%s", out)
+	}
+}
+
+func TestLargeStaticDownloadStreams(t *testing.T) {
+	// 日志和统计中间件必须保留 io.ReaderFrom，http.ServeContent 才能直接使用 sendfile
+	probe := trackStats(logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(io.ReaderFrom); !ok {
+			t.Errorf("%T does not implement io.ReaderFrom", w)
+		}
+	})))
+	probe.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	const size = 256 << 20
+	root := t.TempDir()
+	file, err := os.Create(filepath.Join(root, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 稀疏文件，不占用实际的磁盘空间
+	if err := file.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	srv := httptest.NewServer(trackStats(logRequest(newStaticHandler(root, staticOptions{}))))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	n, err := io.Copy(io.Discard, resp.Body)
+	runtime.ReadMemStats(&after)
+	if err != nil || n != size {
+		t.Fatalf("downloaded %d bytes, err %v", n, err)
+	}
+	// 服务端和客户端都在本进程中，分配总量应远小于文件大小
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/16 {
+		t.Fatalf("allocated %d bytes while streaming a %d byte file", allocated, size)
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	fr := useFakeRedis(t)
+	oldWindow, oldReject := dedupWindow, dedupReject
+	dedupWindow = 100 * time.Millisecond
+	defer func() { dedupWindow, dedupReject = oldWindow, oldReject }()
+
+	hit := func(ip, page string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/count?page="+page, nil)
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		countHandler(rec, req)
+		return rec
+	}
+
+	// 同一 IP 并发刷新同一页面只计数一次
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hit("198.51.100.1", "home")
+		}()
+	}
+	wg.Wait()
+	if got := fr.value("page.count.home"); got != "1" {
+		t.Fatalf("concurrent hits from one IP: stored count %q, want 1", got)
+	}
+
+	rec := hit("198.51.100.1", "home")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Count-Suppressed") != "true" || !strings.Contains(rec.Body.String(), `"count":1`) {
+		t.Fatalf("repeat hit: got %d %q suppressed=%q", rec.Code, rec.Body.String(), rec.Header().Get("X-Count-Suppressed"))
+	}
+	// 其他 IP 和其他页面不受影响
+	hit("198.51.100.2", "home")
+	hit("198.51.100.1", "about")
+	if fr.value("page.count.home") != "2" || fr.value("page.count.about") != "1" {
+		t.Fatalf("counts home=%q about=%q, want 2 and 1", fr.value("page.count.home"), fr.value("page.count.about"))
+	}
+
+	dedupReject = true
+	if rec := hit("198.51.100.2", "home"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("repeat hit with -dedup-reject: status %d, want 429", rec.Code)
+	}
+
+	// 窗口过期后再次计数
+	time.Sleep(150 * time.Millisecond)
+	if rec := hit("198.51.100.1", "home"); rec.Code != http.StatusOK || rec.Header().Get("X-Count-Suppressed") != "" {
+		t.Fatalf("hit after the window: got %d suppressed=%q", rec.Code, rec.Header().Get("X-Count-Suppressed"))
+	}
+	if got := fr.value("page.count.home"); got != "3" {
+		t.Fatalf("stored count %q after the window, want 3", got)
+	}
+}
+
+func TestPushgatewayPush(t *testing.T) {
+	fr := useFakeRedis(t)
+	fr.set("page.count.home", "5")
+	fr.set("page.count.about", "7")
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+
+	type push struct {
+		method, path, contentType, body string
+	}
+	pushes := make(chan push, 8)
+	// 只让第一次推送失败
+	fail := make(chan struct{}, 1)
+	fail <- struct{}{}
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		pushes <- push{r.Method, r.URL.EscapedPath(), r.Header.Get("Content-Type"), string(body)}
+		select {
+		case <-fail:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		default:
+		}
+	}))
+	defer gateway.Close()
+	oldURL, oldJob, oldMax, oldCounts := pushgatewayURL, pushgatewayJob, pageMetricsMax, pageCounts
+	pushgatewayURL, pushgatewayJob, pageMetricsMax = gateway.URL+"/", "edge node", 100
+	defer func() { pushgatewayURL, pushgatewayJob, pageMetricsMax, pageCounts = oldURL, oldJob, oldMax, oldCounts }()
+
+	// 第一次推送失败，记录警告后重试成功
+	pushPageCountsWithRetry()
+	if n := len(pushes); n != 2 {
+		t.Fatalf("%d pushes, want a failed push and one retry", n)
+	}
+	if !strings.Contains(console.String(), "Error pushing page counts") || !strings.Contains(console.String(), "(1/3)") {
+		t.Fatalf("no retry warning:\n%s", console.String())
+	}
+	if strings.Contains(console.String(), "Error pushing page counts to") {
+		t.Fatalf("the successful retry was reported as a failure:\n%s", console.String())
+	}
+	<-pushes
+	got := <-pushes
+	if got.method != http.MethodPut || got.path != "/metrics/job/edge%20node" || !strings.HasPrefix(got.contentType, "text/plain") {
+		t.Fatalf("push %s %s (%s)", got.method, got.path, got.contentType)
+	}
+	for _, want := range []string{
+		"# TYPE page_view_count gauge\n",
+		`page_view_count{page="about"} 7` + "\n",
+		`page_view_count{page="home"} 5` + "\n",
+	} {
+		if !strings.Contains(got.body, want) {
+			t.Errorf("pushed body does not contain %q:\n%s", want, got.body)
+		}
+	}
+
+	// 每次推送重新读取计数
+	fr.set("page.count.home", "6")
+	if err := pushPageCounts(); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-pushes; !strings.Contains(got.body, `page_view_count{page="home"} 6`) {
+		t.Fatalf("second push did not read the new count:\n%s", got.body)
+	}
+}
+
+func TestPageCountMetrics(t *testing.T) {
+	useFakeRedis(t)
+	oldInterval, oldMax, oldCounts := pageMetricsInterval, pageMetricsMax, pageCounts
+	pageMetricsInterval, pageMetricsMax = time.Minute, 2
+	defer func() { pageMetricsInterval, pageMetricsMax, pageCounts = oldInterval, oldMax, oldCounts }()
+
+	for page, hits := range map[string]int{"home": 3, `say "hi"`: 2, "rare": 1} {
+		for i := 0; i < hits; i++ {
+			rec := httptest.NewRecorder()
+			countHandler(rec, httptest.NewRequest("GET", "/count?page="+url.QueryEscape(page), nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("count %s: status %d", page, rec.Code)
+			}
+		}
+	}
+	if err := refreshPageCounts(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE page_view_count gauge\n",
+		`page_view_count{page="home"} 3` + "\n",
+		`page_view_count{page="say \"hi\""} 2` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics does not contain %q", want)
+		}
+	}
+	// 超过 -page-metrics-max 的低计数页面不输出
+	if strings.Contains(body, `page="rare"`) {
+		t.Errorf("/metrics exports more than %d pages:\n%s", pageMetricsMax, body)
+	}
+}
+
+func TestMaxPathLength(t *testing.T) {
+	oldMax := maxPathLength
+	maxPathLength = 64
+	defer func() { maxPathLength = oldMax }()
+
+	reached := 0
+	srv := httptest.NewServer(limitPathLength(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+	})))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		length int
+		status int
+	}{
+		{64, http.StatusOK},
+		{65, http.StatusRequestURITooLong},
+		{10000, http.StatusRequestURITooLong},
+	} {
+		resp, err := http.Get(srv.URL + "/" + strings.Repeat("a", tt.length-1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("path of %d bytes: status %d, want %d", tt.length, resp.StatusCode, tt.status)
+		}
+	}
+	if reached != 1 {
+		t.Errorf("handler reached %d times, want only for the path within the limit", reached)
+	}
+}
+
+// 生成 127.0.0.1 的自签名证书（序列号随机），写入 dir 并返回证书和私钥文件
+func writeSelfSignedCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// 返回一个当前空闲的 TCP 端口
+func freePort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+// 以子进程启动服务器，测试结束时终止它；返回的缓冲区收集服务器的输出
+func startMain(t *testing.T, args ...string) (*exec.Cmd, *logBuffer) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Dir = t.TempDir()
+	cmd.Env = append(os.Environ(), mainArgsEnv+"="+strings.Join(args, "\n"))
+	out := &logBuffer{}
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("server output:\n%s", out.String())
+		}
+	})
+	return cmd, out
+}
+
+// 重试请求直到服务器开始监听
+func getWhenUp(t *testing.T, client *http.Client, url string) *http.Response {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := client.Get(url)
+		if err == nil {
+			return resp
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestHTTPAndHTTPSListeners(t *testing.T) {
+	certFile, keyFile := writeSelfSignedCert(t, t.TempDir())
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	port, tlsPort := freePort(t), freePort(t)
+	startMain(t, "-no-count", "-root", root, "-p", port, "-tls-port", tlsPort, "-cert", certFile, "-key", keyFile)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for _, tt := range []struct {
+		url     string
+		wantTLS bool
+	}{
+		{"http://127.0.0.1:" + port + "/", false},
+		{"https://127.0.0.1:" + tlsPort + "/", true},
+	} {
+		resp := getWhenUp(t, client, tt.url)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+			t.Errorf("GET %s: %d %q", tt.url, resp.StatusCode, body)
+		}
+		if (resp.TLS != nil) != tt.wantTLS {
+			t.Errorf("GET %s: TLS = %v, want %v", tt.url, resp.TLS != nil, tt.wantTLS)
+		}
+	}
+
+	// HTTPS 端口不接受明文 HTTP
+	resp, err := client.Get("http://127.0.0.1:" + tlsPort + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain HTTP to the TLS port: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	oldHeader, oldTraceparent := requestIDHeader, requestIDTraceparent
+	requestIDHeader, requestIDTraceparent = "X-Correlation-ID", true
+	defer func() { requestIDHeader, requestIDTraceparent = oldHeader, oldTraceparent }()
+
+	var seen string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+	}))
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string // 为空时应生成新的 ID
+	}{
+		{"custom header", map[string]string{"X-Correlation-ID": "abc-123"}, "abc-123"},
+		{"default header is ignored", map[string]string{"X-Request-ID": "abc-123"}, ""},
+		{"traceparent", map[string]string{"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01"}, traceID},
+		{"header wins over traceparent", map[string]string{"X-Correlation-ID": "abc-123", "traceparent": "00-" + traceID + "-00f067aa0ba902b7-01"}, "abc-123"},
+		{"all-zero trace-id", map[string]string{"traceparent": "00-" + strings.Repeat("0", 32) + "-00f067aa0ba902b7-01"}, ""},
+		{"log injection", map[string]string{"X-Correlation-ID": "abc\ninjected"}, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		for name, value := range tt.headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		echoed := rec.Header().Get("X-Correlation-ID")
+		if echoed != seen {
+			t.Errorf("%s: response header %q differs from the context value %q", tt.name, echoed, seen)
+		}
+		if tt.want != "" && echoed != tt.want {
+			t.Errorf("%s: request ID %q, want %q", tt.name, echoed, tt.want)
+		}
+		if tt.want == "" && (len(echoed) != 16 || echoed == "abc-123") {
+			t.Errorf("%s: request ID %q, want a generated one", tt.name, echoed)
+		}
+		if rec.Header().Get("X-Request-ID") != "" {
+			t.Errorf("%s: the default header was also set", tt.name)
+		}
+	}
+}
+
+func TestStaticRootRemovedAndRestored(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "site")
+	writeSite := func(content string) {
+		t.Helper()
+		if err := os.MkdirAll(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, "index.html"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeSite("v1")
+	srv := httptest.NewServer(newStaticHandler(root, staticOptions{}))
+	defer srv.Close()
+	get := func() (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if code, body := get(); code != http.StatusOK || body != "v1" {
+		t.Fatalf("before removal: %d %q", code, body)
+	}
+	if err := os.RemoveAll(root); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if code, _ := get(); code != http.StatusServiceUnavailable {
+			t.Fatalf("root removed: status %d, want 503", code)
+		}
+	}
+	// 以同一路径重新创建目录后恢复服务
+	writeSite("v2")
+	if code, body := get(); code != http.StatusOK || body != "v2" {
+		t.Fatalf("after restoring: %d %q", code, body)
+	}
+}
+
+func TestCountAsString(t *testing.T) {
+	oldMode := countAsString
+	defer func() { countAsString = oldMode }()
+
+	const big = maxSafeInteger + 2
+	tests := []struct {
+		mode  string
+		count int64
+		want  string
+	}{
+		{"never", big, `{"page":"p","count":9007199254740993}`},
+		{"unsafe", maxSafeInteger, `{"page":"p","count":9007199254740991}`},
+		{"unsafe", big, `{"page":"p","count":"9007199254740993"}`},
+		{"unsafe", -big, `{"page":"p","count":"-9007199254740993"}`},
+		{"always", 7, `{"page":"p","count":"7"}`},
+	}
+	for _, tt := range tests {
+		countAsString = tt.mode
+		data, err := json.Marshal(CountResponse{Page: "p", Count: tt.count})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s, %d: got %s, want %s", tt.mode, tt.count, data, tt.want)
+		}
+	}
+
+	// 通过 /count 返回时同样生效，Redis 中的计数不受影响
+	fr := useFakeRedis(t)
+	fr.set("page.count.p", strconv.FormatInt(big-1, 10))
+	countAsString = "unsafe"
+	rec := httptest.NewRecorder()
+	countHandler(rec, httptest.NewRequest("GET", "/count?page=p", nil))
+	if !strings.Contains(rec.Body.String(), `"count":"9007199254740993"`) {
+		t.Errorf("/count body %q does not encode the count as a string", rec.Body.String())
+	}
+}
+
+func TestTimeSkewEndpoint(t *testing.T) {
+	fr := useFakeRedis(t)
+	fr.mu.Lock()
+	fr.clock = 2 * time.Second
+	fr.mu.Unlock()
+	oldToken := adminToken
+	adminToken = "secret"
+	defer func() { adminToken = oldToken }()
+	handler := requireAdmin(timeSkewHandler)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/time", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("without the token: status %d, want 401", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/admin/time", nil)
+	req.Header.Set("X-Admin-Token", "secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var result TimeSkewResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %q, err %v", rec.Code, rec.Body.String(), err)
+	}
+	if result.ServerTime.IsZero() || result.RedisTime.IsZero() {
+		t.Fatalf("missing times in %+v", result)
+	}
+	// Redis TIME 精确到微秒，允许往返时间带来的误差
+	if result.SkewMs < 1900 || result.SkewMs > 2100 {
+		t.Errorf("skew_ms = %v, want about 2000", result.SkewMs)
+	}
+	if got := result.RedisTime.Sub(result.ServerTime); got < 1900*time.Millisecond || got > 2100*time.Millisecond {
+		t.Errorf("redis_time - server_time = %s, want about 2s", got)
+	}
+	if result.RTTMs < 0 {
+		t.Errorf("rtt_ms = %v", result.RTTMs)
+	}
+}
+
+func TestNegotiateContentType(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"text/plain", "text/plain"},
+		{"text/*", "text/plain"},
+		{"application/json;q=0.5, text/plain", "text/plain"},
+		{"text/plain;q=0.2, */*;q=0.8", "application/json"},
+		{"application/xml", ""},
+		{"application/json;q=0", ""},
+		{"*/*, application/json;q=0", "text/plain"},
+	}
+	for _, tt := range tests {
+		if got := negotiateContentType(tt.accept, countContentTypes); got != tt.want {
+			t.Errorf("Accept %q: got %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestCountStrictAccept(t *testing.T) {
+	fr := useFakeRedis(t)
+	oldStrict := strictAccept
+	defer func() { strictAccept = oldStrict }()
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/count?page=home", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		countHandler(rec, req)
+		return rec
+	}
+
+	// 默认回退为 JSON
+	if rec := get("application/xml"); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("XML-only Accept without -strict-accept: %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	strictAccept = true
+	if rec := get("application/xml"); rec.Code != http.StatusNotAcceptable {
+		t.Fatalf("XML-only Accept with -strict-accept: status %d, want 406", rec.Code)
+	}
+	if rec := get("text/plain"); rec.Code != http.StatusOK || rec.Body.String() != "2\n" {
+		t.Fatalf("text/plain: %d %q", rec.Code, rec.Body.String())
+	}
+	// 406 的请求不计数
+	if got := fr.value("page.count.home"); got != "2" {
+		t.Fatalf("stored count %q, want 2", got)
+	}
+}
+
+func TestPageAllowlist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pages.txt")
+	if err := os.WriteFile(file, []byte("# counted pages\nblog/first\n\n  about  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	allowlist, err := loadPageAllowlist("home, docs", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allowlist) != 4 || !allowlist["home"] || !allowlist["docs"] || !allowlist["blog/first"] || !allowlist["about"] {
+		t.Fatalf("allowlist = %v", allowlist)
+	}
+	if unset, err := loadPageAllowlist("", ""); unset != nil || err != nil {
+		t.Fatalf("no allowlist configured: got %v, %v", unset, err)
+	}
+
+	fr := useFakeRedis(t)
+	oldAllowlist := pageAllowlist
+	pageAllowlist = allowlist
+	defer func() { pageAllowlist = oldAllowlist }()
+	for _, tt := range []struct {
+		page   string
+		status int
+	}{
+		{"home", http.StatusOK},
+		{"blog/first", http.StatusOK},
+		{"admin", http.StatusNotFound},
+		{"# counted pages", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		countHandler(rec, httptest.NewRequest("GET", "/count?page="+url.QueryEscape(tt.page), nil))
+		if rec.Code != tt.status {
+			t.Errorf("page %q: status %d, want %d", tt.page, rec.Code, tt.status)
+		}
+	}
+	// 不在允许列表中的页面不创建 Redis 键
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if _, ok := fr.data["page.count.admin"]; ok || len(fr.data) != 2 {
+		t.Fatalf("Redis keys %v, want only the allowlisted pages", fr.data)
+	}
+}
+
+func TestCertReloaderPicksUpRenewedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSignedCert(t, dir)
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.watch(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan struct{}, 10)
+	reloader.setOnReload(func() { reloaded <- struct{}{} })
+
+	// httptest 的 TLS 服务器总是设置自己的证书，GetCertificate 不会被调用，因此直接使用 http.Server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		TLSConfig: &tls.Config{GetCertificate: reloader.GetCertificate},
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+	url := "https://" + ln.Addr().String()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+	servedSerial := func() string {
+		t.Helper()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].SerialNumber.String()
+	}
+	original := servedSerial()
+
+	// 无法加载的文件（例如只写入了一半）不替换当前的证书
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	if got := servedSerial(); got != original {
+		t.Fatalf("serving %s after an invalid update, want the original %s", got, original)
+	}
+	if len(reloaded) != 0 {
+		t.Fatal("reload callback ran after a failed reload")
+	}
+
+	// 像 Kubernetes secret 一样通过重命名替换文件
+	newDir := t.TempDir()
+	newCert, newKey := writeSelfSignedCert(t, newDir)
+	if err := os.Rename(newKey, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(newCert, certFile); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for servedSerial() == original {
+		if time.Now().After(deadline) {
+			t.Fatal("the renewed certificate was never served")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Fatal("reload callback did not run after the certificate was reloaded")
+	}
+}
+
+func TestThresholdWebhookRetriesFailedDelivery(t *testing.T) {
+	fr := useFakeRedis(t)
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+	events := make(chan ThresholdEvent, 10)
+	fail := make(chan struct{}, 1)
+	fail <- struct{}{}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event ThresholdEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		select {
+		case <-fail:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		default:
+		}
+		events <- event
+	}))
+	defer hook.Close()
+	oldURL, oldThresholds := webhookURL, webhookThresholds
+	webhookURL, webhookThresholds = hook.URL, []int64{3}
+	defer func() { webhookURL, webhookThresholds = oldURL, oldThresholds }()
+	webhookRetriesMutex.Lock()
+	oldRetries := webhookRetries
+	webhookRetries = make(map[webhookRetryKey]bool)
+	webhookRetriesMutex.Unlock()
+	defer func() {
+		webhookRetriesMutex.Lock()
+		webhookRetries = oldRetries
+		webhookRetriesMutex.Unlock()
+	}()
+
+	hit := func() {
+		countHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/count?page=post", nil))
+	}
+	for i := 0; i < 3; i++ {
+		hit()
+	}
+	// 第一次投递返回 503，标记被释放并等待重试
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(console.String(), "retrying on the next hit") {
+		if time.Now().After(deadline) {
+			t.Fatalf("the failed delivery was not reported:\n%s", console.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fr.value("page.webhook.post.3") != "" {
+		t.Fatal("the marker was kept after a failed delivery")
+	}
+
+	// 下一次计数重新发送，之后不再重复
+	hit()
+	select {
+	case event := <-events:
+		if event.Threshold != 3 || event.Count != 4 {
+			t.Fatalf("retried event %+v, want threshold 3 at count 4", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the threshold was not retried after the failed delivery")
+	}
+	hit()
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected extra event %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if fr.value("page.webhook.post.3") == "" {
+		t.Fatal("no marker after the successful delivery")
+	}
+}
+
+func TestThresholdWebhookFiresOnce(t *testing.T) {
+	fr := useFakeRedis(t)
+	events := make(chan ThresholdEvent, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event ThresholdEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("webhook payload: %v", err)
+		}
+		events <- event
+	}))
+	defer hook.Close()
+
+	thresholds, err := parseThresholds("5, 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldURL, oldThresholds := webhookURL, webhookThresholds
+	webhookURL, webhookThresholds = hook.URL, thresholds
+	defer func() { webhookURL, webhookThresholds = oldURL, oldThresholds }()
+
+	hit := func() {
+		rec := httptest.NewRecorder()
+		countHandler(rec, httptest.NewRequest("GET", "/count?page=post", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d", rec.Code)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		hit()
+	}
+	// 计数被重置后再次越过阈值也不会重复通知
+	fr.set("page.count.post", "2")
+	for i := 0; i < 4; i++ {
+		hit()
+	}
+
+	received := map[int64]ThresholdEvent{}
+	timeout := time.After(2 * time.Second)
+	for len(received) < 2 {
+		select {
+		case event := <-events:
+			if _, dup := received[event.Threshold]; dup {
+				t.Fatalf("threshold %d fired twice", event.Threshold)
+			}
+			received[event.Threshold] = event
+		case <-timeout:
+			t.Fatalf("received %v, want thresholds 3 and 5", received)
+		}
+	}
+	if e := received[3]; e.Page != "post" || e.Count != 3 || e.Timestamp.IsZero() {
+		t.Errorf("threshold 3 event: %+v", e)
+	}
+	if e := received[5]; e.Count != 5 {
+		t.Errorf("threshold 5 event: %+v", e)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected extra event %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLogRotationRetriesAreThrottled(t *testing.T) {
+	dir := chdirToLogDir(t)
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+	oldInterval, oldRetry, oldFailure := rotateInterval, rotateRetryInterval, lastRotateFailure
+	rotateInterval, rotateRetryInterval, lastRotateFailure = 24*time.Hour, time.Hour, time.Time{}
+	defer func() { rotateInterval, rotateRetryInterval, lastRotateFailure = oldInterval, oldRetry, oldFailure }()
+
+	// server.log 不存在时重命名失败，模拟持续失败的文件系统
+	if err := os.Remove(filepath.Join(dir, "server.log")); err != nil {
+		t.Fatal(err)
+	}
+	lastLogDate = currentLogPeriod().Add(-24 * time.Hour)
+	failures := func() int { return strings.Count(console.String(), "Error rotating log file") }
+
+	for i := 0; i < 50; i++ {
+		checkLogRotation()
+	}
+	if n := failures(); n != 1 {
+		t.Fatalf("%d rotation attempts during the retry interval, want 1", n)
+	}
+
+	// 重试间隔过后再试一次
+	logMutex.Lock()
+	lastRotateFailure = time.Now().Add(-2 * rotateRetryInterval)
+	logMutex.Unlock()
+	for i := 0; i < 50; i++ {
+		checkLogRotation()
+	}
+	if n := failures(); n != 2 {
+		t.Fatalf("%d rotation attempts after the retry interval, want 2", n)
+	}
+
+	// 文件系统恢复后，下一次重试成功并开始新的周期
+	if err := os.WriteFile(filepath.Join(dir, "server.log"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	logMutex.Lock()
+	lastRotateFailure = time.Time{}
+	logMutex.Unlock()
+	checkLogRotation()
+	if !lastLogDate.Equal(currentLogPeriod()) {
+		t.Fatalf("lastLogDate = %v after a successful rotation", lastLogDate)
+	}
+	if archives, _ := filepath.Glob(filepath.Join(dir, "server[0-9]*.log")); len(archives) != 1 {
+		t.Fatalf("archives %v after a successful rotation, want one", archives)
+	}
+	if n := failures(); n != 2 {
+		t.Fatalf("%d failures logged, want 2", n)
+	}
+}
+
+func TestHourlyRotationAtHourBoundary(t *testing.T) {
+	if interval, err := parseRotateInterval("hourly"); err != nil || interval != time.Hour {
+		t.Fatalf("parseRotateInterval(hourly) = %v, %v", interval, err)
+	}
+	if _, err := parseRotateInterval("weekly"); err == nil {
+		t.Fatal("parseRotateInterval accepted weekly")
+	}
+
+	dir := chdirToLogDir(t)
+	oldInterval, oldFailure := rotateInterval, lastRotateFailure
+	rotateInterval, lastRotateFailure = time.Hour, time.Time{}
+	defer func() { rotateInterval, lastRotateFailure = oldInterval, oldFailure }()
+
+	// 当前周期内不轮转
+	lastLogDate = currentLogPeriod()
+	fileLogger.Println("line from the previous hour")
+	checkLogRotation()
+	if archives, _ := filepath.Glob(filepath.Join(dir, "server-*.log")); len(archives) != 0 {
+		t.Fatalf("rotated within the current hour: %v", archives)
+	}
+
+	// 模拟时间越过整点：上一次轮转停留在前一个小时
+	previous := currentLogPeriod().Add(-time.Hour)
+	lastLogDate = previous
+	checkLogRotation()
+	archive := filepath.Join(dir, "server-"+previous.Format("2006-01-02-15")+".log")
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatalf("no hourly archive after crossing the hour: %v", err)
+	}
+	if !strings.Contains(string(data), "line from the previous hour") {
+		t.Fatalf("archive %s is missing the previous hour's lines: %q", archive, data)
+	}
+	if !lastLogDate.Equal(currentLogPeriod()) {
+		t.Fatalf("lastLogDate = %v after rotating, want %v", lastLogDate, currentLogPeriod())
+	}
+	fileLogger.Println("line from the new hour")
+	if data, _ := os.ReadFile(filepath.Join(dir, "server.log")); strings.Contains(string(data), "previous hour") || !strings.Contains(string(data), "new hour") {
+		t.Fatalf("server.log after rotating = %q", data)
+	}
+}
+
+func TestDirectoryIndexIsCachedUntilReload(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{"index.html": "<h1>hi</h1>", "docs/guide.txt": "guide", ".secret": "hidden"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldRoot, oldData, oldGenerated := directoryIndexRoot, directoryIndexData, directoryIndexGenerated
+	directoryIndexRoot = root
+	defer func() {
+		directoryIndexRoot, directoryIndexData, directoryIndexGenerated = oldRoot, oldData, oldGenerated
+	}()
+	if err := refreshDirectoryIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 把索引展开成 路径 -> 大小
+	paths := func() map[string]int64 {
+		rec := httptest.NewRecorder()
+		directoryIndexHandler(rec, httptest.NewRequest("GET", "/index.json", nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+		}
+		var index struct {
+			Entries []directoryIndexEntry `json:"entries"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &index); err != nil {
+			t.Fatalf("invalid index %q: %v", rec.Body, err)
+		}
+		found := map[string]int64{}
+		var walk func([]directoryIndexEntry)
+		walk = func(entries []directoryIndexEntry) {
+			for _, e := range entries {
+				found[e.Path] = e.Size
+				walk(e.Children)
+			}
+		}
+		walk(index.Entries)
+		return found
+	}
+
+	got := paths()
+	want := map[string]int64{"/index.html": 11, "/docs/": 0, "/docs/guide.txt": 5}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("index = %v, want %v", got, want)
+	}
+
+	// 目录变化后在重新生成之前继续返回缓存的索引
+	if err := os.WriteFile(filepath.Join(root, "docs", "new.txt"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := paths()["/docs/new.txt"]; ok {
+		t.Fatal("index changed before it was regenerated")
+	}
+
+	// 重新加载（SIGHUP 或 -index-json-interval）后反映新的目录内容
+	if err := refreshDirectoryIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if size, ok := paths()["/docs/new.txt"]; !ok || size != 3 {
+		t.Fatalf("index after reload = %v, want /docs/new.txt", paths())
+	}
+
+	// 重新生成失败时保留上一次的索引
+	directoryIndexRoot = filepath.Join(root, "missing")
+	if err := refreshDirectoryIndex(); err == nil {
+		t.Fatal("refreshing a missing root succeeded")
+	}
+	if _, ok := paths()["/docs/new.txt"]; !ok {
+		t.Fatal("a failed refresh discarded the cached index")
+	}
+}
+
+func TestNoSniffUsesExtensionTypes(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"data.unknownext": "<html><script>alert(1)</script>",
+		"noext":           "<html>",
+		"style.css":       "body{}",
+		"index.html":      "plain text, not html",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldNoSniff := noSniff
+	noSniff = true
+	defer func() { noSniff = oldNoSniff }()
+	handler := noSniffHeader(newStaticHandler(root, staticOptions{}))
+
+	for _, tt := range []struct {
+		path        string
+		contentType string
+	}{
+		// 内容看起来像 HTML 也不嗅探
+		{"/data.unknownext", "application/octet-stream"},
+		{"/noext", "application/octet-stream"},
+		{"/style.css", "text/css; charset=utf-8"},
+		{"/", "text/html; charset=utf-8"},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != tt.contentType {
+			t.Errorf("GET %s: %d %q, want 200 %q", tt.path, rec.Code, rec.Header().Get("Content-Type"), tt.contentType)
+		}
+		if rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("GET %s: missing X-Content-Type-Options: nosniff", tt.path)
+		}
+	}
+	// 错误响应同样带 nosniff
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/missing", nil))
+	if rec.Code != http.StatusNotFound || rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("GET /missing: %d nosniff=%q", rec.Code, rec.Header().Get("X-Content-Type-Options"))
+	}
+}
+
+// 每次最多写入 max 个字节且不返回错误的 ResponseWriter；总量达到 limit 后不再写入任何数据
+type shortWriter struct {
+	*httptest.ResponseRecorder
+	max, limit int
+	calls      int
+}
+
+func (sw *shortWriter) Write(b []byte) (int, error) {
+	sw.calls++
+	n := len(b)
+	if n > sw.max {
+		n = sw.max
+	}
+	if room := sw.limit - sw.Body.Len(); n > room {
+		n = room
+	}
+	return sw.ResponseRecorder.Write(b[:n])
+}
+
+func TestLoggingResponseWriterShortWrites(t *testing.T) {
+	sw := &shortWriter{ResponseRecorder: httptest.NewRecorder(), max: 3, limit: 1 << 20}
+	lrw := NewLoggingResponseWriter(sw)
+	n, err := lrw.Write([]byte("hello, world"))
+	if n != 12 || err != nil {
+		t.Fatalf("Write returned %d, %v; want 12, nil", n, err)
+	}
+	if sw.Body.String() != "hello, world" || lrw.length != 12 || sw.calls != 4 {
+		t.Fatalf("body %q, length %d after %d calls", sw.Body.String(), lrw.length, sw.calls)
+	}
+
+	// 底层写入器没有任何进展时返回 io.ErrShortWrite，而不是无限循环
+	sw = &shortWriter{ResponseRecorder: httptest.NewRecorder(), max: 3, limit: 5}
+	lrw = NewLoggingResponseWriter(sw)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err = lrw.Write([]byte("hello, world"))
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Write kept looping on a stalled writer")
+	}
+	if n != 5 || err != io.ErrShortWrite || lrw.length != 5 {
+		t.Fatalf("stalled writer: Write returned %d, %v with length %d; want 5, io.ErrShortWrite, 5", n, err, lrw.length)
+	}
+
+	// 访问日志记录实际写入的字节数
+	logs := captureFileLog(t)
+	handler := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello, world")
+	}))
+	handler.ServeHTTP(&shortWriter{ResponseRecorder: httptest.NewRecorder(), max: 3, limit: 1 << 20}, httptest.NewRequest("GET", "/", nil))
+	if line := logs.String(); !strings.HasSuffix(line, " 12\n") {
+		t.Fatalf("access log %q does not record 12 bytes", line)
+	}
+}
+
+func TestNoCountRunsWithoutRedis(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("static"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	// Redis 地址指向一个没有监听的端口，启用计数时启动会失败
+	_, out := startMain(t, "-no-count", "-root", root, "-p", port, "-redis-addr", "127.0.0.1:"+freePort(t))
+
+	base := "http://127.0.0.1:" + port
+	resp := getWhenUp(t, http.DefaultClient, base+"/")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "static" {
+		t.Fatalf("GET /: %d %q", resp.StatusCode, body)
+	}
+	for _, path := range []string{"/count?page=home", "/count.gif?page=home"} {
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", path, resp.StatusCode)
+		}
+	}
+	if !strings.Contains(out.String(), "Page counting is disabled (-no-count)") {
+		t.Errorf("startup output does not say counting is disabled:\n%s", out.String())
+	}
+}
+
+func TestIndexRedirectModes(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("home"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		redirect bool
+		path     string
+		status   int
+		location string
+		body     string
+	}{
+		{false, "/", http.StatusOK, "", "home"},
+		// 默认模式下 http.FileServer 把 /index.html 重定向到目录
+		{false, "/index.html", http.StatusMovedPermanently, "./", ""},
+		{true, "/", http.StatusMovedPermanently, "/index.html", ""},
+		{true, "/?lang=en", http.StatusMovedPermanently, "/index.html?lang=en", ""},
+		// 重定向模式下直接提供 /index.html，不会形成重定向循环
+		{true, "/index.html", http.StatusOK, "", "home"},
+	}
+	for _, tt := range tests {
+		handler := newStaticHandler(root, staticOptions{indexRedirect: tt.redirect})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.status || rec.Header().Get("Location") != tt.location || (tt.body != "" && rec.Body.String() != tt.body) {
+			t.Errorf("redirect=%v GET %s: got %d Location %q body %q", tt.redirect, tt.path, rec.Code, rec.Header().Get("Location"), rec.Body.String())
+		}
+	}
+}
+
+func TestSlowRedisOperationsAreLogged(t *testing.T) {
+	fr := useFakeRedis(t)
+	redisClient.AddHook(slowRedisHook{threshold: 50 * time.Millisecond})
+	fr.delay("INCR", 80*time.Millisecond)
+	logs := captureFileLog(t)
+
+	rec := httptest.NewRecorder()
+	countHandler(rec, httptest.NewRequest("GET", "/count?page=slow", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	redisClient.Get(ctx, "page.count.slow")
+	pipe := redisClient.Pipeline()
+	pipe.Incr(ctx, "page.count.a")
+	pipe.Expire(ctx, "page.count.a", time.Hour)
+	pipe.Exec(ctx)
+
+	lines := logs.String()
+	if !regexp.MustCompile(`Slow Redis operation: incr page\.count\.slow took \d+ms`).MatchString(lines) {
+		t.Errorf("no slow-operation warning for INCR in %q", lines)
+	}
+	if !strings.Contains(lines, "Slow Redis operation: pipeline(incr,expire)  took") {
+		t.Errorf("no slow-operation warning for the pipeline in %q", lines)
+	}
+	// 低于阈值的操作不记录
+	if strings.Contains(lines, "get page.count.slow") {
+		t.Errorf("a fast GET was logged as slow: %q", lines)
+	}
+}
+
+func TestSitemapListsHTMLFiles(t *testing.T) {
+	root := t.TempDir()
+	modTime := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{"index.html", "about.html", "blog/index.html", "blog/my post.html", "notes.txt", ".drafts/secret.html"} {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte("<html>"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(file, modTime, modTime)
+	}
+	oldInterval, oldBase := sitemapInterval, sitemapBaseURL
+	sitemapInterval, sitemapBaseURL = time.Hour, ""
+	defer func() { sitemapInterval, sitemapBaseURL = oldInterval, oldBase }()
+	handler := sitemapHandler(root)
+
+	locs := func() []string {
+		t.Helper()
+		req := httptest.NewRequest("GET", "http://example.com/sitemap.xml", nil)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Header().Get("Content-Type") != "application/xml; charset=utf-8" {
+			t.Fatalf("Content-Type %q", rec.Header().Get("Content-Type"))
+		}
+		var urlSet sitemapURLSet
+		if err := xml.Unmarshal(rec.Body.Bytes(), &urlSet); err != nil {
+			t.Fatalf("%v in %s", err, rec.Body.String())
+		}
+		var locs []string
+		for _, u := range urlSet.URLs {
+			if u.LastMod != "2024-03-04" {
+				t.Errorf("%s: lastmod %q", u.Loc, u.LastMod)
+			}
+			locs = append(locs, u.Loc)
+		}
+		return locs
+	}
+
+	want := []string{
+		"http://example.com/",
+		"http://example.com/about.html",
+		"http://example.com/blog/",
+		"http://example.com/blog/my%20post.html",
+	}
+	if got := locs(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("sitemap lists %q, want %q", got, want)
+	}
+
+	// 缓存期内新增的文件不会出现，过期后重新生成
+	if err := os.WriteFile(filepath.Join(root, "new.html"), []byte("<html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filepath.Join(root, "new.html"), modTime, modTime)
+	if got := locs(); len(got) != len(want) {
+		t.Fatalf("cached sitemap changed: %q", got)
+	}
+	sitemapInterval = 0
+	if got := locs(); len(got) != len(want)+1 {
+		t.Fatalf("regenerated sitemap lists %q, want new.html added", got)
+	}
+}
+
+func TestLogDurationUnit(t *testing.T) {
+	oldUnit, oldFormat := logDurationUnit, fileLogFormat
+	defer func() { logDurationUnit, fileLogFormat = oldUnit, oldFormat }()
+	handler := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Microsecond)
+	}))
+	// 文本日志的格式为 ip [method] path status duration bytes
+	textDuration := func(line string) int64 {
+		fields := strings.Fields(line)
+		d, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+		if err != nil {
+			t.Fatalf("cannot parse the duration in %q", line)
+		}
+		return d
+	}
+
+	for _, tt := range []struct {
+		unit     string
+		min, max int64
+	}{
+		{"ms", 0, 50},
+		{"us", 200, 50000},
+		{"ns", 200000, 50000000},
+	} {
+		logDurationUnit = tt.unit
+
+		fileLogFormat = "text"
+		logs := captureFileLog(t)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+		if d := textDuration(logs.String()); d < tt.min || d > tt.max {
+			t.Errorf("%s text log: duration %d, want between %d and %d", tt.unit, d, tt.min, tt.max)
+		}
+
+		fileLogFormat = "json"
+		logs = captureFileLog(t)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+		var entry accessLogEntry
+		if err := json.Unmarshal([]byte(logs.String()), &entry); err != nil {
+			t.Fatalf("%s JSON log %q: %v", tt.unit, logs.String(), err)
+		}
+		if entry.DurationUnit != tt.unit || entry.Duration < tt.min || entry.Duration > tt.max {
+			t.Errorf("%s JSON log: duration %d %s, want between %d and %d", tt.unit, entry.Duration, entry.DurationUnit, tt.min, tt.max)
+		}
+	}
+}
+
+func TestCountryLoggedOnlyFromTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseTrustedProxies("10.0.0.300"); err == nil {
+		t.Fatal("an invalid proxy address was accepted")
+	}
+	oldProxies, oldHeader := trustedProxies, geoHeader
+	trustedProxies, geoHeader = proxies, "CF-IPCountry"
+	defer func() { trustedProxies, geoHeader = oldProxies, oldHeader }()
+	handler := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tt := range []struct {
+		remote  string
+		country string
+		logged  bool
+	}{
+		{"10.1.2.3:4000", "DE", true},
+		{"192.0.2.7:4000", "JP", true},
+		{"192.0.2.8:4000", "DE", false},
+		// 格式不正确的值不写入日志，防止日志注入
+		{"10.1.2.3:4000", "DE country=US", false},
+	} {
+		logs := captureFileLog(t)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		req.Header.Set("CF-IPCountry", tt.country)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		line := logs.String()
+		if got := strings.Contains(line, "country="); got != tt.logged {
+			t.Errorf("%s with %q: country logged = %v in %q", tt.remote, tt.country, got, line)
+		}
+		if tt.logged && !strings.Contains(line, "country="+tt.country) {
+			t.Errorf("%s: log %q does not contain country=%s", tt.remote, line, tt.country)
+		}
+	}
+}
+
+func TestForwardedHops(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldProxies, oldHops := trustedProxies, forwardedHops
+	trustedProxies = proxies
+	defer func() { trustedProxies, forwardedHops = oldProxies, oldHops }()
+
+	// 客户端 203.0.113.9 经过 CDN（10.0.0.1）和负载均衡器（10.0.0.2）到达，
+	// 客户端自己伪造了最左边的 198.51.100.1
+	const chain = "198.51.100.1, 203.0.113.9, 10.0.0.1"
+	for _, tt := range []struct {
+		hops    int
+		remote  string
+		headers []string
+		want    string
+	}{
+		{0, "10.0.0.2:4000", []string{chain}, "10.0.0.2"},
+		{1, "10.0.0.2:4000", []string{chain}, "10.0.0.1"},
+		{2, "10.0.0.2:4000", []string{chain}, "203.0.113.9"},
+		// 多个代理各自追加一个请求头时按顺序拼接
+		{2, "10.0.0.2:4000", []string{"198.51.100.1", "203.0.113.9", "10.0.0.1"}, "203.0.113.9"},
+		// 条目少于跳数时使用最左边的条目
+		{5, "10.0.0.2:4000", []string{"203.0.113.9, 10.0.0.1"}, "203.0.113.9"},
+		// 不是来自受信任代理的请求忽略该请求头，防止伪造
+		{2, "192.0.2.50:4000", []string{chain}, "192.0.2.50"},
+		// 选中的条目不是合法 IP 时退回对端地址
+		{2, "10.0.0.2:4000", []string{"unknown, 10.0.0.1"}, "10.0.0.2"},
+	} {
+		forwardedHops = tt.hops
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		for _, h := range tt.headers {
+			req.Header.Add("X-Forwarded-For", h)
+		}
+		if got := clientIP(req); got != tt.want {
+			t.Errorf("hops %d from %s with %q: client IP %s, want %s", tt.hops, tt.remote, tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestParseShutdownSignals(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []os.Signal
+		wantErr bool
+	}{
+		{"SIGINT,SIGTERM", []os.Signal{syscall.SIGINT, syscall.SIGTERM}, false},
+		{" term , quit ", []os.Signal{syscall.SIGTERM, syscall.SIGQUIT}, false},
+		{"sighup", nil, true},
+		{"SIGUSR9", nil, true},
+		{" , ", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseShutdownSignals(tt.value)
+		if (err != nil) != tt.wantErr || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("parseShutdownSignals(%q) = %v, %v; want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLogFileHash(t *testing.T) {
+	root := t.TempDir()
+	name := filepath.Join(root, "app.js")
+	modTime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	write := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldHash := logFileHash
+	logFileHash = true
+	defer func() { logFileHash = oldHash }()
+	handler := logRequest(newStaticHandler(root, staticOptions{}))
+	loggedHash := func() string {
+		t.Helper()
+		logs := captureFileLog(t)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/app.js", nil))
+		m := regexp.MustCompile(`sha256=([0-9a-f]+)`).FindStringSubmatch(logs.String())
+		if m == nil {
+			t.Fatalf("no sha256 field in %q", logs.String())
+		}
+		return m[1]
+	}
+	sum := func(content string) string {
+		h := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(h[:])
+	}
+
+	write("console.log(1)", modTime)
+	if got := loggedHash(); got != sum("console.log(1)") {
+		t.Fatalf("logged %s, want the file's SHA-256 %s", got, sum("console.log(1)"))
+	}
+	// 修改时间和大小不变时使用缓存，不重新计算
+	write("console.log(2)", modTime)
+	if got := loggedHash(); got != sum("console.log(1)") {
+		t.Fatalf("second request logged %s, want the cached hash", got)
+	}
+	write("console.log(2)", modTime.Add(time.Second))
+	if got := loggedHash(); got != sum("console.log(2)") {
+		t.Fatalf("after modification logged %s, want %s", got, sum("console.log(2)"))
+	}
+}
+
+func TestCountHEADDoesNotIncrement(t *testing.T) {
+	fr := useFakeRedis(t)
+	fr.set("page.count.home", "41")
+	srv := httptest.NewServer(http.HandlerFunc(countHandler))
+	defer srv.Close()
+
+	for _, accept := range []string{"", "text/plain"} {
+		req, _ := http.NewRequest("HEAD", srv.URL+"/count?page=home", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		want := "application/json"
+		if accept != "" {
+			want = "text/plain; charset=utf-8"
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != want || len(body) != 0 {
+			t.Errorf("HEAD with Accept %q: %d %q body %q", accept, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+	}
+	if got := fr.value("page.count.home"); got != "41" || fr.count("INCR") != 0 {
+		t.Fatalf("HEAD changed the count to %s with %d INCR commands", got, fr.count("INCR"))
+	}
+
+	resp, err := http.Get(srv.URL + "/count?page=home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"count":42`) {
+		t.Fatalf("GET after HEAD: %q", body)
+	}
+}
+
+// 使用空的静态文件缓存，测试结束后恢复
+func useStaticCache(t *testing.T, size int64, entries int) {
+	t.Helper()
+	oldSize, oldEntries, oldBytes, oldList, oldIndex := staticCacheSize, staticCacheMaxEntries, staticCacheBytes, staticCacheList, staticCacheIndex
+	staticCacheSize, staticCacheMaxEntries, staticCacheBytes = size, entries, 0
+	staticCacheList, staticCacheIndex = list.New(), make(map[string]*list.Element)
+	t.Cleanup(func() {
+		staticCacheSize, staticCacheMaxEntries, staticCacheBytes = oldSize, oldEntries, oldBytes
+		staticCacheList, staticCacheIndex = oldList, oldIndex
+	})
+}
+
+func TestStaticCacheServesFromMemory(t *testing.T) {
+	useStaticCache(t, 1<<20, 0)
+	root := t.TempDir()
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(name, content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(root, name), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := newStaticHandler(root, staticOptions{})
+	get := func(path string) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", path, rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	write("app.css", "body{color:red}", modTime)
+	if got := get("/app.css"); got != "body{color:red}" {
+		t.Fatalf("first request: %q", got)
+	}
+	// 修改时间和大小不变时从内存提供，不读取磁盘上的新内容
+	write("app.css", "body{color:blu}", modTime)
+	if got := get("/app.css"); got != "body{color:red}" {
+		t.Fatalf("second request read the disk: %q", got)
+	}
+	write("app.css", "body{color:blu}", modTime.Add(time.Second))
+	if got := get("/app.css"); got != "body{color:blu}" {
+		t.Fatalf("after modification: %q", got)
+	}
+
+	// 超过单个文件上限的文件不进入缓存
+	write("big.bin", strings.Repeat("x", staticCacheMaxFile+1), modTime)
+	get("/big.bin")
+	staticCacheMutex.Lock()
+	_, cached := staticCacheIndex[filepath.Join(root, "big.bin")]
+	entries, bytes := staticCacheList.Len(), staticCacheBytes
+	staticCacheMutex.Unlock()
+	if cached || entries != 1 || bytes != int64(len("body{color:blu}")) {
+		t.Fatalf("cache holds %d entries and %d bytes (big.bin cached: %v)", entries, bytes, cached)
+	}
+}
+
+func TestMaintenanceBannerWhileDegraded(t *testing.T) {
+	root := t.TempDir()
+	for name, body := range map[string]string{"index.html": "<html><body>home</body></html>", "app.css": "body{}"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldBanner, oldReady, oldDegraded, oldLameDuck := maintenanceBanner, ready.Load(), redisDegraded.Load(), lameDuck.Load()
+	maintenanceBanner = "Counts are <paused>"
+	ready.Store(true)
+	redisDegraded.Store(false)
+	lameDuck.Store(false)
+	defer func() {
+		maintenanceBanner = oldBanner
+		ready.Store(oldReady)
+		redisDegraded.Store(oldDegraded)
+		lameDuck.Store(oldLameDuck)
+	}()
+	handler := newStaticHandler(root, staticOptions{})
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", path, rec.Code)
+		}
+		return rec
+	}
+	const banner = `role="alert"`
+
+	if rec := get("/"); strings.Contains(rec.Body.String(), banner) || rec.Header().Get("Last-Modified") == "" {
+		t.Fatalf("healthy page: %v %q", rec.Header(), rec.Body.String())
+	}
+
+	for _, degrade := range []struct {
+		name string
+		set  func(bool)
+	}{
+		{"redis down", redisDegraded.Store},
+		{"lame duck", lameDuck.Store},
+	} {
+		degrade.set(true)
+		rec := get("/")
+		body := rec.Body.String()
+		if !strings.HasPrefix(body, "<html><body>home</body></html>") || !strings.Contains(body, banner) || !strings.Contains(body, "Counts are &lt;paused&gt;") {
+			t.Errorf("%s: page without an escaped banner: %q", degrade.name, body)
+		}
+		if rec.Header().Get("Content-Length") != "" || rec.Header().Get("Last-Modified") != "" {
+			t.Errorf("%s: the modified page kept validators: %v", degrade.name, rec.Header())
+		}
+		if css := get("/app.css").Body.String(); css != "body{}" {
+			t.Errorf("%s: non-HTML response was modified: %q", degrade.name, css)
+		}
+		degrade.set(false)
+	}
+
+	if body := get("/").Body.String(); strings.Contains(body, banner) {
+		t.Fatalf("banner still shown after recovering: %q", body)
+	}
+}
+
+func TestStaticCacheEntryLimit(t *testing.T) {
+	useStaticCache(t, 1<<20, 2)
+	root := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := newStaticHandler(root, staticOptions{})
+	cached := func() []string {
+		staticCacheMutex.Lock()
+		defer staticCacheMutex.Unlock()
+		var names []string
+		for e := staticCacheList.Front(); e != nil; e = e.Next() {
+			for name, elem := range staticCacheIndex {
+				if elem == e {
+					names = append(names, filepath.Base(name))
+				}
+			}
+		}
+		return names
+	}
+	for _, target := range []string{"/a.txt", "/b.txt", "/a.txt", "/c.txt"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", target, rec.Code)
+		}
+	}
+	// 字节数远未达到上限，按条目数淘汰最久未使用的 b.txt
+	if got := strings.Join(cached(), ","); got != "c.txt,a.txt" && got != "a.txt,c.txt" {
+		t.Fatalf("cached files %q, want a.txt and c.txt", got)
+	}
+
+	// 没有字节上限时缓存不会启用，条目上限只能配合 -static-cache-size 使用
+	out, err := runMain(t, "-dry-run", "-no-count", "-root", t.TempDir(), "-static-cache-entries", "100")
+	if err == nil || !strings.Contains(out, "-static-cache-entries requires -static-cache-size") {
+		t.Fatalf("-static-cache-entries alone was not rejected: %v\n%s", err, out)
+	}
+}
+
+func TestCountGIFBeacon(t *testing.T) {
+	fr := useFakeRedis(t)
+	srv := httptest.NewServer(http.HandlerFunc(countGIFHandler))
+	defer srv.Close()
+
+	for i := 1; i <= 2; i++ {
+		resp, err := http.Get(srv.URL + "/count.gif?page=home")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/gif" {
+			t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		if cc := resp.Header.Get("Cache-Control"); !strings.Contains(cc, "no-store") {
+			t.Errorf("Cache-Control %q allows caching", cc)
+		}
+		img, err := gif.Decode(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("response is not a valid GIF: %v", err)
+		}
+		if b := img.Bounds(); b.Dx() != 1 || b.Dy() != 1 {
+			t.Fatalf("image is %dx%d, want 1x1", b.Dx(), b.Dy())
+		}
+		if got := fr.value("page.count.home"); got != strconv.Itoa(i) {
+			t.Fatalf("after %d loads the count is %q", i, got)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/count.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("missing page: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestExpectContinueWithBodyLimit(t *testing.T) {
+	oldMax := maxBodySize
+	maxBodySize = 16
+	defer func() { maxBodySize = oldMax }()
+	srv := httptest.NewServer(limitBodySize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		fmt.Fprintf(w, "read %d bytes", len(body))
+	})))
+	defer srv.Close()
+
+	// 发送请求头后读取第一个响应状态行，请求体只在收到 100 Continue 后才发送
+	send := func(expect string, length int) (*bufio.Reader, net.Conn, string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "POST /import HTTP/1.1\r\nHost: example.com\r\nExpect: %s\r\nContent-Length: %d\r\n\r\n", expect, length)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(conn)
+		status, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return br, conn, strings.TrimSpace(status)
+	}
+
+	br, conn, status := send("100-continue", 10)
+	defer conn.Close()
+	if status != "HTTP/1.1 100 Continue" {
+		t.Fatalf("small body: first response %q, want 100 Continue", status)
+	}
+	br.ReadString('\n') // 100 Continue 之后的空行
+	conn.Write([]byte("0123456789"))
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "read 10 bytes" {
+		t.Fatalf("small body: %d %q", resp.StatusCode, body)
+	}
+
+	_, conn2, status := send("100-continue", 1000)
+	defer conn2.Close()
+	if status != "HTTP/1.1 413 Request Entity Too Large" {
+		t.Fatalf("large body: first response %q, want 413 without 100 Continue", status)
+	}
+
+	_, conn3, status := send("something-else", 10)
+	defer conn3.Close()
+	if status != "HTTP/1.1 417 Expectation Failed" {
+		t.Fatalf("unknown expectation: first response %q, want 417", status)
+	}
+}
+
+// 使用空的 DefaultServeMux 和路由表，测试结束后恢复
+func useServeMux(t *testing.T) {
+	t.Helper()
+	oldMux, oldRoutes := http.DefaultServeMux, routes
+	http.DefaultServeMux, routes = http.NewServeMux(), nil
+	t.Cleanup(func() { http.DefaultServeMux, routes = oldMux, oldRoutes })
+}
+
+func TestRouteTimeoutsLogTheSentStatus(t *testing.T) {
+	fr := useFakeRedis(t)
+	fr.delay("INCR", time.Second)
+	logs := captureFileLog(t)
+	useServeMux(t)
+	oldDefault, oldTimeouts := requestTimeout, routeTimeouts
+	requestTimeout, routeTimeouts = 300*time.Millisecond, map[string]time.Duration{"/count": 50 * time.Millisecond}
+	defer func() { requestTimeout, routeTimeouts = oldDefault, oldTimeouts }()
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "small.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 稀疏文件，远大于套接字缓冲区，慢速客户端无法在截止时间前读完
+	const bigSize = 256 << 20
+	big, err := os.Create(filepath.Join(root, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := big.Truncate(bigSize); err != nil {
+		t.Fatal(err)
+	}
+	big.Close()
+
+	handleRoute("/count", http.HandlerFunc(countHandler), "logRequest")
+	handleRoute("/", newStaticHandler(root, staticOptions{}), "logRequest")
+	srv := httptest.NewServer(http.DefaultServeMux)
+	defer srv.Close()
+
+	for _, route := range routes {
+		if route.Middlewares[0] != "logRequest" || !strings.HasPrefix(route.Middlewares[1], "timeout(") {
+			t.Fatalf("route %s: middlewares %v, want logRequest outside the timeout", route.Pattern, route.Middlewares)
+		}
+	}
+
+	// /count 的超时短于慢速 Redis，客户端收到 503，访问日志记录的也是 503
+	start := time.Now()
+	resp, err := http.Get(srv.URL + "/count?page=home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || time.Since(start) > 250*time.Millisecond {
+		t.Fatalf("/count: status %d after %v, want 503 within its 50ms timeout", resp.StatusCode, time.Since(start))
+	}
+	if !strings.Contains(logs.String(), "[GET] /count 503 ") {
+		t.Fatalf("access log does not record the 503:\n%s", logs.String())
+	}
+
+	// 静态路由使用默认超时，在截止时间内完成的请求正常返回
+	resp, err = http.Get(srv.URL + "/small.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("/small.txt: %d %q", resp.StatusCode, body)
+	}
+
+	// 大文件以流式发送，截止时间到达后连接被中断，访问日志记录已发送的 200 和实际字节数
+	resp, err = http.Get(srv.URL + "/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/big.bin: status %d", resp.StatusCode)
+	}
+	time.Sleep(500 * time.Millisecond)
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err == nil || n >= bigSize {
+		t.Fatalf("/big.bin: read %d bytes (err %v), want the download cut off at the deadline", n, err)
+	}
+	var line string
+	for _, l := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if strings.Contains(l, "/big.bin") {
+			line = l
+		}
+	}
+	fields := strings.Fields(line)
+	if !strings.Contains(line, "[GET] /big.bin 200 ") || fields[len(fields)-1] == strconv.Itoa(bigSize) {
+		t.Fatalf("access log %q should record 200 with the truncated byte count", line)
+	}
+}
+
+func TestConsoleJSONAndFileTextLogs(t *testing.T) {
+	oldConsoleFormat, oldFileFormat := consoleLogFormat, fileLogFormat
+	consoleLogFormat, fileLogFormat = "json", "text"
+	defer func() { consoleLogFormat, fileLogFormat = oldConsoleFormat, oldFileFormat }()
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+	file := captureFileLog(t)
+
+	handler := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "queued")
+	}))
+	req := httptest.NewRequest("POST", "/import", nil)
+	req.RemoteAddr = "192.0.2.7:4321"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry accessLogEntry
+	if err := json.Unmarshal([]byte(strings.TrimSpace(console.String())), &entry); err != nil {
+		t.Fatalf("stdout is not a JSON log line: %v\n%s", err, console.String())
+	}
+	if entry.IP != "192.0.2.7" || entry.Method != "POST" || entry.Path != "/import" || entry.Status != 202 || entry.Bytes != 6 {
+		t.Fatalf("stdout entry %+v does not describe the request", entry)
+	}
+	line := strings.TrimSpace(file.String())
+	if strings.HasPrefix(line, "{") || !strings.Contains(line, "192.0.2.7 [POST] /import 202 ") || !strings.HasSuffix(line, " 6") {
+		t.Fatalf("server.log line %q is not the same request in text format", line)
+	}
+}
+
+func TestLogIdleTimeoutCloses(t *testing.T) {
+	oldIdle := idleTimeout
+	idleTimeout = 100 * time.Millisecond
+	defer func() { idleTimeout = oldIdle }()
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.IdleTimeout = idleTimeout
+	srv.Config.ConnState = trackIdleConn
+	srv.Start()
+	defer srv.Close()
+
+	request := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return conn
+	}
+
+	// 客户端主动关闭的空闲连接不记录
+	closed := request()
+	closed.Close()
+	// 保持空闲的连接由服务端在空闲超时后关闭
+	idle := request()
+	defer idle.Close()
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle connection was not closed by the server: %v", err)
+	}
+
+	want := "Connection from " + idle.LocalAddr().String() + " closed after "
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(console.String(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no idle close logged for %s:\n%s", idle.LocalAddr(), console.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if strings.Contains(console.String(), closed.LocalAddr().String()) {
+		t.Fatalf("a connection closed by the client was logged:\n%s", console.String())
+	}
+	if !strings.Contains(console.String(), "(idle timeout 100ms)") {
+		t.Fatalf("log line does not mention the idle timeout:\n%s", console.String())
+	}
+}
+
+func TestCountFloorAndCeiling(t *testing.T) {
+	fr := useFakeRedis(t)
+	oldFloor, oldCeiling := countFloor, countCeiling
+	countFloor, countCeiling = 3, 5
+	defer func() { countFloor, countCeiling = oldFloor, oldCeiling }()
+
+	for i, want := range []int64{3, 3, 3, 4, 5, 5, 5} {
+		rec := httptest.NewRecorder()
+		countHandler(rec, httptest.NewRequest("GET", "/count?page=home", nil))
+		var resp CountResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("request %d: %v (%q)", i+1, err, rec.Body.String())
+		}
+		if resp.Count != want {
+			t.Errorf("request %d: reported count %d, want %d", i+1, resp.Count, want)
+		}
+	}
+	if got := fr.value("page.count.home"); got != "7" {
+		t.Fatalf("stored count %q, want 7", got)
+	}
+}
+
+func TestAPIManifestListsRegisteredRoutes(t *testing.T) {
+	useServeMux(t)
+	handleRoute("/count", http.HandlerFunc(countHandler))
+	handleRoute("/api", http.HandlerFunc(apiHandler))
+
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", "/api", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var manifest struct {
+		Endpoints []apiEndpoint `json:"endpoints"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	// 只列出已注册的路由
+	var paths []string
+	for _, endpoint := range manifest.Endpoints {
+		paths = append(paths, endpoint.Path)
+	}
+	if strings.Join(paths, ",") != "/api,/count" {
+		t.Fatalf("manifest lists %v, want [/api /count]", paths)
+	}
+
+	count := manifest.Endpoints[1]
+	if strings.Join(count.Methods, ",") != "GET,HEAD,OPTIONS" {
+		t.Errorf("/count methods %v", count.Methods)
+	}
+	if len(count.Params) == 0 || count.Params[0].Name != "page" || !count.Params[0].Required {
+		t.Errorf("/count params %+v, want a required page parameter first", count.Params)
+	}
+	if count.Description == "" {
+		t.Error("/count has no description")
+	}
+}
+
+func TestNoStaticServesAPIDescription(t *testing.T) {
+	fr := startFakeRedis(t)
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("<h1>site</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	startMain(t, "-no-static", "-root", root, "-p", port, "-redis-addr", fr.ln.Addr().String())
+	base := "http://127.0.0.1:" + port
+
+	resp := getWhenUp(t, http.DefaultClient, base+"/")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /: %d %q %s", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+	var manifest struct {
+		Endpoints []apiEndpoint `json:"endpoints"`
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		t.Fatalf("GET / is not an API description: %v\n%s", err, body)
+	}
+	paths := make(map[string]bool)
+	for _, endpoint := range manifest.Endpoints {
+		paths[endpoint.Path] = true
+	}
+	if !paths["/count"] || !paths["/readyz"] {
+		t.Fatalf("API description lists %v, want /count and /readyz", manifest.Endpoints)
+	}
+
+	// 根目录中的文件不再提供，未注册的路径返回 JSON 格式的 404
+	for _, path := range []string{"/index.html", "/missing"} {
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		var errResp ErrorResponse
+		if resp.StatusCode != http.StatusNotFound || json.Unmarshal(body, &errResp) != nil || errResp.Status != http.StatusNotFound {
+			t.Errorf("GET %s: %d %s", path, resp.StatusCode, body)
+		}
+	}
+}
+
+// 通过原始连接发送不带 Host 头的 HTTP/1.0 请求，返回响应状态码
+func getWithoutHost(t *testing.T, addr, path string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s HTTP/1.0\r\n\r\n", path)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestHostlessRequests(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("default"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		args   []string
+		status int
+	}{
+		{"served by default", nil, http.StatusOK},
+		{"rejected with -require-host", []string{"-require-host"}, http.StatusBadRequest},
+		{"rejected with -vhost", []string{"-vhost", "example.com=" + t.TempDir()}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := freePort(t)
+			startMain(t, append([]string{"-no-count", "-root", root, "-p", port}, tt.args...)...)
+			getWhenUp(t, http.DefaultClient, "http://127.0.0.1:"+port+"/").Body.Close()
+			if status := getWithoutHost(t, "127.0.0.1:"+port, "/"); status != tt.status {
+				t.Fatalf("hostless request: status %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestVhostRoots(t *testing.T) {
+	dirs := map[string]string{}
+	for _, name := range []string{"default", "example", "blog"} {
+		dirs[name] = t.TempDir()
+		if err := os.WriteFile(filepath.Join(dirs[name], "index.html"), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hosts := map[string]http.Handler{}
+	for host, value := range map[string]string{
+		"example.com": dirs["example"],
+		"blog.test":   dirs["blog"] + "; index-redirect=true",
+	} {
+		root, opts, err := parseVhost(value, staticOptions{})
+		if err != nil {
+			t.Fatalf("parseVhost(%q): %v", value, err)
+		}
+		hosts[host] = newStaticHandler(root, opts)
+	}
+	handler := selectVhost(hosts, newStaticHandler(dirs["default"], staticOptions{}))
+
+	tests := []struct {
+		host     string
+		status   int
+		body     string
+		location string
+	}{
+		{"example.com", http.StatusOK, "example", ""},
+		// 主机名不区分大小写，忽略端口
+		{"EXAMPLE.com:8080", http.StatusOK, "example", ""},
+		// 每个虚拟主机可以有自己的首页设置
+		{"blog.test", http.StatusMovedPermanently, "", "/index.html"},
+		{"other.test", http.StatusOK, "default", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status || (tt.body != "" && rec.Body.String() != tt.body) || rec.Header().Get("Location") != tt.location {
+			t.Errorf("Host %s: got %d %q Location %q, want %d %q %q", tt.host, rec.Code, rec.Body.String(), rec.Header().Get("Location"), tt.status, tt.body, tt.location)
+		}
+	}
+
+	if _, _, err := parseVhost("  ; index-redirect=true", staticOptions{}); err == nil {
+		t.Error("a vhost without a root directory was accepted")
+	}
+}
+
+func TestLogFieldOrder(t *testing.T) {
+	order, err := parseLogFields("status, path,ip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldOrder := logFieldOrder
+	logFieldOrder = order
+	defer func() { logFieldOrder = oldOrder }()
+	logs := captureFileLog(t)
+
+	handler := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	req := httptest.NewRequest("GET", "/missing", nil)
+	req.RemoteAddr = "192.0.2.9:1234"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// 日志前缀是 log 包添加的时间戳
+	line := strings.TrimSpace(logs.String())
+	if !strings.HasSuffix(line, " 404 /missing 192.0.2.9") {
+		t.Fatalf("log line %q does not follow status,path,ip", line)
+	}
+
+	for _, value := range []string{"status,agent", "ip,ip", ""} {
+		if _, err := parseLogFields(value); err == nil {
+			t.Errorf("parseLogFields(%q) was accepted", value)
+		}
+	}
+}
+
+func TestRouteLogFields(t *testing.T) {
+	fr := useFakeRedis(t)
+	fr.set("page.count.home", "41")
+	logs := captureFileLog(t)
+	useServeMux(t)
+	var pairs pairList
+	if err := pairs.Set("/count=ip|method|path|status|duration|bytes|fields,/assets/=status|path"); err != nil {
+		t.Fatal(err)
+	}
+	sets, err := parseRouteLogFields(pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSets := routeLogFieldSets
+	routeLogFieldSets = sets
+	defer func() { routeLogFieldSets = oldSets }()
+
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "assets"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "assets", "app.css"), []byte("body{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// /count 没有显式要求 logRequest，匹配 -route-log-fields 的前缀后也会记录
+	handleRoute("/count", http.HandlerFunc(countHandler))
+	handleRoute("/", newStaticHandler(root, staticOptions{}), "logRequest")
+	srv := httptest.NewServer(http.DefaultServeMux)
+	defer srv.Close()
+	for _, path := range []string{"/count?page=home", "/assets/app.css"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2:\n%s", len(lines), logs.String())
+	}
+	detailed := regexp.MustCompile(` 127\.0\.0\.1 \[GET\] /count 200 \d+ \d+$`)
+	if !detailed.MatchString(lines[0]) {
+		t.Errorf("/count line %q does not carry the detailed fields", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], " 200 /assets/app.css") || strings.Contains(lines[1], "127.0.0.1") || strings.Contains(lines[1], "[GET]") {
+		t.Errorf("static line %q does not use the minimal fields", lines[1])
+	}
+
+	if _, err := parseRouteLogFields(pairList{{Key: "count", Value: "status"}}); err == nil {
+		t.Error("a prefix without a leading / was accepted")
+	}
+	if _, err := parseRouteLogFields(pairList{{Key: "/count", Value: "status|agent"}}); err == nil {
+		t.Error("an unknown field was accepted")
+	}
+}
+
+func TestColorMethods(t *testing.T) {
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+	logs := captureFileLog(t)
+	oldMethods := colorMethods
+	defer func() { colorMethods = oldMethods }()
+	handler := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// 按方法返回控制台日志行是否带颜色
+	colored := func(value string, methods ...string) map[string]bool {
+		t.Helper()
+		var err error
+		if colorMethods, err = parseColorMethods(value); err != nil {
+			t.Fatal(err)
+		}
+		result := make(map[string]bool)
+		for _, method := range methods {
+			before := len(console.String())
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/items", nil))
+			line := console.String()[before:]
+			if !strings.Contains(line, "/items") {
+				t.Fatalf("%s: no console line", method)
+			}
+			result[method] = strings.Contains(line, "\033[")
+		}
+		return result
+	}
+
+	if got := colored("mutating", "GET", "HEAD", "DELETE", "POST"); got["GET"] || got["HEAD"] || !got["DELETE"] || !got["POST"] {
+		t.Errorf("mutating: colored %v, want only DELETE and POST", got)
+	}
+	if got := colored("get, patch", "GET", "PATCH", "DELETE"); !got["GET"] || !got["PATCH"] || got["DELETE"] {
+		t.Errorf("get,patch: colored %v, want GET and PATCH", got)
+	}
+	if got := colored("none", "GET", "DELETE"); got["GET"] || got["DELETE"] {
+		t.Errorf("none: colored %v", got)
+	}
+	if got := colored("all", "GET", "DELETE"); !got["GET"] || !got["DELETE"] {
+		t.Errorf("all: colored %v", got)
+	}
+	if strings.Contains(logs.String(), "\033[") {
+		t.Errorf("file log contains color codes:\n%s", logs.String())
+	}
+	if _, err := parseColorMethods("GET,,POST"); err == nil {
+		t.Error("an empty method was accepted")
+	}
+}
+
+func TestMaxQueryLength(t *testing.T) {
+	fr := useFakeRedis(t)
+	oldMax := maxQueryLength
+	maxQueryLength = 32
+	defer func() { maxQueryLength = oldMax }()
+	handler := limitPathLength(http.HandlerFunc(countHandler))
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"page=" + strings.Repeat("a", 27), http.StatusOK},
+		{"page=" + strings.Repeat("a", 28), http.StatusRequestURITooLong},
+		{"page=" + strings.Repeat("a", 1<<20), http.StatusRequestURITooLong},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/count?"+tt.query, nil))
+		if rec.Code != tt.status {
+			t.Errorf("query of %d bytes: status %d, want %d", len(tt.query), rec.Code, tt.status)
+		}
+	}
+	// 过长的查询字符串在解析之前被拒绝，不会产生 Redis 键
+	if n := fr.count("INCR"); n != 1 {
+		t.Fatalf("%d INCR commands reached Redis, want 1", n)
+	}
+}
+
+func TestAnalyticsForwarding(t *testing.T) {
+	fr := useFakeRedis(t)
+	events := make(chan AnalyticsEvent, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event AnalyticsEvent
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&event) != nil {
+			t.Errorf("unexpected upstream request %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		events <- event
+	}))
+	defer upstream.Close()
+	oldURL, oldQueue := analyticsURL, analyticsQueue
+	analyticsURL = upstream.URL
+	startAnalyticsForwarder(10)
+	defer func() {
+		close(analyticsQueue)
+		analyticsURL, analyticsQueue = oldURL, oldQueue
+	}()
+
+	before := time.Now()
+	req := httptest.NewRequest("GET", "/count?page=home", nil)
+	req.RemoteAddr = "192.0.2.10:5555"
+	rec := httptest.NewRecorder()
+	countHandler(rec, req)
+	if rec.Code != http.StatusOK || fr.value("page.count.home") != "1" {
+		t.Fatalf("status %d, stored count %q; forwarding should be in addition to Redis", rec.Code, fr.value("page.count.home"))
+	}
+	select {
+	case event := <-events:
+		if event.Page != "home" || event.IP != "192.0.2.10" || event.Timestamp.Before(before.Add(-time.Second)) {
+			t.Fatalf("upstream received %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream did not receive the event")
+	}
+}
+
+func TestAnalyticsQueueFullDropsEvents(t *testing.T) {
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+	// 没有发送 goroutine 的队列，第二个事件必然被丢弃
+	oldQueue := analyticsQueue
+	analyticsQueue = make(chan AnalyticsEvent, 1)
+	defer func() { analyticsQueue = oldQueue }()
+
+	done := make(chan struct{})
+	go func() {
+		forwardHit("home", "192.0.2.1")
+		forwardHit("about", "192.0.2.1")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("forwardHit blocked on a full queue")
+	}
+	if event := <-analyticsQueue; event.Page != "home" {
+		t.Fatalf("queued event %+v, want the first one", event)
+	}
+	if !strings.Contains(console.String(), "Analytics queue is full, dropping event for about") {
+		t.Fatalf("no warning for the dropped event:\n%s", console.String())
+	}
+}
+
+func TestSuppressedHitReturnsCurrentCount(t *testing.T) {
+	fr := useFakeRedis(t)
+	oldWindow, oldReject := dedupWindow, dedupReject
+	dedupWindow, dedupReject = time.Minute, false
+	defer func() { dedupWindow, dedupReject = oldWindow, oldReject }()
+
+	hit := func(ip string) (CountResponse, http.Header) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/count?page=home", nil)
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		countHandler(rec, req)
+		var resp CountResponse
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil {
+			t.Fatalf("hit from %s: %d %q", ip, rec.Code, rec.Body.String())
+		}
+		return resp, rec.Header()
+	}
+
+	hit("192.0.2.1")
+	hit("192.0.2.2")
+	// 被抑制的请求返回包含其他客户端计数在内的当前值，而不是 429
+	resp, header := hit("192.0.2.1")
+	if resp.Count != 2 || header.Get("X-Count-Suppressed") != "true" {
+		t.Fatalf("suppressed hit: count %d, X-Count-Suppressed %q; want 2 and true", resp.Count, header.Get("X-Count-Suppressed"))
+	}
+	hit("192.0.2.3")
+	if resp, _ := hit("192.0.2.2"); resp.Count != 3 {
+		t.Fatalf("suppressed hit after another count: count %d, want 3", resp.Count)
+	}
+	if resp, header := hit("192.0.2.4"); resp.Count != 4 || header.Get("X-Count-Suppressed") != "" {
+		t.Fatalf("counted hit: count %d, X-Count-Suppressed %q", resp.Count, header.Get("X-Count-Suppressed"))
+	}
+	if got := fr.value("page.count.home"); got != "4" {
+		t.Fatalf("stored count %q, want 4", got)
+	}
+}
+
+func TestPingRedisRetriesUntilAvailable(t *testing.T) {
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+	addr := "127.0.0.1:" + freePort(t)
+	oldClient := redisClient
+	redisClient = redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	defer func() {
+		redisClient.Close()
+		redisClient = oldClient
+	}()
+
+	// 不重试时立即失败
+	if err := pingRedis(0, 10*time.Millisecond); err == nil {
+		t.Fatal("ping succeeded with no Redis listening")
+	}
+
+	// Redis 在第三次重试之前启动（重试间隔为 50ms、100ms、200ms）
+	started := make(chan *fakeRedis, 1)
+	time.AfterFunc(250*time.Millisecond, func() { started <- startFakeRedisAt(t, addr) })
+	if err := pingRedis(5, 50*time.Millisecond); err != nil {
+		t.Fatalf("ping did not succeed once Redis started: %v", err)
+	}
+	if fr := <-started; fr.count("PING") == 0 {
+		t.Fatal("the delayed Redis never received a PING")
+	}
+	if n := strings.Count(console.String(), "Redis is not available"); n < 2 || n > 4 {
+		t.Fatalf("%d retries logged, want 2 to 4:\n%s", n, console.String())
+	}
+	if !strings.Contains(console.String(), "retrying in 100ms (2/5)") {
+		t.Fatalf("retry interval does not back off:\n%s", console.String())
+	}
+}
+
+func TestCountStaleOnError(t *testing.T) {
+	useFakeRedis(t)
+	oldStale, oldCounts := countStaleOnError, lastCounts
+	countStaleOnError, lastCounts = true, make(map[string]int64)
+	defer func() { countStaleOnError, lastCounts = oldStale, oldCounts }()
+
+	hit := func(page string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		countHandler(rec, httptest.NewRequest("GET", "/count?page="+page, nil))
+		return rec
+	}
+	if rec := hit("home"); rec.Code != http.StatusOK || rec.Header().Get("X-Count-Stale") != "" {
+		t.Fatalf("healthy Redis: %d stale=%q", rec.Code, rec.Header().Get("X-Count-Stale"))
+	}
+
+	// Redis 宕机：改为连接一个没有监听的地址
+	redisClient.Close()
+	redisClient = redis.NewClient(&redis.Options{Addr: "127.0.0.1:" + freePort(t), MaxRetries: -1})
+
+	rec := hit("home")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Count-Stale") != "true" || rec.Header().Get("Warning") == "" {
+		t.Fatalf("stale read: %d stale=%q Warning=%q", rec.Code, rec.Header().Get("X-Count-Stale"), rec.Header().Get("Warning"))
+	}
+	var resp CountResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Count != 1 {
+		t.Fatalf("stale body %q, want the last known count 1", rec.Body.String())
+	}
+	// 没有读取过的页面没有可用的缓存值
+	if rec := hit("about"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("uncached page during the outage: status %d, want 500", rec.Code)
+	}
+}
+
+func TestStaticRequireReadyUntilWarmedUp(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	port, redisAddr := freePort(t), "127.0.0.1:"+freePort(t)
+	_, out := startMain(t, "-root", root, "-p", port, "-static-require-ready",
+		"-redis-addr", redisAddr, "-redis-connect-retries", "20", "-redis-connect-interval", "50ms")
+	base := "http://127.0.0.1:" + port
+
+	status := func(path string) int {
+		t.Helper()
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// Redis 还没有启动：监听器已经接受连接，但所有请求都返回 503
+	getWhenUp(t, http.DefaultClient, base+"/readyz").Body.Close()
+	for _, path := range []string{"/readyz", "/", "/count?page=home"} {
+		if got := status(path); got != http.StatusServiceUnavailable {
+			t.Errorf("GET %s before warm-up: status %d, want 503", path, got)
+		}
+	}
+
+	fr := startFakeRedisAt(t, redisAddr)
+	deadline := time.Now().Add(10 * time.Second)
+	for status("/readyz") != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatalf("not ready after Redis started:\n%s", out.String())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, path := range []string{"/", "/count?page=home"} {
+		if got := status(path); got != http.StatusOK {
+			t.Errorf("GET %s after warm-up: status %d, want 200", path, got)
+		}
+	}
+	if got := fr.value("page.count.home"); got != "1" {
+		t.Fatalf("stored count %q, want only the request after warm-up counted", got)
+	}
+}
+
+func TestLogOnStart(t *testing.T) {
+	oldOnStart, oldFormat := logOnStart, fileLogFormat
+	logOnStart, fileLogFormat = true, "json"
+	defer func() { logOnStart, fileLogFormat = oldOnStart, oldFormat }()
+	logs := captureFileLog(t)
+
+	inProgress := ""
+	handler := withRequestID(logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 请求仍在处理时就能看到 started 行
+		inProgress = logs.String()
+	})))
+	req := httptest.NewRequest("GET", "/slow", nil)
+	req.Header.Set("X-Request-ID", "req-42")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var started startLogEntry
+	if err := json.Unmarshal([]byte(strings.TrimSpace(inProgress)), &started); err != nil {
+		t.Fatalf("no started line while the request was in progress: %v (%q)", err, inProgress)
+	}
+	if started.Event != "started" || started.Method != "GET" || started.Path != "/slow" || started.RequestID != "req-42" {
+		t.Fatalf("started line %+v", started)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want started and completed:\n%s", len(lines), logs.String())
+	}
+	var completed accessLogEntry
+	if err := json.Unmarshal([]byte(lines[1]), &completed); err != nil {
+		t.Fatal(err)
+	}
+	if completed.Status != 200 || completed.Fields["id"] != "req-42" {
+		t.Fatalf("completed line %q does not carry the matching request ID", lines[1])
+	}
+}
+
+func TestLogRedactParams(t *testing.T) {
+	logs := captureFileLog(t)
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+	oldQuery, oldRedact, oldFormat := logQuery, logRedactParams, fileLogFormat
+	logQuery, logRedactParams = true, map[string]bool{"token": true, "email": true}
+	defer func() { logQuery, logRedactParams, fileLogFormat = oldQuery, oldRedact, oldFormat }()
+	handler := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// 参数名不区分大小写，其余参数和顺序保持不变
+	const target = "/search?q=go&Token=abc123&email=a%40example.com&tags=x&tags=y&token"
+	const want = "/search?q=go&Token=[REDACTED]&email=[REDACTED]&tags=x&tags=y&token"
+	for _, format := range []string{"text", "json"} {
+		fileLogFormat = format
+		before := len(logs.String())
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+		line := logs.String()[before:]
+		if format == "json" {
+			var entry accessLogEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("invalid JSON log line %q: %v", line, err)
+			}
+			if entry.Path != want {
+				t.Errorf("JSON path %q, want %q", entry.Path, want)
+			}
+		} else if !strings.Contains(line, " "+want+" ") {
+			t.Errorf("text line %q does not contain %q", line, want)
+		}
+	}
+	for name, out := range map[string]string{"file": logs.String(), "console": console.String()} {
+		if strings.Contains(out, "abc123") || strings.Contains(out, "example.com") {
+			t.Errorf("%s log leaks a redacted value:\n%s", name, out)
+		}
+	}
+
+	out, err := runMain(t, "-dry-run", "-no-count", "-root", t.TempDir(), "-log-redact-params", "token")
+	if err == nil || !strings.Contains(out, "-log-redact-params requires -log-query") {
+		t.Fatalf("-log-redact-params without -log-query was not rejected: %v\n%s", err, out)
+	}
+}
+
+func TestQueueWaitLogged(t *testing.T) {
+	logs := captureFileLog(t)
+	oldMax, oldSlots := maxInFlight, inFlightSlots
+	maxInFlight, inFlightSlots = 1, make(chan struct{}, 1)
+	defer func() { maxInFlight, inFlightSlots = oldMax, oldSlots }()
+
+	// 与 main 一致，limitInFlight 作为全局中间件包在路由的 logRequest 之外
+	release := make(chan struct{})
+	entered := make(chan string, 2)
+	handler := limitInFlight(logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- r.URL.Path
+		if r.URL.Path == "/first" {
+			<-release
+		}
+	})))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	done := make(chan struct{}, 2)
+	get := func(path string) {
+		resp, err := http.Get(srv.URL + path)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- struct{}{}
+	}
+	go get("/first")
+	<-entered
+	go get("/queued")
+	// /queued 在 /first 占用唯一的名额期间排队
+	select {
+	case path := <-entered:
+		t.Fatalf("%s ran while the limit was reached", path)
+	case <-time.After(150 * time.Millisecond):
+	}
+	close(release)
+	<-done
+	<-done
+
+	waits := make(map[string]int64)
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		m := regexp.MustCompile(` (/\w+) .* wait=(\d+)$`).FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("log line %q has no wait field", line)
+		}
+		waits[m[1]], _ = strconv.ParseInt(m[2], 10, 64)
+	}
+	if len(waits) != 2 || waits["/first"] > 50 || waits["/queued"] < 150 {
+		t.Fatalf("logged waits %v, want about 0ms for /first and at least 150ms for /queued", waits)
+	}
+}
+
+func TestSlowStartRampsConnections(t *testing.T) {
+	oldWindow, oldConns := slowStartWindow, slowStartConns
+	slowStartWindow, slowStartConns = 600*time.Millisecond, 5
+	defer func() { slowStartWindow, slowStartConns = oldWindow, oldConns }()
+
+	now := time.Now()
+	for _, tt := range []struct {
+		elapsed time.Duration
+		limit   int
+	}{
+		{0, 1},
+		{150 * time.Millisecond, 2},
+		{300 * time.Millisecond, 3},
+		{599 * time.Millisecond, 4},
+		{600 * time.Millisecond, -1},
+	} {
+		l := &slowStartListener{start: now.Add(-tt.elapsed)}
+		if got := l.limit(); got != tt.limit {
+			t.Errorf("limit after %s = %d, want %d", tt.elapsed, got, tt.limit)
+		}
+	}
+
+	ln, err := listen(&http.Server{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	// 5 个客户端同时连接并保持连接，接受的数量随窗口推移逐步增加
+	for i := 0; i < 5; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	countAfter := func(d time.Duration) int {
+		time.Sleep(d)
+		return len(accepted)
+	}
+	if n := countAfter(50 * time.Millisecond); n != 1 {
+		t.Fatalf("%d connections accepted right after startup, want 1", n)
+	}
+	mid := countAfter(300 * time.Millisecond)
+	if mid < 2 || mid > 4 {
+		t.Fatalf("%d connections accepted halfway through the window, want 2 to 4", mid)
+	}
+	if n := countAfter(400 * time.Millisecond); n != 5 {
+		t.Fatalf("%d connections accepted after the window, want 5", n)
+	}
+	for i := 0; i < 5; i++ {
+		(<-accepted).Close()
+	}
+}
+
+func TestSlowStartRestartAndClose(t *testing.T) {
+	oldWindow, oldConns := slowStartWindow, slowStartConns
+	slowStartWindow, slowStartConns = time.Hour, 5
+	defer func() { slowStartWindow, slowStartConns = oldWindow, oldConns }()
+
+	ln, err := listen(&http.Server{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := ln.(*slowStartListener)
+	// 窗口结束后不再限制，重新开始后上限回到 1
+	l.start = time.Now().Add(-2 * time.Hour)
+	if got := l.limit(); got != -1 {
+		t.Fatalf("limit after the window = %d, want -1", got)
+	}
+	l.restart()
+	if got := l.limit(); got != 1 {
+		t.Fatalf("limit after restart = %d, want 1", got)
+	}
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	first, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// 达到上限时等待中的 Accept 在监听器关闭后立即返回
+	done := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ln.Close()
+	select {
+	case err := <-done:
+		if err != net.ErrClosed {
+			t.Fatalf("Accept after Close: %v, want net.ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept kept waiting after the listener was closed")
+	}
+}
+
+func TestAdminStatusPage(t *testing.T) {
+	useFakeRedis(t)
+	oldToken, oldCounts := adminToken, pageCounts
+	adminToken = "secret"
+	pageCounts = map[string]int64{"home": 12, "<script>": 3}
+	recentErrorsMutex.Lock()
+	oldErrors := recentErrors
+	recentErrors = nil
+	recentErrorsMutex.Unlock()
+	defer func() {
+		adminToken, pageCounts = oldToken, oldCounts
+		recentErrorsMutex.Lock()
+		recentErrors = oldErrors
+		recentErrorsMutex.Unlock()
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/status", requireAdmin(statusPageHandler))
+	mux.HandleFunc("/boom", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	handler := trackStats(mux)
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, path := range []string{"/", "/about", "/boom?token=hidden"} {
+		serve(httptest.NewRequest("GET", path, nil))
+	}
+
+	if rec := serve(httptest.NewRequest("GET", "/admin/status", nil)); rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("without the token: status %d, WWW-Authenticate %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+
+	// 浏览器中以令牌为 Basic 认证的密码打开
+	req := httptest.NewRequest("GET", "/admin/status", nil)
+	req.SetBasicAuth("admin", "secret")
+	requests := totalRequests.Load()
+	rec := serve(req)
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{
+		fmt.Sprintf(`<td id="requests">%d</td>`, requests),
+		"<th>Redis</th><td>ok</td>",
+		"<td>home</td><td>12</td>",
+		"<td>&lt;script&gt;</td><td>3</td>",
+		"<td>GET /boom</td><td>500</td>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("status page does not contain %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "hidden") {
+		t.Error("status page shows the query string of a failed request")
+	}
+}
+
+func TestPeakConcurrency(t *testing.T) {
+	oldInFlight, oldConns := peakInFlight.Load(), peakConns.Load()
+	peakInFlight.Store(0)
+	peakConns.Store(0)
+	defer func() {
+		peakInFlight.Store(oldInFlight)
+		peakConns.Store(oldConns)
+	}()
+
+	// 所有请求都到达之后才一起返回，保证它们同时处于处理中
+	const n = 8
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	release := make(chan struct{})
+	srv := httptest.NewUnstartedServer(trackStats(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		<-release
+	})))
+	srv.Config.ConnState = trackConnState
+	srv.Start()
+	defer srv.Close()
+
+	var done sync.WaitGroup
+	for i := 0; i < n; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			resp, err := http.Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	arrived.Wait()
+	close(release)
+	done.Wait()
+
+	if peak := peakInFlight.Load(); peak < n {
+		t.Errorf("peak in-flight %d, want at least %d", peak, n)
+	}
+	if peak := peakConns.Load(); peak < n {
+		t.Errorf("peak connections %d, want at least %d", peak, n)
+	}
+	summary := buildShutdownSummary()
+	if summary.PeakInFlight != peakInFlight.Load() || summary.PeakConnections != peakConns.Load() {
+		t.Errorf("shutdown summary %+v does not report the peaks", summary)
+	}
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		fmt.Sprintf("http_requests_in_flight_peak %d\n", peakInFlight.Load()),
+		fmt.Sprintf("http_connections_peak %d\n", peakConns.Load()),
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics does not contain %q", want)
+		}
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	fr := useFakeRedis(t)
+	oldWindow := idempotencyWindow
+	idempotencyWindow = 200 * time.Millisecond
+	defer func() { idempotencyWindow = oldWindow }()
+
+	hit := func(page, key string) (int64, *httptest.ResponseRecorder) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/count?page="+page, nil)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		countHandler(rec, req)
+		var resp CountResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp.Count, rec
+	}
+
+	if count, rec := hit("home", "beacon-1"); count != 1 || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first request: count %d, replayed %q", count, rec.Header().Get("Idempotent-Replayed"))
+	}
+	hit("home", "")
+	// 重试返回第一次请求的结果，即使其他请求已经计数
+	if count, rec := hit("home", "beacon-1"); count != 1 || rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry: count %d, replayed %q; want the prior result 1", count, rec.Header().Get("Idempotent-Replayed"))
+	}
+	if got := fr.value("page.count.home"); got != "2" {
+		t.Fatalf("stored count %q after a retry, want 2", got)
+	}
+	// 同一个键用于其他页面时单独计数
+	if count, _ := hit("about", "beacon-1"); count != 1 || fr.value("page.count.about") != "1" {
+		t.Fatalf("same key on another page: count %d", count)
+	}
+	if _, rec := hit("home", strings.Repeat("k", maxIdempotencyKeyLength+1)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("over-long key: status %d, want 400", rec.Code)
+	}
+
+	// 窗口过期后同一个键再次计数
+	time.Sleep(250 * time.Millisecond)
+	if count, rec := hit("home", "beacon-1"); count != 3 || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("after the window: count %d, replayed %q", count, rec.Header().Get("Idempotent-Replayed"))
+	}
+}
+
+func TestIdempotencyKeyReleasedWhenRejected(t *testing.T) {
+	fr := useFakeRedis(t)
+	oldIdempotency, oldWindow, oldReject := idempotencyWindow, dedupWindow, dedupReject
+	idempotencyWindow, dedupWindow, dedupReject = time.Minute, 100*time.Millisecond, true
+	defer func() { idempotencyWindow, dedupWindow, dedupReject = oldIdempotency, oldWindow, oldReject }()
+
+	hit := func(key string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/count?page=home", nil)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		countHandler(rec, req)
+		return rec
+	}
+
+	hit("")
+	if rec := hit("beacon-1"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("duplicate hit: status %d, want 429", rec.Code)
+	}
+	// 被拒绝的请求没有计数，窗口过后用同一个键重试应该计数而不是返回重放结果
+	time.Sleep(150 * time.Millisecond)
+	rec := hit("beacon-1")
+	if rec.Code != http.StatusOK || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("retry after a 429: status %d, replayed %q", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+	if got := fr.value("page.count.home"); got != "2" {
+		t.Fatalf("stored count %q after the retry, want 2", got)
+	}
+}
+
+func TestLameDuckToggle(t *testing.T) {
+	oldToken, oldReady, oldLameDuck := adminToken, ready.Load(), lameDuck.Load()
+	adminToken = "secret"
+	ready.Store(true)
+	lameDuck.Store(false)
+	defer func() {
+		adminToken = oldToken
+		ready.Store(oldReady)
+		lameDuck.Store(oldLameDuck)
+	}()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/lame-duck", requireAdmin(lameDuckHandler))
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "hi") })
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	do := func(method, path, token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	toggle := func(enabled string) {
+		t.Helper()
+		if resp := do("POST", "/admin/lame-duck?enabled="+enabled, "secret"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST enabled=%s: status %d", enabled, resp.StatusCode)
+		}
+	}
+
+	if resp := do("POST", "/admin/lame-duck?enabled=true", "wrong"); resp.StatusCode != http.StatusUnauthorized || lameDuck.Load() {
+		t.Fatalf("wrong token: status %d, lame duck %v", resp.StatusCode, lameDuck.Load())
+	}
+
+	toggle("true")
+	if resp := do("GET", "/readyz", ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz in lame-duck mode: status %d, want 503", resp.StatusCode)
+	}
+	if resp := do("GET", "/hello", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("request in lame-duck mode: status %d, want 200", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/admin/lame-duck", nil)
+	req.Header.Set("X-Admin-Token", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state LameDuckResponse
+	json.NewDecoder(resp.Body).Decode(&state)
+	resp.Body.Close()
+	if !state.LameDuck {
+		t.Fatal("GET /admin/lame-duck does not report lame-duck mode")
+	}
+
+	toggle("false")
+	if resp := do("GET", "/readyz", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("/readyz after leaving lame-duck mode: status %d, want 200", resp.StatusCode)
+	}
+	if resp := do("POST", "/admin/lame-duck?enabled=maybe", "secret"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid enabled value: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestLenientRange(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "data.bin"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+	oldLenient := lenientRange
+	defer func() { lenientRange = oldLenient }()
+
+	tests := []struct {
+		rangeHeader string
+		strict      int
+		lenient     int
+	}{
+		{"bytes=5-2", http.StatusRequestedRangeNotSatisfiable, http.StatusOK},
+		{"bytes=abc", http.StatusRequestedRangeNotSatisfiable, http.StatusOK},
+		{"items=0-1", http.StatusRequestedRangeNotSatisfiable, http.StatusOK},
+		// 格式正确的范围不受影响，无法满足时仍然返回 416
+		{"bytes=2-4", http.StatusPartialContent, http.StatusPartialContent},
+		{"bytes=100-200", http.StatusRequestedRangeNotSatisfiable, http.StatusRequestedRangeNotSatisfiable},
+	}
+	for _, lenient := range []bool{false, true} {
+		lenientRange = lenient
+		handler := newStaticHandler(root, staticOptions{})
+		for _, tt := range tests {
+			req := httptest.NewRequest("GET", "/data.bin", nil)
+			req.Header.Set("Range", tt.rangeHeader)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			want := tt.strict
+			if lenient {
+				want = tt.lenient
+			}
+			if rec.Code != want {
+				t.Errorf("lenient=%v Range %q: status %d, want %d", lenient, tt.rangeHeader, rec.Code, want)
+			}
+			if rec.Code == http.StatusOK && rec.Body.String() != "0123456789" {
+				t.Errorf("lenient=%v Range %q: body %q, want the full file", lenient, tt.rangeHeader, rec.Body.String())
+			}
+		}
+	}
+	if !strings.Contains(console.String(), `Ignoring malformed Range "bytes=5-2"`) {
+		t.Fatalf("malformed Range was not logged:\n%s", console.String())
+	}
+}
+
+func TestMaxIncrementClampsBatches(t *testing.T) {
+	fr := useFakeRedis(t)
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+	oldInterval, oldMax, oldBase, oldFlushing, oldPending := countBatchInterval, maxIncrement, countBatchBase, countBatchFlushing, countBatchPending
+	countBatchInterval, maxIncrement = time.Hour, 3
+	countBatchBase, countBatchFlushing, countBatchPending = make(map[string]int64), make(map[string]int64), make(map[string]int64)
+	defer func() {
+		countBatchInterval, maxIncrement, countBatchBase, countBatchFlushing, countBatchPending = oldInterval, oldMax, oldBase, oldFlushing, oldPending
+	}()
+
+	for i := 0; i < 5; i++ {
+		countHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/count?page=home", nil))
+	}
+	countHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/count?page=about", nil))
+	flushCountBatch()
+	if home, about := fr.value("page.count.home"), fr.value("page.count.about"); home != "3" || about != "1" {
+		t.Fatalf("after the flush home=%q about=%q, want 3 and 1", home, about)
+	}
+	if !strings.Contains(console.String(), "Clamping 5 increments for home to -max-increment 3") || strings.Contains(console.String(), "for about") {
+		t.Fatalf("clamp warnings:\n%s", console.String())
+	}
+	// 超出的部分被丢弃，不会留到下一次写入
+	flushCountBatch()
+	if home := fr.value("page.count.home"); home != "3" {
+		t.Fatalf("home=%q after a flush without new hits, want 3", home)
+	}
+}
+
+func TestCountBatching(t *testing.T) {
+	fr := useFakeRedis(t)
+	oldInterval, oldBase, oldFlushing, oldPending := countBatchInterval, countBatchBase, countBatchFlushing, countBatchPending
+	// 不启动定时写入，由测试调用 flushCountBatch
+	countBatchInterval = time.Hour
+	countBatchBase, countBatchFlushing, countBatchPending = make(map[string]int64), make(map[string]int64), make(map[string]int64)
+	defer func() {
+		countBatchInterval, countBatchBase, countBatchFlushing, countBatchPending = oldInterval, oldBase, oldFlushing, oldPending
+	}()
+	fr.set("page.count.home", "100")
+
+	hit := func(page string) int64 {
+		rec := httptest.NewRecorder()
+		countHandler(rec, httptest.NewRequest("GET", "/count?page="+page, nil))
+		var resp CountResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp.Count
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := make(map[int64]bool)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(page string) {
+			defer wg.Done()
+			count := hit(page)
+			if page == "home" {
+				mu.Lock()
+				seen[count] = true
+				mu.Unlock()
+			}
+		}([]string{"home", "home", "home", "about", "about"}[i%5])
+	}
+	wg.Wait()
+
+	// 每个请求立即得到不同的估计计数，但还没有写入 Redis
+	for count := int64(101); count <= 130; count++ {
+		if !seen[count] {
+			t.Fatalf("no response reported count %d, got %v", count, seen)
+		}
+	}
+	if n := fr.count("INCR") + fr.count("INCRBY"); n != 0 {
+		t.Fatalf("%d increments reached Redis before the flush", n)
+	}
+
+	flushCountBatch()
+	if n := fr.count("INCRBY"); n != 2 {
+		t.Fatalf("flush sent %d INCRBY commands, want one per page", n)
+	}
+	if fr.value("page.count.home") != "130" || fr.value("page.count.about") != "20" {
+		t.Fatalf("after the flush home=%q about=%q, want 130 and 20", fr.value("page.count.home"), fr.value("page.count.about"))
+	}
+	// 写入后的估计值从 Redis 中的值继续
+	if count := hit("home"); count != 131 {
+		t.Fatalf("count after the flush %d, want 131", count)
+	}
+	flushCountBatch()
+	if fr.value("page.count.home") != "131" || fr.count("INCRBY") != 3 {
+		t.Fatalf("second flush: home=%q with %d INCRBY commands", fr.value("page.count.home"), fr.count("INCRBY"))
+	}
+}
+
+func TestDebugRedisCommandLog(t *testing.T) {
+	fr := startFakeRedis(t)
+	console := &logBuffer{}
+	oldConsole, oldClient := consoleLogger.Writer(), redisClient
+	consoleLogger.SetOutput(console)
+	defer func() {
+		consoleLogger.SetOutput(oldConsole)
+		redisClient = oldClient
+	}()
+
+	for _, debug := range []bool{false, true} {
+		console.mu.Lock()
+		console.buf.Reset()
+		console.mu.Unlock()
+		redisClient = redis.NewClient(&redis.Options{Addr: fr.ln.Addr().String(), Password: "hunter2", MaxRetries: -1})
+		// 与 main 一样只在 -debug 时添加钩子
+		if debug {
+			redisClient.AddHook(debugRedisHook{})
+		}
+		rec := httptest.NewRecorder()
+		countHandler(rec, httptest.NewRequest("GET", "/count?page=home", nil))
+		redisClient.Set(ctx, "page.note", "sensitive-value", 0)
+		redisClient.Close()
+
+		out := console.String()
+		if !debug {
+			if strings.Contains(out, "Redis command") {
+				t.Fatalf("Redis commands logged without -debug:\n%s", out)
+			}
+			continue
+		}
+		if !strings.Contains(out, "Redis command: INCR page.count.home\n") || !strings.Contains(out, "Redis command: SET page.note\n") {
+			t.Fatalf("debug log does not contain the commands:\n%s", out)
+		}
+		if strings.Contains(out, "hunter2") || strings.Contains(out, "sensitive-value") {
+			t.Fatalf("debug log contains the password or a value:\n%s", out)
+		}
+	}
+}
+
+func TestRejectSuspiciousPaths(t *testing.T) {
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+	captureFileLog(t)
+	oldMode := suspiciousPaths
+	defer func() { suspiciousPaths = oldMode }()
+	srv := httptest.NewServer(rejectSuspiciousPaths(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer srv.Close()
+
+	// 通过原始连接发送，避免客户端规范化请求路径
+	status := func(target string) int {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n", target)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		target string
+		basic  int
+		strict int
+	}{
+		{"/docs/index.html", 200, 200},
+		{"/static/..%2f..%2fetc/passwd", 400, 400},
+		{"/%2e%2e/etc/passwd", 400, 400},
+		{"/file%00.html", 400, 400},
+		{"/line%0abreak", 400, 400},
+		// 只有 strict 拒绝编码的斜杠和点路径段
+		{"/a%2fb", 200, 400},
+		{"/a/%2e/b", 200, 400},
+	}
+	for _, mode := range []string{"basic", "strict"} {
+		suspiciousPaths = mode
+		for _, tt := range tests {
+			want := tt.basic
+			if mode == "strict" {
+				want = tt.strict
+			}
+			if got := status(tt.target); got != want {
+				t.Errorf("%s: GET %s: status %d, want %d", mode, tt.target, got, want)
+			}
+		}
+	}
+	if !strings.Contains(console.String(), `Security: rejected request from 127.0.0.1 with suspicious path "/file%00.html" (null byte)`) {
+		t.Fatalf("rejection was not logged as a security event:\n%s", console.String())
+	}
+}
+
+func TestBufferJSONSetsContentLength(t *testing.T) {
+	useFakeRedis(t)
+	oldBuffer := bufferJSON
+	defer func() { bufferJSON = oldBuffer }()
+
+	// ResponseRecorder 不会自动设置 Content-Length，响应头只能来自 writeJSON
+	for _, buffer := range []bool{false, true} {
+		bufferJSON = buffer
+		rec := httptest.NewRecorder()
+		countHandler(rec, httptest.NewRequest("GET", "/count?page=home", nil))
+		length := rec.Header().Get("Content-Length")
+		if buffer && length != strconv.Itoa(rec.Body.Len()) {
+			t.Errorf("-buffer-json: Content-Length %q for a %d byte body", length, rec.Body.Len())
+		}
+		if !buffer && length != "" {
+			t.Errorf("without -buffer-json: Content-Length %q", length)
+		}
+	}
+
+	// 超过 2KB 的响应没有缓冲时使用分块传输
+	flags := make(map[string]interface{})
+	for i := 0; i < 200; i++ {
+		flags[fmt.Sprintf("feature_%03d", i)] = true
+	}
+	data, _ := json.Marshal(flags)
+	useFlagsFile(t, string(data))
+	srv := httptest.NewServer(http.HandlerFunc(flagsHandler))
+	defer srv.Close()
+	for _, buffer := range []bool{false, true} {
+		bufferJSON = buffer
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		chunked := len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+		if buffer && (chunked || resp.ContentLength != int64(len(body))) {
+			t.Errorf("-buffer-json: chunked=%v Content-Length %d for %d bytes", chunked, resp.ContentLength, len(body))
+		}
+		if !buffer && !chunked {
+			t.Errorf("without -buffer-json a %d byte response was not chunked", len(body))
+		}
+	}
+}
+
+// 写出总是返回 err 的 ResponseWriter
+type errorResponseWriter struct {
+	header http.Header
+	err    error
+}
+
+func (ew *errorResponseWriter) Header() http.Header       { return ew.header }
+func (ew *errorResponseWriter) WriteHeader(int)           {}
+func (ew *errorResponseWriter) Write([]byte) (int, error) { return 0, ew.err }
+
+func TestJSONWriteErrors(t *testing.T) {
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+	oldDebug := debugMode
+	defer func() { debugMode = oldDebug }()
+
+	// 返回本次写出产生的控制台日志
+	write := func(w http.ResponseWriter, r *http.Request, v interface{}) string {
+		before := len(console.String())
+		writeJSON(w, r, v)
+		return console.String()[before:]
+	}
+	req := httptest.NewRequest("GET", "/count?page=home", nil)
+	for _, debug := range []bool{false, true} {
+		debugMode = debug
+		for _, err := range []error{syscall.EPIPE, &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.ECONNRESET)}} {
+			out := write(&errorResponseWriter{http.Header{}, err}, req, CountResponse{Page: "home"})
+			if logged := strings.Contains(out, "Client disconnected while writing JSON response for /count"); logged != debug {
+				t.Errorf("debug=%v, %v: disconnect logged = %v: %q", debug, err, logged, out)
+			}
+			if strings.Contains(out, "Error writing") {
+				t.Errorf("debug=%v, %v: a disconnect was logged as an error: %q", debug, err, out)
+			}
+		}
+		// 其他写出失败不是客户端断开，始终作为错误记录
+		for _, err := range []error{io.ErrShortWrite, http.ErrHandlerTimeout} {
+			if out := write(&errorResponseWriter{http.Header{}, err}, req, CountResponse{Page: "home"}); !strings.Contains(out, "Error writing JSON response for /count: "+err.Error()) {
+				t.Errorf("debug=%v: %v was not logged as an error: %q", debug, err, out)
+			}
+		}
+	}
+
+	// 客户端断开后小响应仍能写入连接的缓冲区，Write 不返回错误，靠请求上下文发现
+	debugMode = true
+	gone, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec := httptest.NewRecorder()
+	if out := write(rec, req.WithContext(gone), CountResponse{Page: "home"}); !strings.Contains(out, "Client disconnected") || !strings.Contains(out, "context canceled") {
+		t.Errorf("write after the client left: %q", out)
+	}
+	if out := write(httptest.NewRecorder(), req, CountResponse{Page: "home"}); out != "" {
+		t.Errorf("a successful write logged %q", out)
+	}
+}
+
+// 客户端在 /count 写出响应之前断开：写出没有报错，但仍被识别为客户端断开，访问日志标记为客户端取消
+func TestCountClientDisconnectLogged(t *testing.T) {
+	useFakeRedis(t)
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+	logs := captureFileLog(t)
+	oldDebug := debugMode
+	debugMode = true
+	defer func() { debugMode = oldDebug }()
+
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	srv := httptest.NewServer(logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		<-closed
+		// 等待服务端的后台读取发现连接已关闭
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+			t.Error("the request context was not cancelled after the client left")
+		}
+		countHandler(w, r)
+	})))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET /count?page=home HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	close(closed)
+	<-done
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(logs.String(), "/count") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(console.String(), "Client disconnected while writing JSON response for /count") {
+		t.Errorf("disconnect was not logged:\n%s", console.String())
+	}
+	if strings.Contains(console.String(), "Error writing") {
+		t.Errorf("disconnect was logged as an error:\n%s", console.String())
+	}
+	if line := logs.String(); !strings.Contains(line, " cancelled=client") {
+		t.Errorf("access log line %q is not marked as cancelled by the client", line)
+	}
+}
+
+func TestGRPCCountService(t *testing.T) {
+	fr := useFakeRedis(t)
+	oldWarmedUp, oldAllowlist := warmedUp.Load(), pageAllowlist
+	warmedUp.Store(true)
+	pageAllowlist = map[string]bool{"home": true}
+	defer func() {
+		warmedUp.Store(oldWarmedUp)
+		pageAllowlist = oldAllowlist
+	}()
+
+	// 进程内的 gRPC 连接
+	ln := bufconn.Listen(1 << 20)
+	srv := newGRPCServer()
+	go srv.Serve(ln)
+	defer srv.Stop()
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	call := func(method, page string) (int64, error) {
+		out := new(wrapperspb.Int64Value)
+		err := conn.Invoke(context.Background(), "/httpserver.CountService/"+method, wrapperspb.String(page), out)
+		return out.GetValue(), err
+	}
+
+	for want := int64(1); want <= 2; want++ {
+		if count, err := call("IncrementCount", "home"); err != nil || count != want {
+			t.Fatalf("IncrementCount: %d, %v; want %d", count, err, want)
+		}
+	}
+	if count, err := call("GetCount", "home"); err != nil || count != 2 {
+		t.Fatalf("GetCount: %d, %v; want 2", count, err)
+	}
+	if got := fr.value("page.count.home"); got != "2" {
+		t.Fatalf("stored count %q, want 2 shared with /count", got)
+	}
+	// 与 /count 共用同一个计数
+	rec := httptest.NewRecorder()
+	countHandler(rec, httptest.NewRequest("GET", "/count?page=home", nil))
+	if count, _ := call("GetCount", "home"); count != 3 {
+		t.Fatalf("GetCount after /count: %d, want 3", count)
+	}
+
+	for _, tt := range []struct {
+		page string
+		code codes.Code
+	}{
+		{"", codes.InvalidArgument},
+		{"secret", codes.NotFound},
+	} {
+		if _, err := call("IncrementCount", tt.page); status.Code(err) != tt.code {
+			t.Errorf("IncrementCount(%q): %v, want %s", tt.page, err, tt.code)
+		}
+	}
+
+	topPagesCall := func(limit int32) ([]interface{}, error) {
+		out := new(structpb.ListValue)
+		err := conn.Invoke(context.Background(), "/httpserver.CountService/GetTopPages", wrapperspb.Int32(limit), out)
+		return out.AsSlice(), err
+	}
+	oldInterval, oldMax := pageMetricsInterval, pageMetricsMax
+	defer func() { pageMetricsInterval, pageMetricsMax = oldInterval, oldMax }()
+	pageMetricsInterval = 0
+	if _, err := topPagesCall(0); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("GetTopPages without -page-metrics-interval: %v, want FailedPrecondition", err)
+	}
+	pageMetricsInterval, pageMetricsMax = time.Minute, 100
+	fr.set("page.count.about", "5")
+	fr.set("page.count.blog", "1")
+	if err := refreshPageCounts(); err != nil {
+		t.Fatal(err)
+	}
+	pages, err := topPagesCall(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(pages); got != "[map[count:5 page:about] map[count:3 page:home]]" {
+		t.Errorf("GetTopPages(2) = %s, want about and home, highest first", got)
+	}
+	if pages, _ := topPagesCall(0); len(pages) != 3 {
+		t.Errorf("GetTopPages(0) returned %d pages, want all 3", len(pages))
+	}
+
+	warmedUp.Store(false)
+	if _, err := call("GetCount", "home"); status.Code(err) != codes.Unavailable {
+		t.Errorf("GetCount while warming up: %v, want Unavailable", err)
+	}
+}
+
+func TestMarkdownDirectoryIndex(t *testing.T) {
+	oldRender, oldIndex := renderMarkdown, markdownIndex
+	renderMarkdown, markdownIndex = true, true
+	defer func() { renderMarkdown, markdownIndex = oldRender, oldIndex }()
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"docs/install.md":   "# Install\n",
+		"docs/faq page.md":  "# FAQ\n",
+		"docs/notes.txt":    "notes",
+		"site/index.html":   "home",
+		"site/about.md":     "# About\n",
+		"plain/readme.txt":  "text only",
+		"docs/sub/child.md": "# Child\n",
+	} {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := newStaticHandler(root, staticOptions{})
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := get("/docs/")
+	if code != http.StatusOK {
+		t.Fatalf("/docs/: status %d", code)
+	}
+	for _, want := range []string{"<h1>Index of /docs/</h1>", `<a href="install.md">install.md</a>`, `<a href="faq%20page.md">faq page.md</a>`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/docs/ index does not contain %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "notes.txt") || strings.Contains(body, "sub") {
+		t.Errorf("/docs/ index lists entries other than .md files:\n%s", body)
+	}
+	// 链接的 Markdown 文件渲染为 HTML
+	if code, body := get("/docs/install.md"); code != http.StatusOK || !strings.Contains(body, "<h1>Install</h1>") {
+		t.Errorf("/docs/install.md: %d %q", code, body)
+	}
+	// 有 index.html 的目录和没有 Markdown 文件的目录不受影响
+	if code, body := get("/site/"); code != http.StatusOK || body != "home" {
+		t.Errorf("/site/: %d %q, want its index.html", code, body)
+	}
+	if code, body := get("/plain/"); code != http.StatusOK || !strings.Contains(body, `<a href="readme.txt">readme.txt</a>`) {
+		t.Errorf("/plain/: %d %q, want the normal listing", code, body)
+	}
+}
+
+func TestRejectedRequestsAreCounted(t *testing.T) {
+	root := t.TempDir()
+	big, err := os.Create(filepath.Join(root, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := big.Truncate(256 << 20); err != nil {
+		t.Fatal(err)
+	}
+	big.Close()
+	port := freePort(t)
+	_, out := startMain(t, "-no-count", "-root", root, "-p", port, "-max-conns-per-ip", "1", "-reject-suspicious-paths", "basic")
+	base := "http://127.0.0.1:" + port
+	getWhenUp(t, http.DefaultClient, base+"/readyz").Body.Close()
+
+	// 不读取的大文件下载占用这个 IP 唯一的名额
+	download, err := http.Get(base + "/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Get(base + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second concurrent request: status %d, want 429", resp.StatusCode)
+	}
+	download.Body.Close()
+	client.CloseIdleConnections()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "GET /..%2fetc/passwd HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	io.ReadAll(conn)
+	conn.Close()
+
+	// 下载的连接关闭后名额才释放
+	var metrics string
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(base + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		metrics = string(body)
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/metrics stayed at %d:\n%s", resp.StatusCode, out.String())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// 429 和 400 各至少一次，/metrics 在重试期间可能还有 429
+	match := regexp.MustCompile(`http_requests_total\{class="4xx"\} (\d+)`).FindStringSubmatch(metrics)
+	if match == nil {
+		t.Fatalf("no 4xx counter in /metrics:\n%s", metrics)
+	}
+	if n, _ := strconv.Atoi(match[1]); n < 2 {
+		t.Fatalf("4xx counter is %d, want the 429 and the 400 counted:\n%s", n, metrics)
+	}
+}
+
+func TestLogSNI(t *testing.T) {
+	oldSNI := logSNI
+	logSNI = true
+	defer func() { logSNI = oldSNI }()
+	logs := captureFileLog(t)
+	handler := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+	plainSrv := httptest.NewServer(handler)
+	defer plainSrv.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "docs.example.com"}}}
+	resp, err := client.Get(tlsSrv.URL + "/tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = http.Get(plainSrv.URL + "/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2:\n%s", len(lines), logs.String())
+	}
+	for _, line := range lines {
+		switch {
+		case strings.Contains(line, "/tls "):
+			if !strings.HasSuffix(line, " sni=docs.example.com") {
+				t.Errorf("TLS request line %q does not carry the SNI name", line)
+			}
+		case strings.Contains(line, "/plain "):
+			if strings.Contains(line, "sni=") {
+				t.Errorf("plain HTTP line %q carries an SNI field", line)
+			}
+		default:
+			t.Errorf("unexpected log line %q", line)
+		}
+	}
+}
+
+// 生成一张证书；parent 为 nil 时自签名，isCA 为 true 时可以签发其他证书
+func issueCert(t *testing.T, commonName string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func TestClientCertAuth(t *testing.T) {
+	caPair, caCert := issueCert(t, "test CA", true, nil, nil)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := loadClientCAs(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 主题中带换行的合法证书不能在日志里伪造出新的一行
+	valid, _ := issueCert(t, "alice\nGET /forged 200", false, caCert, caPair.PrivateKey.(*ecdsa.PrivateKey))
+	rogue, _ := issueCert(t, "mallory", false, nil, nil)
+
+	logs := captureFileLog(t)
+	start := func(mode string) *httptest.Server {
+		srv := httptest.NewUnstartedServer(logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+		srv.TLS = &tls.Config{ClientAuth: clientAuthModes[mode], ClientCAs: pool}
+		srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	// 不管服务端接受哪些 CA 都发送给定的证书
+	get := func(srv *httptest.Server, path string, cert *tls.Certificate) error {
+		config := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return cert, nil }
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		defer client.CloseIdleConnections()
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	strict := start("require-and-verify")
+	if err := get(strict, "/none", nil); err == nil {
+		t.Error("request without a client certificate was accepted")
+	}
+	if err := get(strict, "/rogue", &rogue); err == nil {
+		t.Error("request with a certificate from an unknown CA was accepted")
+	}
+	if err := get(strict, "/valid", &valid); err != nil {
+		t.Fatalf("request with a valid client certificate failed: %v", err)
+	}
+
+	// request 模式接受任意证书，但未经校验的主题不写入日志
+	lenient := start("request")
+	if err := get(lenient, "/unverified", &rogue); err != nil {
+		t.Fatalf("request mode rejected a certificate: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2:\n%s", len(lines), logs.String())
+	}
+	if want := ` client_cert="CN=alice\nGET /forged 200"`; !strings.Contains(lines[0], "/valid ") || !strings.HasSuffix(lines[0], want) {
+		t.Errorf("log line %q, want a quoted subject %s", lines[0], want)
+	}
+	if !strings.Contains(lines[1], "/unverified ") || strings.Contains(lines[1], "client_cert") {
+		t.Errorf("log line %q carries an unverified certificate subject", lines[1])
+	}
+}
+
+func TestHTTP2StreamResetLoggedAsClientCancel(t *testing.T) {
+	logs := captureFileLog(t)
+	started := make(chan int, 2)
+	srv := httptest.NewUnstartedServer(logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/partial" {
+			w.Write([]byte("first chunk"))
+			http.NewResponseController(w).Flush()
+		}
+		started <- r.ProtoMajor
+		<-r.Context().Done()
+	})))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	client := srv.Client()
+
+	// 客户端取消请求时 HTTP/2 只重置这一个流，连接保持打开
+	reset := func(path string) {
+		t.Helper()
+		reqCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, _ := http.NewRequestWithContext(reqCtx, "GET", srv.URL+path, nil)
+		errs := make(chan error, 1)
+		go func() {
+			resp, err := client.Do(req)
+			if err == nil {
+				_, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			errs <- err
+		}()
+		if proto := <-started; proto != 2 {
+			t.Fatalf("request used HTTP/%d, want HTTP/2", proto)
+		}
+		cancel()
+		if err := <-errs; err == nil {
+			t.Fatalf("%s completed despite the reset", path)
+		}
+	}
+	reset("/silent")
+	reset("/partial")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for strings.Count(logs.String(), "\n") < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2:\n%s", len(lines), logs.String())
+	}
+	for _, line := range lines {
+		switch {
+		case strings.Contains(line, "/silent "):
+			// 没有发出任何响应体，客户端实际上没有收到响应
+			if !strings.Contains(line, " /silent 499 ") || !strings.HasSuffix(line, " cancelled=client") {
+				t.Errorf("reset before the response: %q", line)
+			}
+		case strings.Contains(line, "/partial "):
+			if !strings.Contains(line, " /partial 200 ") || !strings.HasSuffix(line, " cancelled=client") {
+				t.Errorf("reset after the first chunk: %q", line)
+			}
+		default:
+			t.Errorf("unexpected log line %q", line)
+		}
+	}
+}
+
+func TestNegotiatedStaticErrors(t *testing.T) {
+	handler := negotiatedErrors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		// 模拟 http.FileServer 读取文件失败，错误信息不应泄露给客户端
+		w.Header().Set("ETag", `"abc"`)
+		http.Error(w, "read /srv/www/page.html: input/output error", http.StatusInternalServerError)
+	}))
+	serve := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("/page.html", "application/json")
+	var body ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("JSON error body %q: %v", rec.Body.String(), err)
+	}
+	if rec.Code != 500 || rec.Header().Get("Content-Type") != "application/json" || body != (ErrorResponse{Error: "Internal Server Error", Status: 500}) {
+		t.Fatalf("JSON error: %d %q %+v", rec.Code, rec.Header().Get("Content-Type"), body)
+	}
+	if rec.Header().Get("ETag") != "" || !strings.Contains(rec.Header().Get("Vary"), "Accept") {
+		t.Errorf("JSON error headers %v", rec.Header())
+	}
+
+	rec = serve("/page.html", "text/html,application/xhtml+xml,*/*;q=0.8")
+	if rec.Code != 500 || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") || !strings.Contains(rec.Body.String(), "Internal Server Error") {
+		t.Fatalf("HTML error: %d %q %q", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	for _, rec := range []*httptest.ResponseRecorder{serve("/page.html", "application/json"), rec} {
+		if strings.Contains(rec.Body.String(), "input/output error") {
+			t.Errorf("error body leaks the read error: %q", rec.Body.String())
+		}
+	}
+
+	// 4xx 响应原样透传
+	if rec := serve("/missing", "application/json"); rec.Code != 404 || rec.Body.String() != "404 page not found\n" {
+		t.Errorf("404: %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRedisAuthErrors(t *testing.T) {
+	fr := startFakeRedis(t)
+	fr.mu.Lock()
+	fr.authErr = "NOAUTH Authentication required."
+	fr.mu.Unlock()
+
+	// 启动时给出明确的凭据错误，并且不会因为 -redis-connect-retries 而重试
+	out, err := runMain(t, "-redis-addr", fr.ln.Addr().String(), "-redis-connect-retries", "5", "-root", t.TempDir(), "-p", freePort(t))
+	if err == nil {
+		t.Fatalf("server started with rejected credentials:\n%s", out)
+	}
+	if !strings.Contains(out, "Redis rejected the credentials, check -redis-password: NOAUTH") {
+		t.Fatalf("startup failure does not name the credentials:\n%s", out)
+	}
+	if strings.Contains(out, "retrying") {
+		t.Fatalf("an authentication error was retried:\n%s", out)
+	}
+
+	// 运行中出现的认证错误返回 503 和 X-Error-Code: redis-auth
+	oldClient := redisClient
+	redisClient = redis.NewClient(&redis.Options{Addr: fr.ln.Addr().String(), MaxRetries: -1})
+	defer func() {
+		redisClient.Close()
+		redisClient = oldClient
+	}()
+	console := &logBuffer{}
+	oldConsole := consoleLogger.Writer()
+	consoleLogger.SetOutput(console)
+	defer consoleLogger.SetOutput(oldConsole)
+	rec := httptest.NewRecorder()
+	countHandler(rec, httptest.NewRequest("GET", "/count?page=home", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("X-Error-Code") != "redis-auth" {
+		t.Fatalf("count with rejected credentials: %d X-Error-Code %q, want 503 redis-auth", rec.Code, rec.Header().Get("X-Error-Code"))
+	}
+}
+
+func TestCountTrend(t *testing.T) {
+	fr := useFakeRedis(t)
+	oldTrends := trendsEnabled
+	trendsEnabled = true
+	defer func() { trendsEnabled = oldTrends }()
+
+	trendOf := func(page string) *CountTrend {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		countHandler(rec, httptest.NewRequest("GET", "/count?trend=true&page="+page, nil))
+		var resp CountResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Trend == nil {
+			t.Fatalf("/count?trend=true: %d %q", rec.Code, rec.Body.String())
+		}
+		return resp.Trend
+	}
+	// 按“几分钟之前”写入分钟桶，离整小时边界足够远，测试期间跨分钟也不影响归属
+	seed := func(page string, buckets map[int64]int) {
+		now := time.Now().Unix() / 60
+		for minutesAgo, n := range buckets {
+			fr.set(trendBucketKey(page, now-minutesAgo), strconv.Itoa(n))
+		}
+	}
+
+	// 访问量逐步上升：前一小时 1+2，最近一小时 3+4，再加上本次请求
+	seed("rising", map[int64]int{100: 1, 70: 2, 30: 3, 5: 4})
+	if trend := trendOf("rising"); trend.PriorHour != 3 || trend.LastHour != 8 || trend.Direction != "up" {
+		t.Fatalf("rising trend = %+v, want 8 vs 3 up", trend)
+	}
+	if got := fr.value(trendBucketKey("rising", time.Now().Unix()/60)); got != "1" {
+		t.Fatalf("current minute bucket = %q after one hit", got)
+	}
+
+	seed("falling", map[int64]int{90: 10, 20: 2})
+	if trend := trendOf("falling"); trend.PriorHour != 10 || trend.LastHour != 3 || trend.Direction != "down" {
+		t.Fatalf("falling trend = %+v, want 3 vs 10 down", trend)
+	}
+
+	// 两小时之前的桶不参与比较
+	seed("old", map[int64]int{130: 50, 80: 1})
+	if trend := trendOf("old"); trend.PriorHour != 1 || trend.LastHour != 1 || trend.Direction != "flat" {
+		t.Fatalf("trend with an expired bucket = %+v, want 1 vs 1 flat", trend)
+	}
+
+	trendsEnabled = false
+	rec := httptest.NewRecorder()
+	countHandler(rec, httptest.NewRequest("GET", "/count?trend=true&page=rising", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("trend without -trends: status %d, want 400", rec.Code)
+	}
+}
+
+func TestConfirmedCounting(t *testing.T) {
+	fr := useFakeRedis(t)
+	oldWindow := confirmWindow
+	confirmWindow = 200 * time.Millisecond
+	defer func() { confirmWindow = oldWindow }()
+
+	pending := func() CountResponse {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		countHandler(rec, httptest.NewRequest("GET", "/count?page=home", nil))
+		var resp CountResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.ConfirmToken == "" || rec.Header().Get("X-Confirm-Token") != resp.ConfirmToken {
+			t.Fatalf("/count did not return a confirm token: %d %q", rec.Code, rec.Body.String())
+		}
+		return resp
+	}
+	confirm := func(token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		confirmHandler(rec, httptest.NewRequest("POST", "/count/confirm?token="+token, nil))
+		return rec
+	}
+
+	confirmed, prefetched := pending(), pending()
+	if confirmed.Count != 0 || fr.value("page.count.home") != "" {
+		t.Fatalf("pending hits were counted: response %d, stored %q", confirmed.Count, fr.value("page.count.home"))
+	}
+	if rec := confirm(confirmed.ConfirmToken); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"count":1`) {
+		t.Fatalf("confirm: %d %q", rec.Code, rec.Body.String())
+	}
+	// 同一个令牌只能确认一次
+	if rec := confirm(confirmed.ConfirmToken); rec.Code != http.StatusNotFound {
+		t.Fatalf("second confirm: status %d, want 404", rec.Code)
+	}
+
+	// 预取的页面从未渲染，令牌过期后无法再确认，计数保持不变
+	time.Sleep(250 * time.Millisecond)
+	if fr.value("page.pending."+prefetched.ConfirmToken) != "" {
+		t.Fatal("the unconfirmed pending hit did not expire")
+	}
+	if rec := confirm(prefetched.ConfirmToken); rec.Code != http.StatusNotFound {
+		t.Fatalf("confirm after the window: status %d, want 404", rec.Code)
+	}
+	if got := fr.value("page.count.home"); got != "1" {
+		t.Fatalf("stored count %q, want only the confirmed hit", got)
+	}
+}
@@ -0,0 +1,185 @@
+//go:build unix
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 打开命名管道会一直阻塞到有写入方，处理器必须在打开之前拒绝它
+func TestRegularFilesOnlyRefusesFIFO(t *testing.T) {
+	root := t.TempDir()
+	if err := syscall.Mkfifo(filepath.Join(root, "pipe"), 0644); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(root, "dir", "index.html"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler := regularFilesOnly(root, http.FileServer(http.Dir(root)))
+
+	for _, target := range []string{"/pipe", "/dir/"} {
+		done := make(chan int, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+			done <- rec.Code
+		}()
+		select {
+		case code := <-done:
+			if code != http.StatusForbidden {
+				t.Errorf("GET %s: status %d, want 403", target, code)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("GET %s blocked instead of being refused", target)
+		}
+	}
+}
+
+func TestRegularFilesOnlyRefusesDevice(t *testing.T) {
+	if _, err := os.Stat("/dev/null"); err != nil {
+		t.Skip("no /dev/null")
+	}
+	handler := regularFilesOnly("/dev", http.FileServer(http.Dir("/dev")))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/null", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status %d, want 403", rec.Code)
+	}
+}
+
+// 把日志行逐行转发到 channel
+type lineWriter chan string
+
+func (lw lineWriter) Write(b []byte) (int, error) {
+	lw <- string(b)
+	return len(b), nil
+}
+
+func TestFlagsReloadOnSIGHUP(t *testing.T) {
+	file := useFlagsFile(t, `{"theme": "light"}`)
+	watchReloadSignal()
+
+	// 等待重新加载的日志行，确保信号处理 goroutine 读完 featureFlagsFile 后才恢复全局变量
+	lines := make(lineWriter, 16)
+	oldOutput := consoleLogger.Writer()
+	consoleLogger.SetOutput(lines)
+	defer consoleLogger.SetOutput(oldOutput)
+
+	if err := os.WriteFile(file, []byte(`{"theme": "dark"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			if !strings.Contains(line, "Reloaded feature flags") {
+				continue
+			}
+			if theme := getFlags(t)["theme"]; theme != "dark" {
+				t.Fatalf("theme = %v after SIGHUP, want dark", theme)
+			}
+			return
+		case <-timeout:
+			t.Fatal("feature flags were not reloaded after SIGHUP")
+		}
+	}
+}
+
+func TestHTTPAndHTTPSListenersShutDownTogether(t *testing.T) {
+	certFile, keyFile := writeSelfSignedCert(t, t.TempDir())
+	port, tlsPort := freePort(t), freePort(t)
+	cmd, _ := startMain(t, "-no-count", "-root", t.TempDir(), "-p", port, "-tls-port", tlsPort, "-cert", certFile, "-key", keyFile)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	getWhenUp(t, client, "http://127.0.0.1:"+port+"/").Body.Close()
+	getWhenUp(t, client, "https://127.0.0.1:"+tlsPort+"/").Body.Close()
+	client.CloseIdleConnections()
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("server exited with %v after SIGTERM", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("server did not shut down after SIGTERM")
+	}
+	for _, addr := range []string{"127.0.0.1:" + port, "127.0.0.1:" + tlsPort} {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("%s still accepts connections after shutdown", addr)
+		}
+	}
+}
+
+func TestConfiguredShutdownSignal(t *testing.T) {
+	port := freePort(t)
+	cmd, out := startMain(t, "-no-count", "-root", t.TempDir(), "-p", port, "-shutdown-signals", "SIGQUIT")
+	getWhenUp(t, http.DefaultClient, "http://127.0.0.1:"+port+"/").Body.Close()
+
+	// SIGQUIT 默认会让 Go 程序打印堆栈后退出，配置后应当优雅关闭
+	if err := cmd.Process.Signal(syscall.SIGQUIT); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("server exited with %v after SIGQUIT", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("server did not shut down after SIGQUIT")
+	}
+	if !strings.Contains(out.String(), "Shutting down server...") || !strings.Contains(out.String(), "Shutdown summary:") {
+		t.Fatalf("no graceful shutdown in the output:\n%s", out.String())
+	}
+}
+
+func TestGRPCServerShutsDownWithHTTP(t *testing.T) {
+	fr := startFakeRedis(t)
+	port, grpcPort := freePort(t), freePort(t)
+	cmd, out := startMain(t, "-root", t.TempDir(), "-p", port, "-grpc-port", grpcPort, "-redis-addr", fr.ln.Addr().String())
+	getWhenUp(t, http.DefaultClient, "http://127.0.0.1:"+port+"/").Body.Close()
+	if conn, err := net.Dial("tcp", "127.0.0.1:"+grpcPort); err != nil {
+		t.Fatalf("gRPC port is not listening: %v\n%s", err, out.String())
+	} else {
+		conn.Close()
+	}
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("server exited with %v after SIGTERM:\n%s", err, out.String())
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("server did not shut down after SIGTERM")
+	}
+	if conn, err := net.Dial("tcp", "127.0.0.1:"+grpcPort); err == nil {
+		conn.Close()
+		t.Fatal("gRPC port still accepts connections after shutdown")
+	}
+}